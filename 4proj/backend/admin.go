@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Admin holds the operator facing RPCs, kept apart from the ones the frontend uses
+type Admin struct {
+	backend *Backend
+}
+
+// PeerStatus is how far along the leader thinks a peer is
+type PeerStatus struct {
+	ID         string
+	Addr       string
+	NextIndex  uint64
+	MatchIndex uint64
+	Lag        uint64
+	Connected  bool
+	Priority   int
+	Witness    bool
+}
+
+// StatusReply describes a node's view of raft
+type StatusReply struct {
+	Node   string
+	Addr   string
+	State  string
+	Term   uint64
+	Leader string
+
+	LeaderAddr string
+	Priority   int
+
+	CommitIndex  uint64
+	LastApplied  uint64
+	LastLogIndex uint64
+	LogBase      uint64 // the log has been compacted up to here
+
+	Removed bool
+	Peers   []PeerStatus
+
+	LeaderLag   uint64        // committed entries we have yet to apply, as a follower
+	SinceLeader time.Duration // since we last heard from the leader, or a majority last answered it on the leader
+}
+
+// DumpLogArgs picks which log entries to dump, To of 0 means up to the end of the log and an
+// empty Action means every action
+type DumpLogArgs struct {
+	From   uint64
+	To     uint64
+	Action string
+}
+
+// LogEntryInfo is a log entry as it's stored, with its command left encoded
+type LogEntryInfo struct {
+	Index   uint64
+	Term    uint64
+	Action  string
+	Version uint32
+	Data    json.RawMessage
+
+	Client     string `json:",omitempty"`
+	OnBehalfOf string `json:",omitempty"`
+	Time       int64  `json:",omitempty"`
+}
+
+// TransferLeaderArgs names who should take over leadership by node ID
+type TransferLeaderArgs struct {
+	Target string
+}
+
+// Status exposes RPC to see this node's role, indexes, and (on the leader) how far behind each peer is
+func (admin *Admin) Status(args int, reply *StatusReply) error {
+	server := admin.backend.raft
+
+	lag, age, _ := server.lag() // zero when we don't know of a leader, the leader's age is since a majority answered
+
+	server.lock <- true
+	defer func() {
+		<-server.lock
+	}()
+
+	server.logLock <- true
+	defer func() {
+		<-server.logLock
+	}()
+
+	last := server.lastIndex()
+
+	*reply = StatusReply{
+		Node:   server.Self,
+		Addr:   server.Addr,
+		State:  server.State,
+		Term:   server.Term,
+		Leader: server.Leader,
+
+		LeaderAddr: server.leaderAddr(),
+		Priority:   server.config.Priority,
+
+		CommitIndex:  server.commitIndex,
+		LastApplied:  server.lastApplied,
+		LastLogIndex: last,
+		LogBase:      server.logBase(),
+
+		LeaderLag:   lag,
+		SinceLeader: age,
+
+		Removed: server.removed,
+		Peers:   []PeerStatus{},
+	}
+
+	for _, node := range server.peersLocked() {
+		peer := PeerStatus{
+			ID:         node.ID,
+			Addr:       node.Addr,
+			NextIndex:  node.nextIndex,
+			MatchIndex: node.matchIndex,
+			Connected:  node.client != nil,
+			Priority:   node.priority,
+			Witness:    node.witness,
+		}
+		if node.matchIndex < last {
+			peer.Lag = last - node.matchIndex
+		}
+		reply.Peers = append(reply.Peers, peer)
+	}
+
+	return nil
+}
+
+// DumpLog exposes RPC to read back raw log entries
+func (admin *Admin) DumpLog(args *DumpLogArgs, reply *[]LogEntryInfo) error {
+	server := admin.backend.raft
+
+	server.logLock <- true
+	defer func() {
+		<-server.logLock
+	}()
+
+	to := args.To
+	if to == 0 || to > server.lastIndex() {
+		to = server.lastIndex()
+	}
+	from := args.From
+	if from <= server.logBase() {
+		from = server.logBase() + 1 // the base is a placeholder for what's been compacted, not a real entry
+	}
+
+	*reply = []LogEntryInfo{}
+	for i := from; i <= to; i++ {
+		entry := server.entry(i)
+		if args.Action != "" && entry.Command.Action != args.Action {
+			continue
+		}
+
+		*reply = append(*reply, LogEntryInfo{
+			Index:   entry.Index,
+			Term:    entry.Term,
+			Action:  entry.Command.Action,
+			Version: entry.Command.Version,
+			Data:    entry.Command.Data,
+
+			Client:     entry.Command.Client,
+			OnBehalfOf: entry.Command.OnBehalfOf,
+			Time:       entry.Command.Time,
+		})
+	}
+
+	return nil
+}
+
+// AddNode exposes RPC to add a node to the cluster, it has to be sent to the leader
+func (admin *Admin) AddNode(args *MembershipArgs, reply *bool) error {
+	if !admin.backend.raft.isLeader() {
+		return admin.backend.notLeader()
+	}
+
+	err := admin.backend.raft.changeMembership(addNodeAction, *args)
+	*reply = err == nil
+
+	return err
+}
+
+// RemoveNode exposes RPC to take a node out of the cluster, it has to be sent to the leader
+func (admin *Admin) RemoveNode(args *MembershipArgs, reply *bool) error {
+	if !admin.backend.raft.isLeader() {
+		return admin.backend.notLeader()
+	}
+
+	err := admin.backend.raft.changeMembership(removeNodeAction, *args)
+	*reply = err == nil
+
+	return err
+}
+
+// TransferLeader exposes RPC to hand leadership to another node, it has to be sent to the leader
+func (admin *Admin) TransferLeader(args *TransferLeaderArgs, reply *bool) error {
+	if !admin.backend.raft.isLeader() {
+		return admin.backend.notLeader()
+	}
+
+	if args.Target == "" {
+		return errors.New("no target to transfer leadership to")
+	}
+
+	err := admin.backend.raft.TransferLeadership(args.Target)
+	*reply = err == nil
+
+	return err
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"../protos"
+)
+
+// auditPrefix is where every change to a giraffe is recorded, by giraffe Idx and then log index. Deleting a
+// giraffe adds one too. Records more than HistoryRetention entries old are collected, apart from the one each
+// giraffe was left with, so the history still says how it was as of the oldest index we keep
+const auditPrefix = "audit/"
+
+// auditOrderPrefix lists every audit record by log index then giraffe idx, so collecting and reads of every giraffe
+// at a past index only look at the records they need
+const auditOrderPrefix = "auditorder/"
+
+// auditOrderedKey is set once a store's audit records are all in auditOrderPrefix
+const auditOrderedKey = "meta/auditordered"
+
+// collectedIdxKey is one past the highest idx whose records have all been collected, so nextIdx doesn't hand it
+// out again
+const collectedIdxKey = "meta/collectedidx"
+
+// AuditRecord is one change to a giraffe, who asked for it and when. Giraffe is how it was left, nil if deleted
+type AuditRecord struct {
+	Index      uint64
+	Action     string
+	Client     string
+	OnBehalfOf string `json:",omitempty"` // who the client said it was acting for
+	Time       int64  // the leader's clock when it was proposed, in milliseconds
+	Giraffe    *protos.Giraffe
+}
+
+// seedAction is what giraffes a brand new store starts with are recorded as
+const seedAction = "SeedGiraffe"
+
+func auditKey(idx uint64, index uint64) string {
+	return fmt.Sprintf("%v%016x/%016x", auditPrefix, idx, index)
+}
+
+// auditGiraffePrefix is where one giraffe's records are, in log index order
+func auditGiraffePrefix(idx uint64) string {
+	return fmt.Sprintf("%v%016x/", auditPrefix, idx)
+}
+
+func auditOrderKey(index uint64, idx uint64) string {
+	return fmt.Sprintf("%v%016x/%016x", auditOrderPrefix, index, idx)
+}
+
+// parseAuditOrderKey gives back the log index and giraffe idx an auditOrderKey was made from
+func parseAuditOrderKey(key string) (uint64, uint64, error) {
+	var index, idx uint64
+	_, err := fmt.Sscanf(key[len(auditOrderPrefix):], "%016x/%016x", &index, &idx)
+	return index, idx, err
+}
+
+// parseAuditKey gives back the giraffe idx and log index an auditKey was made from
+func parseAuditKey(key string) (uint64, uint64, error) {
+	var idx, index uint64
+	_, err := fmt.Sscanf(key[len(auditPrefix):], "%016x/%016x", &idx, &index)
+	return idx, index, err
+}
+
+// auditOps records a command that changed giraffe idx, to be applied along with the change itself
+func auditOps(index uint64, idx uint64, command Command, giraffe *protos.Giraffe) []StoreOp {
+	value, _ := json.Marshal(AuditRecord{
+		Index:      index,
+		Action:     command.Action,
+		Client:     command.Client,
+		OnBehalfOf: command.OnBehalfOf,
+		Time:       command.Time,
+		Giraffe:    giraffe,
+	})
+	return []StoreOp{{Key: auditKey(idx, index), Value: value}, {Key: auditOrderKey(index, idx), Value: []byte{}}}
+}
+
+// historyFloor is the oldest log index reads can still go back to once index is applied
+func historyFloor(index uint64) uint64 {
+	if index < HistoryRetention {
+		return 0
+	}
+	return index - HistoryRetention
+}
+
+// auditSpot is one record found in auditOrderPrefix
+type auditSpot struct {
+	index uint64
+	idx   uint64
+}
+
+// collectHistoryOps drops up to HistoryCollectBatch audit records that have fallen behind the history floor as of
+// index, oldest first, to go in the batch applied at index. Every batch that records changes collects some, so
+// the trail keeps up with the writes growing it. Records are collected once a newer one of the same giraffe is
+// behind the floor too, and a deleted giraffe's last record goes once it's behind the floor. storelock must be held
+func (backend *Backend) collectHistoryOps(index uint64) ([]StoreOp, error) {
+	floor := historyFloor(index)
+
+	spots := []auditSpot{}
+	err := backend.disk.Scan(auditOrderPrefix, func(key string, value []byte) error {
+		recordIndex, idx, err := parseAuditOrderKey(key)
+		if err != nil {
+			return err
+		}
+		if recordIndex >= floor || len(spots) == HistoryCollectBatch {
+			return errPastRange
+		}
+		spots = append(spots, auditSpot{index: recordIndex, idx: idx})
+		return nil
+	})
+	if err != nil && err != errPastRange {
+		return nil, err
+	}
+
+	ops := []StoreOp{}
+	collected := uint64(0)
+	for _, spot := range spots {
+		ops = append(ops, StoreOp{Key: auditOrderKey(spot.index, spot.idx), Delete: true})
+
+		// Everything this giraffe was before is superseded by a record that's also behind the floor
+		last := auditKey(spot.idx, spot.index)
+		err = backend.disk.Scan(auditGiraffePrefix(spot.idx), func(key string, value []byte) error {
+			if key >= last {
+				return errPastRange
+			}
+			ops = append(ops, StoreOp{Key: key, Delete: true})
+			return nil
+		})
+		if err != nil && err != errPastRange {
+			return nil, err
+		}
+
+		value, found, err := backend.disk.Get(last)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			continue
+		}
+		var record AuditRecord
+		err = json.Unmarshal(value, &record)
+		if err != nil {
+			return nil, err
+		}
+		if record.Giraffe == nil {
+			ops = append(ops, StoreOp{Key: last, Delete: true})
+			if spot.idx+1 > collected {
+				collected = spot.idx + 1
+			}
+		}
+	}
+
+	if collected > 0 {
+		value, found, err := backend.disk.Get(collectedIdxKey)
+		if err != nil {
+			return nil, err
+		}
+		if !found || binary.BigEndian.Uint64(value) < collected {
+			value = make([]byte, 8)
+			binary.BigEndian.PutUint64(value, collected)
+			ops = append(ops, StoreOp{Key: collectedIdxKey, Value: value})
+		}
+	}
+
+	return ops, nil
+}
+
+// orderAudit lists audit records from before auditOrderPrefix existed in it, once
+func (backend *Backend) orderAudit() error {
+	_, ordered, err := backend.disk.Get(auditOrderedKey)
+	if err != nil || ordered {
+		return err
+	}
+
+	ops := []StoreOp{}
+	err = backend.disk.Scan(auditPrefix, func(key string, value []byte) error {
+		idx, index, err := parseAuditKey(key)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, StoreOp{Key: auditOrderKey(index, idx), Value: []byte{}})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ops = append(ops, StoreOp{Key: auditOrderedKey, Value: []byte{}})
+	return backend.disk.Apply(backend.disk.Applied(), ops...)
+}
+
+// GiraffeHistoryArgs picks a giraffe and how stale an answer can be
+type GiraffeHistoryArgs struct {
+	Idx       uint64
+	Staleness Staleness
+}
+
+// GiraffeHistory exposes RPC to list every recorded change to a giraffe, oldest first
+func (backend *Backend) GiraffeHistory(args *GiraffeHistoryArgs, reply *[]AuditRecord) error {
+	err := backend.checkStaleness(args.Staleness)
+	if err != nil {
+		return err
+	}
+
+	backend.storelock <- true
+	defer func() {
+		<-backend.storelock
+	}()
+
+	*reply = []AuditRecord{}
+
+	return backend.disk.Scan(auditGiraffePrefix(args.Idx), func(key string, value []byte) error {
+		var record AuditRecord
+		err := json.Unmarshal(value, &record)
+		if err != nil {
+			return err
+		}
+		*reply = append(*reply, record)
+		return nil
+	})
+}
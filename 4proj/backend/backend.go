@@ -1,113 +1,382 @@
 package main
 
 import (
-	"encoding/gob"
+	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"net/rpc"
-
-	"./protos"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"../protos"
+	"../tlsconf"
 )
 
-// Command details our state machine operations
-type Command struct {
-	Action string
-	Data   interface{}
-}
-
 // Backend wraps raft and a data store
 type Backend struct {
-	listen string
-	raft   *Server
+	listen  string
+	dataDir string
+	raft    *Server
+	tls     *tls.Config
+
+	operators []string // certificate names admin RPCs are open to when TLS is on
 
 	idx       uint64
-	store     map[uint64]*protos.Giraffe
+	disk      *DiskStore // installSnapshot swaps it, so it's only used under storelock
 	storelock chan bool
+
+	applied    uint64
+	events     []WatchEvent
+	eventFloor uint64
+	eventSeq   uint64 // where the next event is kept in the store
+	changed    chan bool
+
+	backup string // the ID of the backup spooled in dataDir for BackupChunk, empty if there isn't one
+
+	clock int64
 }
 
 // CreateBackend is a constructor for backend
-func CreateBackend(listen string, backends string) *Backend {
+func CreateBackend(id string, listen string, backends string, dataDir string) *Backend {
 	backend := &Backend{
-		listen: listen,
-		idx:    3,
-		store: map[uint64]*protos.Giraffe{
-			0: &protos.Giraffe{
-				Idx:        0,
-				Name:       "leon",
-				NeckLength: 15,
-			},
-			1: &protos.Giraffe{
-				Idx:        1,
-				Name:       "Giraffe3",
-				NeckLength: 257,
-			},
-			2: &protos.Giraffe{
-				Idx:        2,
-				Name:       "Bob",
-				NeckLength: 12,
-			},
-		},
+		listen:    listen,
+		dataDir:   dataDir,
+		idx:       0,
 		storelock: make(chan bool, 1),
+
+		events:  []WatchEvent{},
+		changed: make(chan bool),
 	}
 
-	backend.raft = CreateServer(listen, backends, backend.CommitEntry)
+	backend.raft = CreateServer(id, listen, backends, backend.CommitEntry)
+	backend.raft.snapshot = backend.writeSnapshot
+	backend.raft.restore = backend.installSnapshot
 
 	return backend
 }
 
+// open loads the store from disk, seeding it if it is brand new, and rebuilds everything we keep in memory
+func (backend *Backend) open() error {
+	err := os.MkdirAll(backend.dataDir, 0755)
+	if err != nil {
+		return err
+	}
+	removeBackups(backend.dataDir)
+
+	disk, err := OpenDiskStore(filepath.Join(backend.dataDir, "giraffes.db"))
+	if err != nil {
+		return err
+	}
+	backend.disk = disk
+
+	if disk.Applied() == 0 && len(disk.sorted) == 0 {
+		ops := []StoreOp{}
+		for _, giraffe := range seedGiraffes {
+			ops = append(ops, putGiraffeOp(giraffe))
+			ops = append(ops, auditOps(0, giraffe.Idx, Command{Action: seedAction}, giraffe)...)
+		}
+
+		err = disk.Apply(0, ops...)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = backend.loadClock()
+	if err != nil {
+		return err
+	}
+
+	backend.applied = disk.Applied()
+
+	err = backend.loadEvents()
+	if err != nil {
+		return err
+	}
+	err = backend.buildIndex()
+	if err != nil {
+		return err
+	}
+	err = backend.orderAudit()
+	if err != nil {
+		return err
+	}
+	backend.idx, err = backend.nextIdx()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Opened store at %v, resuming from applied index %v\n", backend.dataDir, backend.applied)
+
+	return backend.raft.Open(backend.dataDir, backend.applied)
+}
+
 // CommitEntry is a callback by raft to commit entries to this state machine
-func (backend *Backend) CommitEntry(command Command) (interface{}, error) {
+func (backend *Backend) CommitEntry(index uint64, command Command) (interface{}, error) {
+	defer backend.markApplied(index)
+
+	if command.Version > CommandVersion {
+		// Skipping this would leave us out of sync with everyone who could apply it
+		log.Fatalf("Entry %v is %v at command version %v, this build only understands up to %v\n",
+			index, command.Action, command.Version, CommandVersion)
+	}
+
 	switch command.Action {
 	case "CreateGiraffe":
-		return backend.createGiraffe(command.Data)
+		return backend.createGiraffe(index, command)
 	case "EditGiraffe":
-		return backend.editGiraffe(command.Data)
+		return backend.editGiraffe(index, command)
 	case "DeleteGiraffe":
-		return backend.deleteGiraffe(command.Data)
+		return backend.deleteGiraffe(index, command)
+	case "AcquireLock":
+		return backend.acquireLock(index, command)
+	case "RenewLock":
+		return backend.renewLock(index, command)
+	case "ReleaseLock":
+		return backend.releaseLock(index, command)
+	case "Tick":
+		return backend.tick(index, command)
+	case "KVPut":
+		return backend.kvPut(index, command)
+	case "KVDelete":
+		return backend.kvDelete(index, command)
+	case "KVCas":
+		return backend.kvCas(index, command)
+	case addNodeAction, removeNodeAction:
+		return nil, nil // raft acted on these as soon as they reached the log
+	case startTermAction:
+		return nil, nil
 	}
 
 	return nil, fmt.Errorf("unrecognized command %v", command.Action)
 }
 
+// leaderNow is the leader's clock in milliseconds, it should only ever go into the log
+func leaderNow() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// propose adds a command to the log as the leader and waits for it to be applied
+func (backend *Backend) propose(command Command) (interface{}, error) {
+	command.Time = leaderNow()
+
+	entry, err := backend.raft.proposeEntry(command)
+	if err == errNotLeading {
+		return nil, backend.notLeader()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := backend.raft.awaitEntry(entry)
+	if err == errNotLeading {
+		return nil, backend.notLeader()
+	}
+	return reply, err
+}
+
+// notLeader builds the error followers give back for writes
+func (backend *Backend) notLeader() error {
+	return &protos.NotLeaderError{
+		Leader:   backend.raft.leaderAddr(),
+		Term:     backend.raft.Term,
+		LeaderID: backend.raft.Leader,
+	}
+}
+
+// UseTLS has every RPC to and from this backend go over mutual TLS, with peer RPCs limited to cluster members
+// and admin RPCs to certificates naming one of operators
+func (backend *Backend) UseTLS(config *tls.Config, operators []string) {
+	backend.tls = config
+	backend.operators = operators
+	backend.raft.tls = config
+}
+
 // Run will start the backend
 func (backend *Backend) Run() error {
+	witness := backend.raft.config.Witness
+
+	var err error
+	if witness {
+		err = backend.openWitness()
+	} else {
+		err = backend.open()
+	}
+	if err != nil {
+		return err
+	}
 
-	rpc.Register(backend)
-	rpc.Register(backend.raft)
+	if witness {
+		rpc.RegisterName("Backend", &Witness{raft: backend.raft})
+	} else {
+		rpc.Register(backend)
+	}
+	if backend.tls == nil {
+		rpc.Register(&Admin{backend: backend})
+		rpc.Register(backend.raft)
+	} else {
+		admin := rpc.NewServer()
+		admin.Register(&Admin{backend: backend})
+		http.Handle(tlsconf.AdminPath, backend.operatorsOnly(admin))
+
+		peers := rpc.NewServer()
+		peers.Register(backend.raft)
+		http.Handle(raftPath, backend.raft.membersOnly(peers))
+	}
 
 	go backend.raft.timeouts()
+	if !witness {
+		go backend.proposeTicks()
+	}
 
-	rpc.HandleHTTP()
-
-	gob.Register(Command{})
-	gob.Register(LogCreateGiraffeArgs{})
-	gob.Register(LogEditGiraffeArgs{})
+	if backend.tls == nil {
+		rpc.HandleHTTP()
+	} else {
+		http.Handle(rpc.DefaultRPCPath, identified(rpc.DefaultServer))
+	}
 
 	l, e := net.Listen("tcp", backend.listen)
 	if e != nil {
 		return e
 	}
+	if backend.tls != nil {
+		l = tls.NewListener(l, backend.tls)
+	}
 
 	return http.Serve(l, nil)
 }
 
-// Healthcheck provides a way to check if a server is ready
-func (backend *Backend) Healthcheck(args int, reply *bool) error {
+// ListEntriesArgs asks for a page of giraffes, Token comes from a previous reply's Next or Prev
+type ListEntriesArgs struct {
+	Token    string
+	PageSize int
 
-	*reply = backend.raft.Ready
+	Staleness Staleness
+}
 
-	return nil
+// ListEntriesReply holds a page of giraffes ordered by Idx, along with tokens for the pages around it
+type ListEntriesReply struct {
+	Giraffes []protos.Giraffe
+	Next     string
+	Prev     string
+}
+
+func encodePageToken(direction string, idx uint64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%v:%v", direction, idx)))
+}
+
+func decodePageToken(token string) (string, uint64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", 0, errors.New("invalid page token")
+	}
+
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 || (parts[0] != "after" && parts[0] != "before") {
+		return "", 0, errors.New("invalid page token")
+	}
+
+	idx, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return "", 0, errors.New("invalid page token")
+	}
+
+	return parts[0], idx, nil
 }
 
-// ListEntries gives back the status on all giraffes
-func (backend *Backend) ListEntries(args int, reply *[]protos.Giraffe) error {
-	*reply = []protos.Giraffe{}
+// ListEntries gives back a page of giraffes ordered by Idx
+func (backend *Backend) ListEntries(args *ListEntriesArgs, reply *ListEntriesReply) error {
+	err := backend.checkStaleness(args.Staleness)
+	if err != nil {
+		return err
+	}
+
+	size := args.PageSize
+	if size <= 0 {
+		size = DefaultPageSize
+	}
+	if size > MaxPageSize {
+		size = MaxPageSize
+	}
 
-	for _, giraffe := range backend.store {
-		*reply = append(*reply, *giraffe)
+	backend.storelock <- true
+	defer func() {
+		<-backend.storelock
+	}()
+
+	// One more than a page tells us whether there's a page after it
+	var ids []uint64
+	backwards := false
+	if args.Token == "" {
+		ids, err = backend.giraffeIdxs(0, size+1, false)
+	} else {
+		direction, idx, bad := decodePageToken(args.Token)
+		if bad != nil {
+			return bad
+		}
+
+		backwards = direction != "after"
+		if backwards {
+			ids, err = backend.giraffeIdxs(idx, size+1, true)
+		} else {
+			ids, err = backend.giraffeIdxs(idx+1, size+1, false)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	more := len(ids) > size
+	if more {
+		ids = ids[:size]
+	}
+	if backwards {
+		for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+			ids[i], ids[j] = ids[j], ids[i]
+		}
+	}
+	if len(ids) == 0 {
+		reply.Giraffes = []protos.Giraffe{}
+		return nil
+	}
+
+	first, last := ids[0], ids[len(ids)-1]
+	before, after := more && backwards, more && !backwards
+	if !backwards {
+		earlier, err := backend.giraffeIdxs(first, 1, true)
+		if err != nil {
+			return err
+		}
+		before = len(earlier) > 0
+	} else {
+		later, err := backend.giraffeIdxs(last+1, 1, false)
+		if err != nil {
+			return err
+		}
+		after = len(later) > 0
+	}
+
+	reply.Giraffes = []protos.Giraffe{}
+	for _, idx := range ids {
+		giraffe, err := backend.getGiraffe(idx)
+		if err != nil {
+			return err
+		}
+		reply.Giraffes = append(reply.Giraffes, *giraffe)
+	}
+
+	if before {
+		reply.Prev = encodePageToken("before", first)
+	}
+	if after {
+		reply.Next = encodePageToken("after", last)
 	}
 
 	return nil
@@ -117,72 +386,149 @@ func (backend *Backend) ListEntries(args int, reply *[]protos.Giraffe) error {
 type LogCreateGiraffeArgs struct {
 	Name string
 	Idx  uint64
+
+	TTL       int64  `json:",omitempty"` // milliseconds until it expires, 0 for never
+	RequestID string `json:",omitempty"` // the client's ID for the create, so retries don't make it twice
 }
 
-func (backend *Backend) createGiraffe(data interface{}) (*protos.Giraffe, error) {
+func (backend *Backend) createGiraffe(index uint64, command Command) (*protos.Giraffe, error) {
 	backend.storelock <- true
 	defer func() {
 		<-backend.storelock
 	}()
 
-	args := data.(LogCreateGiraffeArgs)
+	var args LogCreateGiraffeArgs
+	err := command.decode(&args)
+	if err != nil {
+		return nil, err
+	}
 
-	giraffe := &protos.Giraffe{
-		Idx:        args.Idx,
-		Name:       args.Name,
-		NeckLength: 0,
+	// A retry of a create that already went through gives back what it made
+	earlier, err := backend.requested(args.RequestID)
+	if err != nil || earlier != nil {
+		if args.Idx >= backend.idx {
+			backend.idx = args.Idx + 1
+		}
+		return earlier, err
+	}
+
+	// A leader that took over before applying everything can hand out an idx that's already taken. Every
+	// replica turns it down the same way, rather than overwriting the giraffe and leaving it indexed twice
+	existing, err := backend.getGiraffe(args.Idx)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		if args.Idx >= backend.idx {
+			backend.idx = args.Idx + 1
+		}
+		return nil, fmt.Errorf("giraffe %v already exists, try again", args.Idx)
+	}
+
+	giraffe := CreateGiraffe(args.Idx, args.Name)
+
+	collect, err := backend.collectHistoryOps(index)
+	if err != nil {
+		return nil, err
+	}
+
+	ops := append([]StoreOp{putGiraffeOp(giraffe)}, auditOps(index, giraffe.Idx, command, giraffe)...)
+	ops = append(append(ops, indexOps(giraffe)...), collect...)
+	ops = append(ops, backend.requestOps(args.RequestID, giraffe.Idx, command)...)
+	event := WatchEvent{Index: index, Action: "CreateGiraffe", Giraffe: *giraffe}
+	ops = append(ops, backend.eventOps(event)...)
+	err = backend.disk.Apply(index, append(ops, backend.ttlOps(giraffe.Idx, command, args.TTL)...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	if giraffe.Idx >= backend.idx {
+		backend.idx = giraffe.Idx + 1 // keeps a newly elected leader from reusing ids
 	}
 
-	backend.store[giraffe.Idx] = giraffe
+	backend.publish(event)
 
 	log.Printf("Create giraffe %v\n", *giraffe)
 
 	return giraffe, nil
 }
 
-// CreateGiraffe exposes RPC to client to request a creation of a giraffe
-func (backend *Backend) CreateGiraffe(args *string, reply *protos.Giraffe) error {
-	if backend.raft.isLeader() {
-		backend.storelock <- true
-		command := Command{
-			Action: "CreateGiraffe",
-			Data: LogCreateGiraffeArgs{
-				Name: *args,
-				Idx:  backend.idx,
-			},
-		}
-		backend.idx++
-		<-backend.storelock
+// CreateGiraffeArgs names a new giraffe, and the client creating it and who it's acting for, for the audit
+// trail. A TTL (in milliseconds) has it expire on its own. Sending the same RequestID again gives back the giraffe the first
+// request made, so clients can retry creates they didn't hear back about
+type CreateGiraffeArgs struct {
+	Name       string
+	Client     string
+	OnBehalfOf string
 
-		entry := backend.raft.appendEntry(command)
+	TTL       int64
+	RequestID string
+}
 
-		<-entry.done
-		if entry.error != nil {
-			return entry.error
-		}
+// CreateGiraffe exposes RPC to client to request a creation of a giraffe
+func (backend *Backend) CreateGiraffe(args *CreateGiraffeArgs, reply *protos.Giraffe) error {
+	if !backend.raft.isLeader() {
+		return backend.notLeader()
+	}
 
-		*reply = *entry.reply.(*protos.Giraffe)
+	if args.TTL < 0 {
+		return errNegativeTTL
+	}
 
+	backend.storelock <- true
+	earlier, err := backend.requested(args.RequestID)
+	if err != nil || earlier != nil {
+		<-backend.storelock
+		if err != nil {
+			return err
+		}
+		*reply = *earlier
 		return nil
 	}
 
-	leader := backend.raft.getLeader()
-	if leader == nil {
-		return errors.New("no leader")
-	}
-	err := leader.Connect()
+	command := NewCommand("CreateGiraffe", LogCreateGiraffeArgs{
+		Name:      args.Name,
+		Idx:       backend.idx,
+		TTL:       args.TTL,
+		RequestID: args.RequestID,
+	}).by(args.Client, args.OnBehalfOf)
+	backend.idx++
+	<-backend.storelock
+
+	giraffe, err := backend.propose(command)
 	if err != nil {
 		return err
 	}
 
-	err = leader.client.Call("Backend.CreateGiraffe", args, reply)
+	*reply = *giraffe.(*protos.Giraffe)
 
-	return err
+	return nil
+}
+
+// ReadGiraffeArgs picks a giraffe and how stale an answer can be
+type ReadGiraffeArgs struct {
+	Idx       uint64
+	Staleness Staleness
 }
 
 // ReadGiraffe expoes RPC to fetch a giraffe. This adds nothing to the log
-func (backend *Backend) ReadGiraffe(args *uint64, reply *protos.Giraffe) error {
-	if giraffe, found := backend.store[*args]; found {
+func (backend *Backend) ReadGiraffe(args *ReadGiraffeArgs, reply *protos.Giraffe) error {
+	err := backend.checkStaleness(args.Staleness)
+	if err != nil {
+		return err
+	}
+
+	backend.storelock <- true
+	defer func() {
+		<-backend.storelock
+	}()
+
+	giraffe, err := backend.getGiraffe(args.Idx)
+	if err != nil {
+		return err
+	}
+
+	if giraffe != nil {
 		*reply = *giraffe
 		return nil
 	}
@@ -190,10 +536,11 @@ func (backend *Backend) ReadGiraffe(args *uint64, reply *protos.Giraffe) error {
 	return errors.New("Giraffe not found")
 }
 
-func (backend *Backend) editGiraffe(data interface{}) (interface{}, error) {
-	args, ok := data.(LogEditGiraffeArgs)
-	if !ok {
-		return nil, errors.New("Incorrect type passed")
+func (backend *Backend) editGiraffe(index uint64, command Command) (interface{}, error) {
+	var args LogEditGiraffeArgs
+	err := command.decode(&args)
+	if err != nil {
+		return nil, err
 	}
 
 	backend.storelock <- true
@@ -201,108 +548,198 @@ func (backend *Backend) editGiraffe(data interface{}) (interface{}, error) {
 		<-backend.storelock
 	}()
 
-	if g, found := backend.store[args.Idx]; found {
-		g.Name = args.Name
-		g.NeckLength = args.NeckLength
-		return *g, nil
+	g, err := backend.getGiraffe(args.Idx)
+	if err != nil {
+		return nil, err
+	}
+
+	if g != nil {
+		edited := *g
+		edited.Name = args.Name
+		edited.NeckLength = args.NeckLength
+		if args.Species != "" || args.ClearSpecies {
+			edited.Species = args.Species
+		}
+		if args.BirthDate != "" || args.ClearBirthDate {
+			edited.BirthDate = args.BirthDate
+		}
+
+		collect, err := backend.collectHistoryOps(index)
+		if err != nil {
+			return nil, err
+		}
+
+		ops := append([]StoreOp{putGiraffeOp(&edited)}, auditOps(index, args.Idx, command, &edited)...)
+		ops = append(append(ops, unindexOps(g)...), indexOps(&edited)...)
+		ops = append(ops, collect...)
+		event := WatchEvent{Index: index, Action: "EditGiraffe", Giraffe: edited}
+		ops = append(ops, backend.eventOps(event)...)
+		err = backend.disk.Apply(index, append(ops, backend.ttlOps(args.Idx, command, args.TTL)...)...)
+		if err != nil {
+			return nil, err
+		}
+
+		backend.publish(event)
+		return edited, nil
 	}
 
 	return nil, errors.New("Giraffe not found")
 }
 
-// LogEditGiraffeArgs will keep all information necessary to edit a giraffe later
+// LogEditGiraffeArgs will keep all information necessary to edit a giraffe later. Species and BirthDate are
+// left alone when empty unless their Clear flag is set, so entries from before they existed don't wipe them
 type LogEditGiraffeArgs struct {
 	Idx        uint64
 	Name       string
 	NeckLength uint64
-}
 
-// EditGiraffe RPC to create a log entry and edit a giraffe
-func (backend *Backend) EditGiraffe(args *LogEditGiraffeArgs, reply *protos.Giraffe) error {
-
-	if backend.raft.isLeader() {
-		command := Command{
-			Action: "EditGiraffe",
-			Data:   *args,
-		}
+	Species        string `json:",omitempty"`
+	BirthDate      string `json:",omitempty"`
+	ClearSpecies   bool   `json:",omitempty"`
+	ClearBirthDate bool   `json:",omitempty"`
 
-		entry := backend.raft.appendEntry(command)
+	TTL int64 `json:",omitempty"` // milliseconds from now until it expires, 0 keeps its deadline
+}
 
-		<-entry.done
-		if entry.error != nil {
-			return entry.error
-		}
+// EditGiraffeArgs is an edit along with the client making it, for the audit trail. A TTL (in milliseconds)
+// gives the giraffe a new deadline counted from now. An empty Species or BirthDate keeps the old one, set
+// ClearSpecies or ClearBirthDate to empty it instead
+type EditGiraffeArgs struct {
+	Idx            uint64
+	Name           string
+	NeckLength     uint64
+	Species        string
+	BirthDate      string
+	ClearSpecies   bool
+	ClearBirthDate bool
+
+	Client     string
+	OnBehalfOf string
+	TTL        int64
+}
 
-		*reply = entry.reply.(protos.Giraffe)
+// EditGiraffe RPC to create a log entry and edit a giraffe
+func (backend *Backend) EditGiraffe(args *EditGiraffeArgs, reply *protos.Giraffe) error {
+	if !backend.raft.isLeader() {
+		return backend.notLeader()
+	}
 
-		return nil
+	if args.TTL < 0 {
+		return errNegativeTTL
 	}
 
-	leader := backend.raft.getLeader()
-	if leader == nil {
-		return errors.New("no leader")
+	if args.BirthDate != "" {
+		_, err := time.Parse("2006-01-02", args.BirthDate)
+		if err != nil {
+			return fmt.Errorf("birth date %q isn't YYYY-MM-DD", args.BirthDate)
+		}
 	}
-	err := leader.Connect()
+
+	giraffe, err := backend.propose(NewCommand("EditGiraffe", LogEditGiraffeArgs{
+		Idx:        args.Idx,
+		Name:       args.Name,
+		NeckLength: args.NeckLength,
+		Species:    args.Species,
+		BirthDate:  args.BirthDate,
+		TTL:        args.TTL,
+
+		ClearSpecies:   args.ClearSpecies,
+		ClearBirthDate: args.ClearBirthDate,
+	}).by(args.Client, args.OnBehalfOf))
 	if err != nil {
 		return err
 	}
 
-	err = leader.client.Call("Backend.EditGiraffe", args, reply)
+	*reply = giraffe.(protos.Giraffe)
 
-	return err
+	return nil
 }
 
-func (backend *Backend) deleteGiraffe(data interface{}) (interface{}, error) {
-	idx, ok := data.(uint64)
-	if !ok {
-		return false, errors.New("incorrect type passed")
+func (backend *Backend) deleteGiraffe(index uint64, command Command) (interface{}, error) {
+	var args LogDeleteGiraffeArgs
+	err := command.decode(&args)
+	if err != nil {
+		return false, err
 	}
+	idx := args.Idx
 
 	backend.storelock <- true
 	defer func() {
 		<-backend.storelock
 	}()
 
-	if _, found := backend.store[idx]; !found {
+	giraffe, err := backend.getGiraffe(idx)
+	if err != nil {
+		return false, err
+	}
+
+	if giraffe == nil {
+		// A retry of a delete that already went through did what it asked for
+		done, err := backend.deleted(args.RequestID, idx)
+		if err != nil || done {
+			return done, err
+		}
 		return false, errors.New("giraffe not found")
 	}
 
-	delete(backend.store, idx)
+	collect, err := backend.collectHistoryOps(index)
+	if err != nil {
+		return false, err
+	}
+
+	ops := append([]StoreOp{deleteGiraffeOp(idx), deleteTTLOp(idx)}, auditOps(index, idx, command, nil)...)
+	ops = append(append(ops, unindexOps(giraffe)...), collect...)
+	event := WatchEvent{Index: index, Action: "DeleteGiraffe", Giraffe: *giraffe}
+	ops = append(ops, backend.eventOps(event)...)
+	err = backend.disk.Apply(index, append(ops, backend.requestOps(args.RequestID, idx, command)...)...)
+	if err != nil {
+		return false, err
+	}
+	backend.publish(event)
 
 	return true, nil
 }
 
-// DeleteGiraffe is rpc to add a log entry to delete giraffes
-func (backend *Backend) DeleteGiraffe(args *uint64, reply *bool) error {
-	if backend.raft.isLeader() {
-		command := Command{
-			Action: "DeleteGiraffe",
-			Data:   *args,
-		}
+// LogDeleteGiraffeArgs says which giraffe to delete
+type LogDeleteGiraffeArgs struct {
+	Idx uint64
 
-		entry := backend.raft.appendEntry(command)
+	RequestID string `json:",omitempty"` // the client's ID for the delete, so a retry isn't told it's gone
+}
 
-		<-entry.done
-		if entry.error != nil {
-			return entry.error
-		}
+// DeleteGiraffeArgs says which giraffe to delete, and for which client. Sending the same RequestID again after
+// the delete went through succeeds instead of finding nothing to delete
+type DeleteGiraffeArgs struct {
+	Idx        uint64
+	Client     string
+	OnBehalfOf string
 
-		*reply = entry.reply.(bool)
+	RequestID string
+}
 
-		return nil
+// DeleteGiraffe is rpc to add a log entry to delete giraffes
+func (backend *Backend) DeleteGiraffe(args *DeleteGiraffeArgs, reply *bool) error {
+	if !backend.raft.isLeader() {
+		return backend.notLeader()
 	}
 
-	leader := backend.raft.getLeader()
-	if leader == nil {
-		return errors.New("no leader")
+	backend.storelock <- true
+	done, err := backend.deleted(args.RequestID, args.Idx)
+	<-backend.storelock
+	if err != nil || done {
+		*reply = done
+		return err
 	}
 
-	err := leader.Connect()
+	deleted, err := backend.propose(NewCommand("DeleteGiraffe", LogDeleteGiraffeArgs{
+		Idx:       args.Idx,
+		RequestID: args.RequestID,
+	}).by(args.Client, args.OnBehalfOf))
 	if err != nil {
 		return err
 	}
 
-	err = leader.client.Call("Backend.DeleteGiraffe", args, reply)
+	*reply = deleted.(bool)
 
-	return err
+	return nil
 }
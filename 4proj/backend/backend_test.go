@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"../protos"
+)
+
+// openTestBackend opens a backend on a fresh data directory and makes it the leader of its own one node cluster,
+// so RPCs that check for the leader go through. Nothing runs in the background, entries are applied with applyNext
+func openTestBackend(t *testing.T) (*Backend, func()) {
+	dir, err := ioutil.TempDir("", "backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := CreateBackend("a", ":0", "", dir)
+	err = backend.open()
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	backend.raft.Term = 1
+	backend.raft.State = "leader"
+	backend.raft.Leader = backend.raft.Self
+
+	return backend, func() {
+		backend.disk.Close()
+		if backend.raft.logFile != nil {
+			backend.raft.logFile.Close()
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+// applyNext applies command at the next log index, the way raft does once an entry commits
+func applyNext(backend *Backend, command Command) (interface{}, error) {
+	return backend.CommitEntry(backend.applied+1, command)
+}
+
+// createAt applies a create for a giraffe named name at idx, proposed at leader time now
+func createAt(t *testing.T, backend *Backend, idx uint64, name string, ttl int64, now int64) *protos.Giraffe {
+	command := NewCommand("CreateGiraffe", LogCreateGiraffeArgs{Name: name, Idx: idx, TTL: ttl})
+	command.Time = now
+
+	reply, err := applyNext(backend, command)
+	if err != nil {
+		t.Fatalf("creating %v at %v: %v", name, idx, err)
+	}
+	return reply.(*protos.Giraffe)
+}
+
+func TestNegativeTTLRefused(t *testing.T) {
+	backend, done := openTestBackend(t)
+	defer done()
+
+	var giraffe protos.Giraffe
+	if err := backend.CreateGiraffe(&CreateGiraffeArgs{Name: "never", TTL: -1}, &giraffe); err != errNegativeTTL {
+		t.Fatalf("expected %v creating with a negative TTL, got %v", errNegativeTTL, err)
+	}
+	if err := backend.EditGiraffe(&EditGiraffeArgs{Idx: 0, Name: "never", TTL: -1}, &giraffe); err != errNegativeTTL {
+		t.Fatalf("expected %v editing with a negative TTL, got %v", errNegativeTTL, err)
+	}
+
+	if last := len(backend.raft.log) - 1; last != 0 {
+		t.Fatalf("refused writes still reached the log, it ends at %v", last)
+	}
+}
+
+func TestPagesAcrossInsertsAndDeletes(t *testing.T) {
+	backend, done := openTestBackend(t)
+	defer done()
+
+	for idx := uint64(100); idx < 105; idx++ {
+		createAt(t, backend, idx, "paged", 0, 1000)
+	}
+
+	idxs := func(reply ListEntriesReply) []uint64 {
+		found := []uint64{}
+		for _, giraffe := range reply.Giraffes {
+			found = append(found, giraffe.Idx)
+		}
+		return found
+	}
+
+	var first ListEntriesReply
+	if err := backend.ListEntries(&ListEntriesArgs{PageSize: 3}, &first); err != nil {
+		t.Fatal(err)
+	}
+	if got := idxs(first); len(got) != 3 || got[2] != 2 || first.Prev != "" || first.Next == "" {
+		t.Fatalf("expected the seeds and a next page, got %v %+v", got, first)
+	}
+
+	// A giraffe deleted from the next page and one added before it don't throw the token off
+	if _, err := applyNext(backend, NewCommand("DeleteGiraffe", LogDeleteGiraffeArgs{Idx: 100})); err != nil {
+		t.Fatal(err)
+	}
+	createAt(t, backend, 3, "late", 0, 1000)
+
+	var second ListEntriesReply
+	if err := backend.ListEntries(&ListEntriesArgs{Token: first.Next, PageSize: 3}, &second); err != nil {
+		t.Fatal(err)
+	}
+	if got := idxs(second); len(got) != 3 || got[0] != 3 || got[1] != 101 || got[2] != 102 {
+		t.Fatalf("expected 3, 101 and 102, got %v", got)
+	}
+
+	var back ListEntriesReply
+	if err := backend.ListEntries(&ListEntriesArgs{Token: second.Prev, PageSize: 3}, &back); err != nil {
+		t.Fatal(err)
+	}
+	if got := idxs(back); len(got) != 3 || got[0] != 0 || back.Prev != "" || back.Next == "" {
+		t.Fatalf("expected the first page back, got %v %+v", got, back)
+	}
+
+	// The giraffe a token points after can be gone too
+	if _, err := applyNext(backend, NewCommand("DeleteGiraffe", LogDeleteGiraffeArgs{Idx: 102})); err != nil {
+		t.Fatal(err)
+	}
+	var last ListEntriesReply
+	if err := backend.ListEntries(&ListEntriesArgs{Token: second.Next, PageSize: 3}, &last); err != nil {
+		t.Fatal(err)
+	}
+	if got := idxs(last); len(got) != 2 || got[0] != 103 || last.Next != "" || last.Prev == "" {
+		t.Fatalf("expected 103 and 104 and no next page, got %v %+v", got, last)
+	}
+
+	if err := backend.ListEntries(&ListEntriesArgs{Token: "nonsense"}, &last); err == nil {
+		t.Fatal("took a token that isn't one")
+	}
+}
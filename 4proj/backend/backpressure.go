@@ -0,0 +1,76 @@
+package main
+
+import "fmt"
+
+// Pressure is how much of the log is waiting to commit, next to the limits proposals are turned away at
+type Pressure struct {
+	Uncommitted      int
+	UncommittedBytes int64
+
+	MaxUncommitted      int
+	MaxUncommittedBytes int64
+
+	Overloaded bool
+}
+
+// OverloadedError is given back for proposals made while too much of the log is uncommitted, usually because
+// followers are slow or down. Nothing was added to the log, so the client can back off and try again
+type OverloadedError struct {
+	Uncommitted      int
+	UncommittedBytes int64
+}
+
+func (err *OverloadedError) Error() string {
+	return fmt.Sprintf("overloaded: uncommitted=%v bytes=%v, retry later", err.Uncommitted, err.UncommittedBytes)
+}
+
+// pressureLocked adds up the entries past commitIndex, it needs the logLock
+func (server *Server) pressureLocked() Pressure {
+	pressure := Pressure{
+		MaxUncommitted:      server.config.MaxUncommittedEntries,
+		MaxUncommittedBytes: server.config.MaxUncommittedBytes,
+	}
+
+	for i := server.commitIndex + 1; i <= server.lastIndex(); i++ { // followers can hear of commits before the entries
+		pressure.Uncommitted++
+		pressure.UncommittedBytes += int64(len(server.entry(i).Command.Data))
+	}
+
+	pressure.Overloaded = (pressure.MaxUncommitted != 0 && pressure.Uncommitted >= pressure.MaxUncommitted) ||
+		(pressure.MaxUncommittedBytes != 0 && pressure.UncommittedBytes >= pressure.MaxUncommittedBytes)
+
+	return pressure
+}
+
+func (server *Server) pressure() Pressure {
+	server.logLock <- true
+	defer func() {
+		<-server.logLock
+	}()
+
+	return server.pressureLocked()
+}
+
+// proposeEntry is appendEntry for proposals, turning them away while the log is too far ahead of commitIndex.
+// Raft's own entries like membership changes skip this, they may be what gets the cluster committing again
+func (server *Server) proposeEntry(command Command) (*Entry, error) {
+	server.lock <- true
+	defer func() {
+		<-server.lock
+	}()
+	if !server.isLeader() {
+		return nil, errNotLeading
+	}
+
+	server.logLock <- true
+	defer func() {
+		<-server.logLock
+	}()
+
+	pressure := server.pressureLocked()
+	if pressure.Overloaded {
+		return nil, &OverloadedError{Uncommitted: pressure.Uncommitted, UncommittedBytes: pressure.UncommittedBytes}
+	}
+
+	return server.appendEntryLocked(command), nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+)
+
+// overloadableLeader is the leader of a three node cluster, so nothing it proposes commits without us saying so
+func overloadableLeader(t *testing.T, entries int, bytes int64) *Server {
+	server := CreateServer("a", ":0", "b=:1,c=:2", noCommit)
+	config := DefaultRaftConfig()
+	config.MaxUncommittedEntries = entries
+	config.MaxUncommittedBytes = bytes
+	err := server.Configure(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.Term = 1
+	server.State = "leader"
+	server.Leader = server.Self
+	return server
+}
+
+func TestProposalsTurnedAwayPastUncommittedEntries(t *testing.T) {
+	server := overloadableLeader(t, 3, 0)
+
+	for i := 0; i < 3; i++ {
+		if _, err := server.proposeEntry(Command{Action: "KVPut"}); err != nil {
+			t.Fatalf("proposal %v was turned away under the limit: %v", i, err)
+		}
+	}
+
+	_, err := server.proposeEntry(Command{Action: "KVPut"})
+	overloaded, ok := err.(*OverloadedError)
+	if !ok || overloaded.Uncommitted != 3 {
+		t.Fatalf("expected an OverloadedError with 3 uncommitted, got %v", err)
+	}
+	if server.lastIndex() != 3 {
+		t.Fatalf("a turned away proposal went into the log, it ends at %v", server.lastIndex())
+	}
+	if pressure := server.pressure(); !pressure.Overloaded || pressure.MaxUncommitted != 3 {
+		t.Fatalf("expected to be overloaded at 3, got %+v", pressure)
+	}
+
+	// Membership changes can still go in, they may be what the cluster needs to commit again
+	if _, _, err := server.appendMembership(removeNodeAction, MembershipArgs{ID: "c"}); err != nil {
+		t.Fatalf("a membership change was turned away while overloaded: %v", err)
+	}
+
+	server.commitIndex = 3
+	if _, err := server.proposeEntry(Command{Action: "KVPut"}); err != nil {
+		t.Fatalf("proposal turned away once the log committed: %v", err)
+	}
+}
+
+func TestProposalsTurnedAwayPastUncommittedBytes(t *testing.T) {
+	server := overloadableLeader(t, 0, 10)
+
+	big := Command{Action: "KVPut", Data: []byte(`"12345678"`)}
+	if _, err := server.proposeEntry(big); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := server.proposeEntry(big)
+	if overloaded, ok := err.(*OverloadedError); !ok || overloaded.UncommittedBytes != 10 {
+		t.Fatalf("expected an OverloadedError with 10 bytes uncommitted, got %v", err)
+	}
+}
+
+func TestNoLimitsNeverOverloads(t *testing.T) {
+	server := overloadableLeader(t, 0, 0)
+
+	for i := 0; i < MaxUncommittedEntries+1; i++ {
+		if _, err := server.proposeEntry(Command{Action: "KVPut"}); err != nil {
+			t.Fatalf("turned away proposal %v with no limits set: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// A backup file is a header, the store's live keys written as ordinary store records, and a footer:
+//
+// Header: backupMagic | backup version
+// Footer: backupEndMagic | applied index | record count | sha256 of everything before the footer
+const (
+	backupMagic    = "GIRAFFE-BACKUP\n"
+	backupEndMagic = "GIRAFFE-END\n"
+	backupVersion  = 1
+)
+
+const backupFooterSize = len(backupEndMagic) + 8 + 8 + sha256.Size
+
+// BackupInfo describes a backup file
+type BackupInfo struct {
+	Applied uint64
+	Records uint64
+	Bytes   int64
+}
+
+// countingWriter keeps track of how many records go through it
+type countingWriter struct {
+	w       io.Writer
+	records uint64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.records++ // writeLive writes exactly one record per call
+	return cw.w.Write(p)
+}
+
+// WriteBackup writes every live key and the applied index to w, consistent as of a single point in the log
+func (store *DiskStore) WriteBackup(w io.Writer) (*BackupInfo, error) {
+	store.lock <- true
+	defer func() {
+		<-store.lock
+	}()
+
+	hash := sha256.New()
+	out := io.MultiWriter(w, hash)
+
+	header := make([]byte, len(backupMagic)+4)
+	copy(header, backupMagic)
+	binary.BigEndian.PutUint32(header[len(backupMagic):], backupVersion)
+	_, err := out.Write(header)
+	if err != nil {
+		return nil, err
+	}
+
+	records := &countingWriter{w: out}
+	err = store.writeLive(records)
+	if err != nil {
+		return nil, err
+	}
+
+	footer := make([]byte, 0, backupFooterSize)
+	footer = append(footer, backupEndMagic...)
+	footer = append(footer, make([]byte, 16)...)
+	binary.BigEndian.PutUint64(footer[len(backupEndMagic):], store.applied)
+	binary.BigEndian.PutUint64(footer[len(backupEndMagic)+8:], records.records)
+	footer = append(footer, hash.Sum(nil)...)
+
+	_, err = w.Write(footer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BackupInfo{
+		Applied: store.applied,
+		Records: records.records,
+	}, nil
+}
+
+// BackupReply names a backup the backend has spooled, to be fetched with BackupChunk
+type BackupReply struct {
+	ID   string
+	Info BackupInfo
+}
+
+// BackupChunkArgs asks for the piece of backup ID starting at Offset. Size caps how much comes back, 0 or
+// anything over BackupChunkSize means BackupChunkSize
+type BackupChunkArgs struct {
+	ID     string
+	Offset int64
+	Size   int
+}
+
+// BackupChunkReply is a piece of a backup. Done is set on the last one, and the backend forgets the backup then
+type BackupChunkReply struct {
+	Data []byte
+	Done bool
+}
+
+// backupPath is where a backup is spooled until raftctl has fetched it. The backend picks the name, so nobody
+// can have it write over files on its disk
+func backupPath(dataDir string, id string) string {
+	return filepath.Join(dataDir, "backup-"+id+".tmp")
+}
+
+// removeBackups throws away backups nobody finished fetching before we last stopped
+func removeBackups(dataDir string) {
+	paths, _ := filepath.Glob(backupPath(dataDir, "*"))
+	for _, path := range paths {
+		os.Remove(path)
+	}
+}
+
+// Backup exposes RPC to take a consistent snapshot of the store. It's spooled to a file in the data directory
+// and fetched a chunk at a time with BackupChunk, so neither side holds the whole store in memory. Only the
+// newest backup is kept, taking another throws away the last one
+func (admin *Admin) Backup(args int, reply *BackupReply) error {
+	backend := admin.backend
+
+	raw := make([]byte, 8)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return err
+	}
+	id := hex.EncodeToString(raw)
+	path := backupPath(backend.dataDir, id)
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	backend.storelock <- true
+	disk, err := backend.store()
+	var info *BackupInfo
+	if err == nil {
+		info, err = disk.WriteBackup(writer)
+	}
+	<-backend.storelock
+	if err == nil {
+		err = writer.Flush()
+	}
+	var stat os.FileInfo
+	if err == nil {
+		stat, err = file.Stat()
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	info.Bytes = stat.Size()
+
+	backend.storelock <- true
+	old := backend.backup
+	backend.backup = id
+	<-backend.storelock
+	if old != "" {
+		os.Remove(backupPath(backend.dataDir, old))
+	}
+
+	log.Printf("Backed up %v records at applied index %v to %v\n", info.Records, info.Applied, path)
+
+	reply.ID = id
+	reply.Info = *info
+
+	return nil
+}
+
+// BackupChunk exposes RPC to fetch a piece of the backup Backup spooled
+func (admin *Admin) BackupChunk(args *BackupChunkArgs, reply *BackupChunkReply) error {
+	backend := admin.backend
+
+	backend.storelock <- true
+	_, err := backend.store()
+	current := backend.backup
+	<-backend.storelock
+	if err != nil {
+		return err
+	}
+	if args.ID == "" || args.ID != current {
+		return fmt.Errorf("backup %v is gone, take another", args.ID)
+	}
+
+	file, err := os.Open(backupPath(backend.dataDir, args.ID))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	size := args.Size
+	if size <= 0 || size > BackupChunkSize {
+		size = BackupChunkSize
+	}
+	if args.Offset < 0 || args.Offset > stat.Size() {
+		return fmt.Errorf("offset %v is outside backup %v, which is %v bytes", args.Offset, args.ID, stat.Size())
+	}
+
+	data := make([]byte, size)
+	n, err := file.ReadAt(data, args.Offset)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	reply.Data = data[:n]
+	reply.Done = args.Offset+int64(n) >= stat.Size()
+
+	if reply.Done {
+		backend.storelock <- true
+		if backend.backup == args.ID {
+			backend.backup = ""
+		}
+		<-backend.storelock
+		os.Remove(backupPath(backend.dataDir, args.ID))
+	}
+
+	return nil
+}
+
+// countingReader keeps track of how many bytes go through it
+type countingReader struct {
+	r     io.Reader
+	bytes int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.bytes += int64(n)
+	return n, err
+}
+
+// readBackup checks a backup end to end as it streams in, calling fn with every op in it. Giraffes written at
+// an older schema version are migrated on the way out. fn sees ops before the checksum at the end is checked,
+// so anything it does has to be thrown away if this fails
+func readBackup(r io.Reader, fn func(op StoreOp) error) (*BackupInfo, error) {
+	counted := &countingReader{r: r}
+	buffered := bufio.NewReader(counted)
+	hash := sha256.New()
+	body := io.TeeReader(buffered, hash) // everything up to the footer is hashed
+
+	header := make([]byte, len(backupMagic)+4)
+	_, err := io.ReadFull(body, header)
+	if err != nil || string(header[:len(backupMagic)]) != backupMagic {
+		return nil, errors.New("not a giraffe backup")
+	}
+
+	if version := binary.BigEndian.Uint32(header[len(backupMagic):]); version != backupVersion {
+		return nil, fmt.Errorf("backup version %v is not supported, expected %v", version, backupVersion)
+	}
+
+	// Records run until the footer's magic. A record starting with it would be over a gigabyte long
+	var records uint64
+	var applied uint64
+	for {
+		next, err := buffered.Peek(len(backupEndMagic))
+		if err != nil {
+			return nil, errors.New("backup is truncated, its footer is missing")
+		}
+		if string(next) == backupEndMagic {
+			break
+		}
+
+		recordApplied, ops, _, _, err := readRecord(body, 0)
+		if err != nil {
+			return nil, fmt.Errorf("backup record %v is corrupt: %v", records, err)
+		}
+		if records == 0 {
+			applied = recordApplied
+		} else if recordApplied != applied {
+			return nil, fmt.Errorf("backup record %v is at index %v, not %v", records, recordApplied, applied)
+		}
+
+		for _, op := range ops {
+			op, err = migrateGiraffeOp(op)
+			if err != nil {
+				return nil, fmt.Errorf("backup record %v: %v", records, err)
+			}
+
+			err = fn(op)
+			if err != nil {
+				return nil, err
+			}
+		}
+		records++
+	}
+
+	sum := hash.Sum(nil)
+
+	footer := make([]byte, backupFooterSize)
+	_, err = io.ReadFull(buffered, footer)
+	if err != nil {
+		return nil, errors.New("backup is truncated, its footer is cut short")
+	}
+	if _, err := buffered.ReadByte(); err != io.EOF {
+		return nil, errors.New("backup has data after its footer")
+	}
+
+	footerApplied := binary.BigEndian.Uint64(footer[len(backupEndMagic):])
+	count := binary.BigEndian.Uint64(footer[len(backupEndMagic)+8:])
+	if !bytes.Equal(sum, footer[len(backupEndMagic)+16:]) {
+		return nil, errors.New("backup checksum does not match its contents")
+	}
+	if records > 0 && footerApplied != applied {
+		return nil, fmt.Errorf("backup records are at index %v, but its footer says %v", applied, footerApplied)
+	}
+	if records != count {
+		return nil, fmt.Errorf("backup has %v records but its footer says %v", records, count)
+	}
+
+	return &BackupInfo{
+		Applied: footerApplied,
+		Records: records,
+		Bytes:   counted.bytes,
+	}, nil
+}
+
+// VerifyBackup checks a backup's integrity without restoring it
+func VerifyBackup(r io.Reader) (*BackupInfo, error) {
+	return readBackup(r, func(op StoreOp) error {
+		return nil
+	})
+}
+
+// restoreBatchSize is how many ops a restore writes to the store at a time
+const restoreBatchSize = 1024
+
+// RestoreBackup seeds an empty data directory from a backup to bootstrap a new cluster. The store is built next
+// to where it goes and only moved into place once the whole backup checks out. The new cluster's log starts
+// where the backup left off, not from 0, so lease tokens and KV versions taken from log indexes keep growing
+func RestoreBackup(r io.Reader, dataDir string) (*BackupInfo, error) {
+	for _, name := range []string{"giraffes.db", "raft.log", "raft.state"} {
+		if _, err := os.Stat(filepath.Join(dataDir, name)); err == nil {
+			return nil, fmt.Errorf("%v already has data in it, restore into an empty directory", dataDir)
+		}
+	}
+
+	err := os.MkdirAll(dataDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp := filepath.Join(dataDir, "giraffes.db.restore")
+	info, err := buildStore(r, tmp)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every node is restored from the same backup, so they all start from the same base. It records no
+	// membership, the peers each node is started with stand
+	frame, err := encodeLogEntry(&Entry{Index: info.Applied, Command: NewCommand(logBaseAction, LogBaseArgs{})})
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dataDir, "raft.log"), frame, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(dataDir, "giraffes.db"))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		os.Remove(filepath.Join(dataDir, "raft.log"))
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// buildStore writes a backup into a new store at path, as of the backup's applied index. It's only complete
+// if this succeeds, otherwise it's removed
+func buildStore(r io.Reader, path string) (*BackupInfo, error) {
+	os.Remove(path) // left over from one that failed
+	store, err := OpenDiskStore(path)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := []StoreOp{}
+	info, err := readBackup(r, func(op StoreOp) error {
+		batch = append(batch, op)
+		if len(batch) < restoreBatchSize {
+			return nil
+		}
+
+		err := store.Apply(0, batch...)
+		batch = []StoreOp{}
+		return err
+	})
+	if err == nil {
+		err = store.Apply(info.Applied, batch...)
+	}
+	store.Close()
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// writeSnapshot backs the store up to w for a follower the leader's log has left behind
+func (backend *Backend) writeSnapshot(w io.Writer) (uint64, error) {
+	backend.storelock <- true
+	defer func() {
+		<-backend.storelock
+	}()
+
+	disk, err := backend.store()
+	if err != nil {
+		return 0, err
+	}
+
+	info, err := disk.WriteBackup(w)
+	if err != nil {
+		return 0, err
+	}
+	return info.Applied, nil
+}
+
+// installSnapshot replaces the store with a snapshot the leader sent, in the backup format. The new store is
+// built next to the old one, so a bad snapshot leaves the old one alone. It's swapped in under storelock, which
+// every read of the store holds too
+func (backend *Backend) installSnapshot(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(backend.dataDir, "giraffes.db.snapshot")
+	info, err := buildStore(file, tmp)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	backend.storelock <- true
+	defer func() {
+		<-backend.storelock
+	}()
+
+	backend.disk.Close()
+	err = os.Rename(tmp, filepath.Join(backend.dataDir, "giraffes.db"))
+	if err == nil {
+		backend.disk, err = OpenDiskStore(filepath.Join(backend.dataDir, "giraffes.db"))
+	}
+	if err != nil {
+		log.Fatalf("Could not open the store after installing a snapshot: %v\n", err) // there's nothing left to serve from
+	}
+
+	backend.applied = info.Applied
+	err = backend.loadEvents() // the leader's, watchers behind its floor find out they've missed events
+	close(backend.changed)
+	backend.changed = make(chan bool)
+	if err != nil {
+		return err
+	}
+
+	backend.clock = 0
+	err = backend.loadClock()
+	if err == nil {
+		backend.idx, err = backend.nextIdx()
+	}
+	return err
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"../protos"
+)
+
+// fetchBackup takes a backup through Admin the way raftctl does, a few bytes at a time
+func fetchBackup(t *testing.T, backend *Backend) ([]byte, BackupInfo) {
+	admin := &Admin{backend: backend}
+
+	var backup BackupReply
+	err := admin.Backup(0, &backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var data []byte
+	for chunks := 0; ; chunks++ {
+		var chunk BackupChunkReply
+		err = admin.BackupChunk(&BackupChunkArgs{ID: backup.ID, Offset: int64(len(data)), Size: 100}, &chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chunk.Data) > 100 {
+			t.Fatalf("asked for 100 bytes, got %v", len(chunk.Data))
+		}
+		data = append(data, chunk.Data...)
+		if chunk.Done {
+			break
+		}
+	}
+
+	if int64(len(data)) != backup.Info.Bytes {
+		t.Fatalf("fetched %v bytes of a %v byte backup", len(data), backup.Info.Bytes)
+	}
+	if _, err := os.Stat(backupPath(backend.dataDir, backup.ID)); !os.IsNotExist(err) {
+		t.Fatal("the spooled backup is still there after the last chunk")
+	}
+	var chunk BackupChunkReply
+	if admin.BackupChunk(&BackupChunkArgs{ID: backup.ID}, &chunk) == nil {
+		t.Fatal("fetched a backup that was already done")
+	}
+
+	return data, backup.Info
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+	backend, done := openTestBackend(t)
+	defer done()
+
+	createAt(t, backend, 100, "kept", 0, 1000)
+	if _, err := applyNext(backend, NewCommand("KVPut", KVArgs{Key: []byte("k"), Value: []byte("v")})); err != nil {
+		t.Fatal(err)
+	}
+
+	data, info := fetchBackup(t, backend)
+
+	verified, err := VerifyBackup(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *verified != info {
+		t.Fatalf("took %+v, verified %+v", info, *verified)
+	}
+
+	dir, err := ioutil.TempDir("", "restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, err = RestoreBackup(bytes.NewReader(data), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := CreateBackend("r", ":0", "", dir)
+	err = restored.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.disk.Close()
+	defer restored.raft.logFile.Close()
+
+	// The new log carries on from the backup, so versions and lease tokens from the old cluster stay behind
+	// everything written after the restore
+	if restored.applied != info.Applied || restored.raft.logBase() != info.Applied || restored.raft.lastIndex() != info.Applied {
+		t.Fatalf("expected the restored node at %v, its store is at %v and its log goes from %v to %v", info.Applied,
+			restored.applied, restored.raft.logBase(), restored.raft.lastIndex())
+	}
+
+	for _, key := range []string{giraffeKey(100), kvKey([]byte("k"))} {
+		want, _, _ := backend.disk.Get(key)
+		got, found, err := restored.disk.Get(key)
+		if err != nil || !found || !bytes.Equal(got, want) {
+			t.Fatalf("%v restored as %q (found %v, %v), expected %q", key, got, found, err, want)
+		}
+	}
+
+	if _, err := RestoreBackup(bytes.NewReader(data), dir); err == nil {
+		t.Fatal("restored over a data directory that has a store")
+	}
+}
+
+func TestBadBackupsRefused(t *testing.T) {
+	backend, done := openTestBackend(t)
+	defer done()
+
+	createAt(t, backend, 100, "kept", 0, 1000)
+	data, _ := fetchBackup(t, backend)
+
+	flipped := append([]byte{}, data...)
+	flipped[len(flipped)/2] ^= 1
+
+	for name, bad := range map[string][]byte{
+		"empty":     {},
+		"truncated": data[:len(data)-10],
+		"no footer": data[:len(data)-backupFooterSize],
+		"flipped":   flipped,
+		"trailing":  append(append([]byte{}, data...), 0),
+	} {
+		if _, err := VerifyBackup(bytes.NewReader(bad)); err == nil {
+			t.Fatalf("%v backup verified", name)
+		}
+
+		dir, err := ioutil.TempDir("", "restore")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = RestoreBackup(bytes.NewReader(bad), dir)
+		_, statErr := os.Stat(filepath.Join(dir, "giraffes.db"))
+		os.RemoveAll(dir)
+		if err == nil || statErr == nil {
+			t.Fatalf("%v backup was restored", name)
+		}
+	}
+}
+
+func TestSnapshotInstallsUnderReads(t *testing.T) {
+	leader, done := openTestBackend(t)
+	defer done()
+	createAt(t, leader, 100, "sent", 0, 1000)
+
+	var snapshot bytes.Buffer
+	if _, err := leader.writeSnapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	follower, done := openTestBackend(t)
+	defer done()
+	path := filepath.Join(follower.dataDir, "snapshot")
+	if err := ioutil.WriteFile(path, snapshot.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reads carry on while the store is swapped out from under them, the race detector catches any that don't wait
+	stop := make(chan bool)
+	reading := make(chan bool)
+	go func() {
+		defer close(reading)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			follower.ReadGiraffe(&ReadGiraffeArgs{Idx: 100}, &protos.Giraffe{})
+			follower.GiraffeHistory(&GiraffeHistoryArgs{Idx: 100}, &[]AuditRecord{})
+			follower.KVGet(&KVGetArgs{Key: []byte("k")}, &KVPair{})
+			follower.KVScan(&KVScanArgs{}, &KVScanReply{})
+		}
+	}()
+
+	err := follower.installSnapshot(path)
+	close(stop)
+	<-reading
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var giraffe protos.Giraffe
+	if err := follower.ReadGiraffe(&ReadGiraffeArgs{Idx: 100}, &giraffe); err != nil || giraffe.Name != "sent" {
+		t.Fatalf("expected the snapshot's giraffe, got %+v %v", giraffe, err)
+	}
+}
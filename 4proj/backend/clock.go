@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Clock is where raft gets the time from, so tests can run elections on virtual time
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// RaftConfig is a server's timing. Election timeouts are picked at random from
+// [ElectionMinTimeout, ElectionMaxTimeout), using Seed so a run can be reproduced (0 seeds from the time).
+// Nodes with a higher Priority are preferred as leader, and a Witness is never leader
+type RaftConfig struct {
+	HeartbeatTimeout   time.Duration
+	ElectionMinTimeout time.Duration
+	ElectionMaxTimeout time.Duration
+
+	Priority int
+	Witness  bool
+
+	MaxUncommittedEntries int   // 0 means no limit
+	MaxUncommittedBytes   int64 // 0 means no limit
+
+	LogCompactEntries uint64 // 0 means never compact
+	LogKeepEntries    uint64
+
+	Clock Clock // nil means the real clock
+	Seed  int64
+}
+
+// DefaultRaftConfig is the timing from constants.go on the real clock
+func DefaultRaftConfig() RaftConfig {
+	return RaftConfig{
+		HeartbeatTimeout:   HeartbeatTimeout * time.Millisecond,
+		ElectionMinTimeout: ElectionMinTimeout * time.Millisecond,
+		ElectionMaxTimeout: ElectionMaxTimeout * time.Millisecond,
+
+		MaxUncommittedEntries: MaxUncommittedEntries,
+		MaxUncommittedBytes:   MaxUncommittedBytes,
+
+		LogCompactEntries: LogCompactEntries,
+		LogKeepEntries:    LogKeepEntries,
+	}
+}
+
+// Validate checks the timing can work: followers have to hear a heartbeat before they give up on the leader
+func (config RaftConfig) Validate() error {
+	if config.HeartbeatTimeout <= 0 {
+		return errors.New("heartbeat timeout has to be positive")
+	}
+	if config.ElectionMinTimeout <= config.HeartbeatTimeout {
+		return fmt.Errorf("election timeout %v has to be longer than the heartbeat timeout %v", config.ElectionMinTimeout, config.HeartbeatTimeout)
+	}
+	if config.ElectionMaxTimeout <= config.ElectionMinTimeout {
+		return fmt.Errorf("election timeout range %v to %v is empty", config.ElectionMinTimeout, config.ElectionMaxTimeout)
+	}
+	if config.Priority < 0 || config.Priority > MaxPriority {
+		return fmt.Errorf("priority %v has to be from 0 to %v", config.Priority, MaxPriority)
+	}
+	if config.Witness && config.Priority != 0 {
+		return errors.New("a witness can't have a priority, it never leads")
+	}
+	if config.MaxUncommittedEntries < 0 || config.MaxUncommittedBytes < 0 {
+		return errors.New("uncommitted limits can't be negative")
+	}
+	return nil
+}
+
+// Configure sets the server's timing, it has to be called before Start
+func (server *Server) Configure(config RaftConfig) error {
+	err := config.Validate()
+	if err != nil {
+		return err
+	}
+
+	if config.Clock == nil {
+		config.Clock = realClock{}
+	}
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	server.config = config
+	server.random = rand.New(rand.NewSource(seed))
+	if config.Witness {
+		server.State = witnessState
+	}
+
+	return nil
+}
+
+// electionTimeout picks how long to wait for a heartbeat before starting an election
+func (server *Server) electionTimeout() time.Duration {
+	spread := server.config.ElectionMaxTimeout - server.config.ElectionMinTimeout
+	timeout := server.config.ElectionMinTimeout + time.Duration(server.random.Int63n(int64(spread)))
+	return timeout + time.Duration(server.priorityGap())*spread
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Command details our state machine operations. Data is the JSON encoding of the action's args,
+// and Version is the CommandVersion it was written with so newer encodings are never misread.
+// Client and Time say who proposed it and when, by the leader's clock in milliseconds, and OnBehalfOf who the
+// client said it was acting for
+type Command struct {
+	Action  string
+	Version uint32
+	Data    json.RawMessage
+
+	Client     string `json:",omitempty"`
+	OnBehalfOf string `json:",omitempty"`
+	Time       int64  `json:",omitempty"`
+}
+
+// NewCommand encodes args for an action at the current CommandVersion
+func NewCommand(action string, args interface{}) Command {
+	data, err := json.Marshal(args)
+	if err != nil {
+		panic(fmt.Sprintf("could not encode %v args: %v", action, err)) // only happens for unencodable types
+	}
+
+	return Command{
+		Action:  action,
+		Version: CommandVersion,
+		Data:    data,
+	}
+}
+
+// by says which client a command is from, and who it's acting for
+func (command Command) by(client string, onBehalfOf string) Command {
+	command.Client = client
+	command.OnBehalfOf = onBehalfOf
+	return command
+}
+
+// decode unpacks a command's args
+func (command Command) decode(args interface{}) error {
+	if command.Version > CommandVersion {
+		return fmt.Errorf("%v was written at command version %v, we only understand up to %v",
+			command.Action, command.Version, CommandVersion)
+	}
+
+	return json.Unmarshal(command.Data, args)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// logBaseAction is the entry at the start of a compacted log, standing in for every entry up to and including
+// its index. Those have all been applied to the store, and the membership they add up to is kept in its args
+const logBaseAction = "LogBase"
+
+// LogBaseArgs is the membership as of a compacted log's base. Without Members, like in a log that starts
+// from a restored backup, the initial peers stand
+type LogBaseArgs struct {
+	Members []MembershipArgs `json:",omitempty"`
+}
+
+// logBase is the index our log starts at, everything up to it has been compacted away. logLock must be held
+func (server *Server) logBase() uint64 {
+	return server.log[0].Index
+}
+
+// lastIndex is the index of the last entry in our log, logLock must be held
+func (server *Server) lastIndex() uint64 {
+	return server.logBase() + uint64(len(server.log)) - 1
+}
+
+// entry is the entry at index, which has to be between our log's base and its end. logLock must be held
+func (server *Server) entry(index uint64) *Entry {
+	return server.log[index-server.logBase()]
+}
+
+// entriesFrom is every entry from index on, index has to be past our log's base. logLock must be held
+func (server *Server) entriesFrom(index uint64) []*Entry {
+	if index > server.lastIndex() {
+		return []*Entry{}
+	}
+	return server.log[index-server.logBase():]
+}
+
+// skipEntries drops entries up to and including index, which a follower has already compacted
+func skipEntries(entries []Entry, index uint64) []Entry {
+	for len(entries) > 0 && entries[0].Index <= index {
+		entries = entries[1:]
+	}
+	return entries
+}
+
+// applyLogBase resets the membership to what a compacted log's base recorded, for rebuildMembership
+func (server *Server) applyLogBase(command Command) {
+	var args LogBaseArgs
+	err := command.decode(&args)
+	if err != nil || args.Members == nil {
+		return
+	}
+
+	server.nodes = map[string]*Node{}
+	member := false
+	for _, peer := range args.Members {
+		if peer.id() == server.Self {
+			member = true
+			continue
+		}
+		server.nodes[peer.id()] = CreateNode(server, peer.id(), peer.Addr)
+	}
+
+	if member {
+		server.joining = false
+		server.removed = false
+	} else if !server.joining {
+		server.removed = true
+	}
+}
+
+// membersAt works out the membership as of index, from our log's base and the changes after it. logLock must
+// be held
+func (server *Server) membersAt(index uint64) []MembershipArgs {
+	members := map[string]string{}
+
+	var base LogBaseArgs
+	if server.log[0].Command.decode(&base) == nil && base.Members != nil {
+		for _, member := range base.Members {
+			members[member.id()] = member.Addr
+		}
+	} else {
+		for id, addr := range server.initialPeers {
+			members[id] = addr
+		}
+		if !server.joining {
+			members[server.Self] = server.Addr // we started out as a member, or joined in a change below
+		}
+	}
+
+	for _, entry := range server.log[1 : index-server.logBase()+1] {
+		var args MembershipArgs
+		if !isMembershipChange(entry.Command.Action) || entry.Command.decode(&args) != nil {
+			continue
+		}
+		if entry.Command.Action == addNodeAction {
+			members[args.id()] = args.Addr
+		} else {
+			delete(members, args.id())
+		}
+	}
+
+	list := []MembershipArgs{}
+	for id, addr := range members {
+		list = append(list, MembershipArgs{ID: id, Addr: addr})
+	}
+	return list
+}
+
+// maybeCompactLog drops applied entries from the start of the log once LogCompactEntries of them have piled up,
+// keeping the last LogKeepEntries for followers that are only a little behind. Anything further behind is sent
+// a snapshot of the store instead. logLock must be held
+func (server *Server) maybeCompactLog() {
+	if server.config.LogCompactEntries == 0 || server.lastApplied < server.logBase()+server.config.LogCompactEntries+server.config.LogKeepEntries {
+		return
+	}
+
+	upTo := server.lastApplied - server.config.LogKeepEntries
+	err := server.compactLog(upTo)
+	if err != nil {
+		log.Printf("Could not compact the raft log up to %v: %v\n", upTo, err)
+		return
+	}
+
+	log.Printf("Compacted the raft log up to %v\n", upTo)
+}
+
+// compactLog drops every entry up to upTo from the log, leaving a base entry with its index and term and the
+// membership as of it in their place. Everything up to upTo has to have been applied. logLock must be held
+func (server *Server) compactLog(upTo uint64) error {
+	base := &Entry{
+		Index:   upTo,
+		Term:    server.entry(upTo).Term,
+		Command: NewCommand(logBaseAction, LogBaseArgs{Members: server.membersAt(upTo)}),
+	}
+
+	return server.replaceLog(append([]*Entry{base}, server.entriesFrom(upTo+1)...))
+}
+
+// replaceLog swaps our log for entries, which start with a base entry. The new log file is written next to the
+// old one and renamed over it, so a crash leaves one or the other. logLock must be held
+func (server *Server) replaceLog(entries []*Entry) error {
+	offsets := []int64{}
+	var size int64
+	frames := [][]byte{}
+	for _, entry := range entries {
+		frame, err := encodeLogEntry(entry)
+		if err != nil {
+			return err
+		}
+		frames = append(frames, frame)
+		offsets = append(offsets, size)
+		size += int64(len(frame))
+	}
+
+	if server.logFile != nil {
+		path := filepath.Join(server.dataDir, "raft.log")
+		tmp := path + ".compact"
+
+		file, err := os.Create(tmp)
+		if err != nil {
+			return err
+		}
+		writer := bufio.NewWriter(file)
+		for _, frame := range frames {
+			_, err = writer.Write(frame)
+			if err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = writer.Flush()
+		}
+		if err == nil {
+			err = file.Sync()
+		}
+		file.Close()
+		if err == nil {
+			err = os.Rename(tmp, path)
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+
+		// The old file is gone now, carrying on without the new one open would lose every entry after this
+		server.logFile.Close()
+		server.logFile, err = os.OpenFile(path, os.O_RDWR, 0644)
+		if err == nil {
+			_, err = server.logFile.Seek(size, io.SeekStart)
+		}
+		if err != nil {
+			log.Fatalf("Could not reopen the raft log after replacing it: %v\n", err)
+		}
+	}
+
+	server.log = entries
+	server.logOffsets = offsets
+	server.logSize = size
+
+	return nil
+}
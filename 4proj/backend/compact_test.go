@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"../protos"
+)
+
+// openCompactingServer opens a server on dir that compacts once 4 applied entries pile up, keeping 2
+func openCompactingServer(t *testing.T, dir string, applied uint64) (*Server, error) {
+	server := CreateServer("a", ":0", "b=:1,c=:2", noCommit)
+	config := DefaultRaftConfig()
+	config.LogCompactEntries = 4
+	config.LogKeepEntries = 2
+	err := server.Configure(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return server, server.Open(dir, applied)
+}
+
+func TestCompactedLogSurvivesRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server, err := openCompactingServer(t, dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(1); i <= 10; i++ {
+		command := Command{Action: "Tick"}
+		if i == 4 {
+			command = NewCommand(addNodeAction, MembershipArgs{ID: "d", Addr: ":3"})
+		}
+		server.storeEntry(&Entry{Index: i, Term: 1 + i/6, Command: command})
+	}
+	server.commitIndex = 10
+	server.applyLogs()
+
+	if server.logBase() != 8 || server.lastIndex() != 10 || server.entry(9).Index != 9 {
+		t.Fatalf("expected the log compacted to 8 and ending at 10, it goes from %v to %v", server.logBase(), server.lastIndex())
+	}
+
+	// A leader that's further back than our base only sends what we still have
+	var reply AppendEntriesReply
+	err = server.AppendEntries(&AppendEntriesArgs{Version: ProtocolVersion, Term: 2, Leader: "b", PrevLogIndex: 6, PrevLogTerm: 2,
+		Entries:      []Entry{{Index: 7, Term: 2}, {Index: 8, Term: 2}, {Index: 9, Term: 2}, {Index: 10, Term: 2}, {Index: 11, Term: 2}},
+		LeaderCommit: 10}, &reply)
+	if err != nil || !reply.Success || server.lastIndex() != 11 {
+		t.Fatalf("entries past our base weren't appended: %+v %v, log ends at %v", reply, err, server.lastIndex())
+	}
+	server.logFile.Close()
+
+	if _, err := openCompactingServer(t, dir, 5); err == nil {
+		t.Fatal("opened a log compacted past what the store has applied")
+	}
+
+	reopened, err := openCompactingServer(t, dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.logFile.Close()
+
+	if reopened.logBase() != 8 || reopened.lastIndex() != 11 || reopened.entry(8).Term != 2 {
+		t.Fatalf("expected the log from 8 to 11 back, got %v to %v", reopened.logBase(), reopened.lastIndex())
+	}
+	if _, found := reopened.nodes["d"]; !found {
+		t.Fatal("a node that joined in a compacted entry isn't a member after a restart")
+	}
+
+	// Peers whose next entry we've dropped need a snapshot
+	reopened.Term = 2
+	reopened.State = "leader"
+	reopened.Leader = reopened.Self
+	reopened.nodes["b"].nextIndex = 5
+	if _, compacted := reopened.nodes["b"].appendEntriesArgs(2); !compacted {
+		t.Fatal("a peer behind our base wasn't sent a snapshot")
+	}
+	reopened.nodes["c"].nextIndex = 9
+	if args, compacted := reopened.nodes["c"].appendEntriesArgs(2); compacted || args.PrevLogIndex != 8 || len(args.Entries) != 3 {
+		t.Fatalf("expected entries from 9 for a peer past our base, got %+v", args)
+	}
+}
+
+func TestSnapshotBringsFollowerUp(t *testing.T) {
+	leader, done := openTestBackend(t)
+	defer done()
+	createAt(t, leader, 100, "snapped", 0, 1000)
+
+	var snapshot bytes.Buffer
+	applied, err := leader.writeSnapshot(&snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "follower")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	follower := CreateBackend("b", ":0", "", dir)
+	err = follower.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := snapshot.Bytes()
+	half := int64(len(data) / 2)
+	args := InstallSnapshotArgs{Version: ProtocolVersion, Term: 1, Leader: "a", LastIndex: applied, LastTerm: 1,
+		Members: []MembershipArgs{{ID: "a", Addr: ":1"}, {ID: "b", Addr: ":0"}}, Data: data[:half]}
+
+	var reply InstallSnapshotReply
+	if err := follower.raft.InstallSnapshot(&args, &reply); err != nil {
+		t.Fatal(err)
+	}
+	args.Offset, args.Data = half+1, data[half:]
+	if err := follower.raft.InstallSnapshot(&args, &reply); err == nil {
+		t.Fatal("took a piece of the snapshot past a gap")
+	}
+	args.Offset, args.Done = half, true
+	if err := follower.raft.InstallSnapshot(&args, &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	var found []protos.Giraffe
+	err = follower.QueryGiraffes(&QueryArgs{Name: "snapped"}, &found)
+	if err != nil || len(found) != 1 || found[0].Idx != 100 {
+		t.Fatalf("expected the leader's giraffe, got %+v %v", found, err)
+	}
+	if follower.raft.logBase() != applied || follower.raft.lastApplied != applied || follower.idx != 101 {
+		t.Fatalf("expected everything at %v, log starts at %v, applied %v, next idx %v", applied,
+			follower.raft.logBase(), follower.raft.lastApplied, follower.idx)
+	}
+	if _, found := follower.raft.nodes["a"]; !found {
+		t.Fatal("the snapshot's membership wasn't taken")
+	}
+
+	// It starts from the snapshot after a restart too
+	follower.disk.Close()
+	follower.raft.logFile.Close()
+	restarted := CreateBackend("b", ":0", "", dir)
+	err = restarted.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.disk.Close()
+	defer restarted.raft.logFile.Close()
+	if giraffe, _ := restarted.getGiraffe(100); giraffe == nil || restarted.raft.logBase() != applied {
+		t.Fatalf("lost the snapshot on restart, log starts at %v", restarted.raft.logBase())
+	}
+}
@@ -7,4 +7,73 @@ const (
 	ElectionMinTimeout = 350
 	// ElectionMaxTimeout describes the maximum range of the randomized election timeout
 	ElectionMaxTimeout = 700
+
+	// WatchBufferSize is how many committed events are kept around for watchers
+	WatchBufferSize = 1024
+	// WatchMaxTimeout caps how long (in milliseconds) a single watch will long-poll
+	WatchMaxTimeout = 30000
+
+	// DefaultPageSize is how many giraffes ListEntries returns when not asked for a page size
+	DefaultPageSize = 20
+	// MaxPageSize is the most giraffes ListEntries will return at once
+	MaxPageSize = 100
+
+	// DefaultQueryLimit is how many giraffes QueryGiraffes returns when not asked for a limit
+	DefaultQueryLimit = 20
+	// MaxQueryLimit is the most giraffes QueryGiraffes will return at once
+	MaxQueryLimit = 100
+
+	// DefaultScanLimit is how many pairs KVScan returns when not asked for a limit
+	DefaultScanLimit = 100
+	// MaxScanLimit is the most pairs KVScan will return at once
+	MaxScanLimit = 1000
+
+	// HistoryRetention is how many log entries back time-travel reads can go
+	HistoryRetention = 4096
+	// HistoryCollectBatch is the most audit records past HistoryRetention a write collects along with its own
+	HistoryCollectBatch = 16
+
+	// StoreCompactMinBytes is how big the store file gets before we consider compacting it
+	StoreCompactMinBytes = 4 << 20
+	// BackupChunkSize is the most bytes of a backup one BackupChunk call gives back
+	BackupChunkSize = 1 << 20
+
+	// LeaseTickInterval is how often (in milliseconds) the leader puts its clock in the log to expire leases
+	LeaseTickInterval = 1000
+
+	// RequestRetention is how long (in milliseconds) a write's request ID is remembered for retries to find
+	RequestRetention = 10 * 60 * 1000
+
+	// ProposeTimeout is how long (in milliseconds) a write waits for its entry to be applied before giving up
+	ProposeTimeout = 10000
+
+	// TransferTimeout is how long (in milliseconds) a leadership transfer waits for the target to catch up
+	TransferTimeout = 5000
+	// MaxPriority is the highest election priority a node can have
+	MaxPriority = 10
+
+	// MaxUncommittedEntries is how many entries the leader lets pile up past commitIndex before turning proposals away
+	MaxUncommittedEntries = 1024
+	// MaxUncommittedBytes is how many bytes of commands the leader lets pile up past commitIndex
+	MaxUncommittedBytes = 8 << 20
+
+	// LogCompactEntries is how many applied entries pile up at the start of the raft log before it's compacted
+	LogCompactEntries = 10000
+	// LogKeepEntries is how many applied entries compacting keeps, so followers a little behind still get entries
+	LogKeepEntries = 1000
+
+	// RemoveNotifyAttempts is how many times we try to replicate to a removed node so it learns it was removed
+	RemoveNotifyAttempts = 10
+)
+
+const (
+	// CommandVersion is the encoding version written into every log entry's command. 2 added species and birth
+	// dates to edits, version 1 entries decode as they are
+	CommandVersion = 2
+
+	// ProtocolVersion is the peer protocol this build speaks, exchanged when nodes connect. It goes up along with
+	// CommandVersion, so builds that can't apply our entries refuse to replicate them instead of crashing on them
+	ProtocolVersion = 2
+	// MinProtocolVersion is the oldest peer protocol this build can still replicate with
+	MinProtocolVersion = 1
 )
@@ -1,6 +1,36 @@
 package main
 
-import "./protos"
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"../protos"
+)
+
+// giraffePrefix is where giraffes live in the disk store
+const giraffePrefix = "giraffe/"
+
+// seedGiraffes are written into a brand new store
+var seedGiraffes = []*protos.Giraffe{
+	&protos.Giraffe{
+		Idx:        0,
+		Name:       "leon",
+		NeckLength: 15,
+	},
+	&protos.Giraffe{
+		Idx:        1,
+		Name:       "Giraffe3",
+		NeckLength: 257,
+	},
+	&protos.Giraffe{
+		Idx:        2,
+		Name:       "Bob",
+		NeckLength: 12,
+	},
+}
 
 // CreateGiraffe serves as a constructor for giraffe
 func CreateGiraffe(idx uint64, name string) *protos.Giraffe {
@@ -8,5 +38,98 @@ func CreateGiraffe(idx uint64, name string) *protos.Giraffe {
 		Idx:        idx,
 		Name:       name,
 		NeckLength: 0,
+		Version:    protos.GiraffeVersion,
+	}
+}
+
+// giraffeKey zero pads the idx so keys sort in idx order
+func giraffeKey(idx uint64) string {
+	return fmt.Sprintf("%v%016x", giraffePrefix, idx)
+}
+
+func putGiraffeOp(giraffe *protos.Giraffe) StoreOp {
+	value, _ := json.Marshal(giraffe)
+	return StoreOp{Key: giraffeKey(giraffe.Idx), Value: value}
+}
+
+func deleteGiraffeOp(idx uint64) StoreOp {
+	return StoreOp{Key: giraffeKey(idx), Delete: true}
+}
+
+// migrateGiraffeOp rewrites a stored giraffe at the current schema version, leaving other ops alone
+func migrateGiraffeOp(op StoreOp) (StoreOp, error) {
+	if op.Delete || !strings.HasPrefix(op.Key, giraffePrefix) {
+		return op, nil
+	}
+
+	var giraffe protos.Giraffe
+	err := json.Unmarshal(op.Value, &giraffe)
+	if err != nil {
+		return op, fmt.Errorf("giraffe %v: %v", op.Key, err)
+	}
+
+	migrated := putGiraffeOp(&giraffe)
+	migrated.Key = op.Key
+	return migrated, nil
+}
+
+// getGiraffe reads a giraffe off disk, giving back nil if there isn't one
+func (backend *Backend) getGiraffe(idx uint64) (*protos.Giraffe, error) {
+	value, found, err := backend.disk.Get(giraffeKey(idx))
+	if err != nil || !found {
+		return nil, err
+	}
+
+	var giraffe protos.Giraffe
+	err = json.Unmarshal(value, &giraffe)
+	if err != nil {
+		return nil, err
+	}
+
+	return &giraffe, nil
+}
+
+// eachGiraffe calls fn with every giraffe on disk in idx order
+func (backend *Backend) eachGiraffe(fn func(*protos.Giraffe) error) error {
+	return backend.disk.Scan(giraffePrefix, func(key string, value []byte) error {
+		var giraffe protos.Giraffe
+		err := json.Unmarshal(value, &giraffe)
+		if err != nil {
+			return err
+		}
+
+		return fn(&giraffe)
+	})
+}
+
+// nextIdx works out the idx to hand out next, one past the newest giraffe or audit record. Audit records outlive
+// their giraffe, and once they're collected too the collected idx is kept, so a deleted giraffe's idx isn't
+// handed out again after a restart
+func (backend *Backend) nextIdx() (uint64, error) {
+	value, found, err := backend.disk.Get(collectedIdxKey)
+	if err != nil {
+		return 0, err
 	}
+
+	next := uint64(0)
+	if found {
+		next = binary.BigEndian.Uint64(value)
+	}
+	for _, prefix := range []string{giraffePrefix, auditPrefix} {
+		err = backend.disk.ScanFrom(prefix, prefix+"\xff", true, func(key string, value []byte) error {
+			idx, err := strconv.ParseUint(strings.SplitN(key[len(prefix):], "/", 2)[0], 16, 64)
+			if err != nil {
+				return fmt.Errorf("bad key %q: %v", key, err)
+			}
+			if idx >= next {
+				next = idx + 1
+			}
+			return errPastRange
+		})
+		if err != nil && err != errPastRange {
+			return 0, err
+		}
+	}
+
+	return next, nil
 }
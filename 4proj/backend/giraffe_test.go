@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"../protos"
+)
+
+func TestOldSchemaGiraffesReadAndRewritten(t *testing.T) {
+	backend, done := openTestBackend(t)
+	defer done()
+
+	old := StoreOp{Key: giraffeKey(100), Value: []byte(`{"Idx":100,"Name":"ancient","NeckLength":40}`)}
+	if err := backend.disk.Apply(backend.applied, old); err != nil {
+		t.Fatal(err)
+	}
+
+	giraffe, err := backend.getGiraffe(100)
+	if err != nil || giraffe == nil || giraffe.Name != "ancient" || giraffe.Version != protos.GiraffeVersion {
+		t.Fatalf("expected the old giraffe at the current version, got %+v %v", giraffe, err)
+	}
+
+	// A restore writes what it reads at the current version, so it's only migrated once
+	migrated, err := migrateGiraffeOp(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated.Key != old.Key || !strings.Contains(string(migrated.Value), `"Species":""`) ||
+		!strings.Contains(string(migrated.Value), `"Version":2`) {
+		t.Fatalf("expected the giraffe rewritten at version 2, got %s", migrated.Value)
+	}
+
+	other := StoreOp{Key: kvKey([]byte("k")), Value: []byte("not a giraffe")}
+	if kept, err := migrateGiraffeOp(other); err != nil || string(kept.Value) != "not a giraffe" {
+		t.Fatalf("an op that isn't a giraffe was touched: %+v %v", kept, err)
+	}
+
+	if _, err := migrateGiraffeOp(StoreOp{Key: giraffeKey(101), Value: []byte(`{"Version":99}`)}); err == nil {
+		t.Fatal("migrated a giraffe from a newer version")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// HealthReply is a node's view of itself, for clients picking who to talk to
+type HealthReply struct {
+	Ready bool // heard from a leader (or, leading, a majority) within an election timeout
+
+	Role       string
+	Term       uint64
+	Leader     string
+	LeaderAddr string
+
+	SinceHeartbeat time.Duration // since the leader last reached us, or a majority last answered the leader. -1 if never
+	ApplyLag       uint64        // commitIndex - lastApplied
+
+	CanWrite          bool // leading, in touch with a majority and not overloaded
+	CanReadLinearized bool // leading, in touch with a majority and caught up applying what's committed
+
+	Pressure Pressure
+}
+
+// quorumContact is the last time a majority of the cluster, counting us, acknowledged our leadership. The
+// caller holds the lock, which lastAck is written under
+func (server *Server) quorumContact() time.Time {
+	now := server.config.Clock.Now()
+	acks := []time.Time{now}
+	for _, node := range server.nodes {
+		acks = append(acks, node.lastAck)
+	}
+
+	sort.Slice(acks, func(i, j int) bool {
+		return acks[i].After(acks[j])
+	})
+
+	return acks[len(acks)/2]
+}
+
+// health puts together a HealthReply from one snapshot of our state, taken under the locks that guard it
+func (server *Server) health() HealthReply {
+	server.logLock <- true
+	pressure := server.pressureLocked()
+	applyLag := server.commitIndex - server.lastApplied
+	if server.lastApplied > server.commitIndex {
+		applyLag = 0
+	}
+	<-server.logLock
+
+	server.lock <- true
+	defer func() {
+		<-server.lock
+	}()
+
+	reply := HealthReply{
+		Role:       server.State,
+		Term:       server.Term,
+		Leader:     server.Leader,
+		LeaderAddr: server.leaderAddr(),
+
+		SinceHeartbeat: -1,
+		ApplyLag:       applyLag,
+
+		Pressure: pressure,
+	}
+
+	contact := server.lastContact
+	if server.isLeader() {
+		contact = server.quorumContact()
+	}
+	if !contact.IsZero() {
+		reply.SinceHeartbeat = server.config.Clock.Now().Sub(contact)
+	}
+
+	inTouch := reply.SinceHeartbeat >= 0 && reply.SinceHeartbeat < server.config.ElectionMaxTimeout
+	reply.Ready = inTouch && server.Leader != "" && !server.joining && !server.removed
+
+	if server.isLeader() && reply.Ready {
+		reply.CanWrite = !pressure.Overloaded
+		reply.CanReadLinearized = applyLag == 0
+	}
+
+	return reply
+}
+
+// Healthcheck exposes RPC to see whether this node is in touch with the cluster and what it can serve
+func (backend *Backend) Healthcheck(args int, reply *HealthReply) error {
+	*reply = backend.raft.health()
+
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"../protos"
+)
+
+// ErrHistoryCollected is returned for reads from before the history floor, or from before a giraffe's recorded
+// history starts
+var ErrHistoryCollected = errors.New("log index is older than the recorded history, it has been collected")
+
+// ErrNotApplied is returned for reads at an index this node hasn't applied yet
+var ErrNotApplied = errors.New("log index has not been applied yet")
+
+// errPastIndex stops a scan over audit records at the first one after the index being read
+var errPastIndex = errors.New("past the log index")
+
+// ReadGiraffeAtArgs asks for a giraffe as it was at a log index
+type ReadGiraffeAtArgs struct {
+	Idx      uint64
+	LogIndex uint64
+}
+
+// versionAt works out a giraffe as of a log index from the last audit record at or before it and the first one
+// after it, either of which can be missing. Giraffes with no records at all are as they've always been,
+// storelock must be held
+func (backend *Backend) versionAt(idx uint64, at *AuditRecord, after *AuditRecord) (*protos.Giraffe, error) {
+	if at != nil {
+		return at.Giraffe, nil // nil if it was deleted
+	}
+	if after == nil {
+		return backend.getGiraffe(idx)
+	}
+	if after.Action == "CreateGiraffe" {
+		return nil, nil
+	}
+	return nil, ErrHistoryCollected // it changed later, but from what we never recorded
+}
+
+// checkHistory makes sure logIndex is one we've applied and is still within HistoryRetention, storelock must be held
+func (backend *Backend) checkHistory(logIndex uint64) error {
+	if logIndex > backend.applied {
+		return ErrNotApplied
+	}
+	if logIndex < historyFloor(backend.applied) {
+		return ErrHistoryCollected
+	}
+	return nil
+}
+
+// giraffeAt finds a giraffe as of a log index from its audit records, storelock must be held
+func (backend *Backend) giraffeAt(idx uint64, logIndex uint64) (*protos.Giraffe, error) {
+	err := backend.checkHistory(logIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	var at, after *AuditRecord
+	err = backend.disk.Scan(auditGiraffePrefix(idx), func(key string, value []byte) error {
+		var record AuditRecord
+		err := json.Unmarshal(value, &record)
+		if err != nil {
+			return err
+		}
+
+		if record.Index > logIndex {
+			after = &record
+			return errPastIndex
+		}
+		at = &record
+		return nil
+	})
+	if err != nil && err != errPastIndex {
+		return nil, err
+	}
+
+	return backend.versionAt(idx, at, after)
+}
+
+// ReadGiraffeAt exposes RPC to fetch a giraffe as it was at a past log index
+func (backend *Backend) ReadGiraffeAt(args *ReadGiraffeAtArgs, reply *protos.Giraffe) error {
+	backend.storelock <- true
+	defer func() {
+		<-backend.storelock
+	}()
+
+	giraffe, err := backend.giraffeAt(args.Idx, args.LogIndex)
+	if err != nil {
+		return err
+	}
+
+	if giraffe == nil {
+		return errors.New("Giraffe not found")
+	}
+
+	*reply = *giraffe
+
+	return nil
+}
+
+// ListEntriesAt gives back every giraffe that existed at a past log index, ordered by idx. Only giraffes changed
+// since then are worked out from their audit records, which the history floor keeps to HistoryRetention entries
+func (backend *Backend) ListEntriesAt(args *uint64, reply *[]protos.Giraffe) error {
+	backend.storelock <- true
+	defer func() {
+		<-backend.storelock
+	}()
+
+	logIndex := *args
+	err := backend.checkHistory(logIndex)
+	if err != nil {
+		return err
+	}
+
+	changed := map[uint64]bool{}
+	err = backend.disk.ScanFrom(auditOrderPrefix, auditOrderKey(logIndex+1, 0), false, func(key string, value []byte) error {
+		_, idx, err := parseAuditOrderKey(key)
+		if err != nil {
+			return err
+		}
+		changed[idx] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	found := map[uint64]*protos.Giraffe{}
+	err = backend.eachGiraffe(func(giraffe *protos.Giraffe) error {
+		if !changed[giraffe.Idx] {
+			found[giraffe.Idx] = giraffe
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for idx := range changed {
+		giraffe, err := backend.giraffeAt(idx, logIndex)
+		if err != nil {
+			return err
+		}
+		if giraffe != nil {
+			found[idx] = giraffe
+		}
+	}
+
+	idxs := []uint64{}
+	for idx := range found {
+		idxs = append(idxs, idx)
+	}
+	sort.Slice(idxs, func(i, j int) bool {
+		return idxs[i] < idxs[j]
+	})
+
+	*reply = []protos.Giraffe{}
+	for _, idx := range idxs {
+		*reply = append(*reply, *found[idx])
+	}
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"testing"
+
+	"../protos"
+)
+
+func TestReadsAtPastIndexes(t *testing.T) {
+	backend, done := openTestBackend(t)
+	defer done()
+
+	base := backend.applied
+	createAt(t, backend, 100, "first", 0, 1000) // base+1
+	edited := NewCommand("EditGiraffe", LogEditGiraffeArgs{Idx: 100, Name: "second", NeckLength: 9})
+	if _, err := applyNext(backend, edited); err != nil { // base+2
+		t.Fatal(err)
+	}
+	if _, err := applyNext(backend, NewCommand("DeleteGiraffe", LogDeleteGiraffeArgs{Idx: 100})); err != nil { // base+3
+		t.Fatal(err)
+	}
+
+	expect := map[uint64]string{base: "", base + 1: "first", base + 2: "second", base + 3: ""}
+	for index, name := range expect {
+		var giraffe protos.Giraffe
+		err := backend.ReadGiraffeAt(&ReadGiraffeAtArgs{Idx: 100, LogIndex: index}, &giraffe)
+		if name == "" && err == nil {
+			t.Fatalf("giraffe 100 existed at %v as %+v", index, giraffe)
+		}
+		if name != "" && (err != nil || giraffe.Name != name) {
+			t.Fatalf("expected %v at %v, got %+v %v", name, index, giraffe, err)
+		}
+
+		var all []protos.Giraffe
+		err = backend.ListEntriesAt(&index, &all)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listed := ""
+		for _, giraffe := range all {
+			if giraffe.Idx == 100 {
+				listed = giraffe.Name
+			}
+		}
+		if listed != name || len(all) < len(seedGiraffes) || all[0].Idx != 0 {
+			t.Fatalf("listing at %v gave %+v", index, all)
+		}
+	}
+
+	var giraffe protos.Giraffe
+	if err := backend.ReadGiraffeAt(&ReadGiraffeAtArgs{Idx: 100, LogIndex: base + 4}, &giraffe); err != ErrNotApplied {
+		t.Fatalf("expected %v reading past what's applied, got %v", ErrNotApplied, err)
+	}
+}
+
+func TestReadAtBeforeHistoryWasRecorded(t *testing.T) {
+	backend, done := openTestBackend(t)
+	defer done()
+
+	// A store from before seeds were audited only has records from the first change on
+	backend.storelock <- true
+	err := backend.disk.Apply(backend.applied, StoreOp{Key: auditKey(1, 0), Delete: true})
+	<-backend.storelock
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := backend.applied
+	if _, err := applyNext(backend, NewCommand("EditGiraffe", LogEditGiraffeArgs{Idx: 1, Name: "renamed"})); err != nil {
+		t.Fatal(err)
+	}
+
+	var giraffe protos.Giraffe
+	if err := backend.ReadGiraffeAt(&ReadGiraffeAtArgs{Idx: 1, LogIndex: before}, &giraffe); err != ErrHistoryCollected {
+		t.Fatalf("expected %v for a version nobody recorded, got %+v %v", ErrHistoryCollected, giraffe, err)
+	}
+	if err := backend.ReadGiraffeAt(&ReadGiraffeAtArgs{Idx: 2, LogIndex: before}, &giraffe); err != nil || giraffe.Name != "Bob" {
+		t.Fatalf("a seed giraffe wasn't there from the start: %+v %v", giraffe, err)
+	}
+}
+
+func TestHistoryIsCollected(t *testing.T) {
+	backend, done := openTestBackend(t)
+	defer done()
+
+	edit := func(index uint64, name string) {
+		command := NewCommand("EditGiraffe", LogEditGiraffeArgs{Idx: 100, Name: name})
+		if _, err := backend.CommitEntry(index, command); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 100 is created and edited, 101 created and deleted, at base+1 to base+4
+	base := backend.applied
+	createAt(t, backend, 100, "first", 0, 1000)
+	edit(base+2, "second")
+	createAt(t, backend, 101, "gone", 0, 1000)
+	if _, err := applyNext(backend, NewCommand("DeleteGiraffe", LogDeleteGiraffeArgs{Idx: 101})); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writing far enough past them collects everything but how each giraffe was left
+	edit(base+4+HistoryRetention+1, "third")
+	floor := historyFloor(backend.applied)
+
+	var history []AuditRecord
+	if err := backend.GiraffeHistory(&GiraffeHistoryArgs{Idx: 100}, &history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].Giraffe.Name != "second" || history[1].Giraffe.Name != "third" {
+		t.Fatalf("expected the last version behind the floor and the newest, got %+v", history)
+	}
+	if err := backend.GiraffeHistory(&GiraffeHistoryArgs{Idx: 101}, &history); err != nil || len(history) != 0 {
+		t.Fatalf("a deleted giraffe's records outlived the floor: %+v %v", history, err)
+	}
+
+	var giraffe protos.Giraffe
+	if err := backend.ReadGiraffeAt(&ReadGiraffeAtArgs{Idx: 100, LogIndex: base + 2}, &giraffe); err != ErrHistoryCollected {
+		t.Fatalf("expected %v reading behind the floor, got %+v %v", ErrHistoryCollected, giraffe, err)
+	}
+	if err := backend.ReadGiraffeAt(&ReadGiraffeAtArgs{Idx: 100, LogIndex: floor}, &giraffe); err != nil || giraffe.Name != "second" {
+		t.Fatalf("expected second at the floor, got %+v %v", giraffe, err)
+	}
+
+	var all []protos.Giraffe
+	if err := backend.ListEntriesAt(&floor, &all); err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != len(seedGiraffes)+1 || all[len(all)-1].Name != "second" {
+		t.Fatalf("listing at the floor gave %+v", all)
+	}
+	before := floor - 1
+	if err := backend.ListEntriesAt(&before, &all); err != ErrHistoryCollected {
+		t.Fatalf("expected %v listing behind the floor, got %v", ErrHistoryCollected, err)
+	}
+
+	if next, err := backend.nextIdx(); err != nil || next != 102 {
+		t.Fatalf("expected collected idx 101 to stay handed out, next is %v %v", next, err)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"log"
+	"net/http"
+	"net/rpc"
+
+	"../tlsconf"
+)
+
+// authenticated is implemented by args that say who is making a write. When TLS is on, whatever the caller
+// put there is replaced with the name on its verified certificate
+type authenticated interface {
+	setClient(name string)
+}
+
+func (args *CreateGiraffeArgs) setClient(name string) {
+	args.Client = name
+}
+
+func (args *EditGiraffeArgs) setClient(name string) {
+	args.Client = name
+}
+
+func (args *DeleteGiraffeArgs) setClient(name string) {
+	args.Client = name
+}
+
+// identityCodec is net/rpc's gob server codec, filling in each request's Client from the connection's
+// certificate as it's decoded. net/rpc doesn't let methods see the connection a call came in on
+type identityCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	name   string
+	closed bool
+}
+
+func newIdentityCodec(conn io.ReadWriteCloser, name string) *identityCodec {
+	buf := bufio.NewWriter(conn)
+	return &identityCodec{
+		rwc:    conn,
+		dec:    gob.NewDecoder(conn),
+		enc:    gob.NewEncoder(buf),
+		encBuf: buf,
+		name:   name,
+	}
+}
+
+func (codec *identityCodec) ReadRequestHeader(r *rpc.Request) error {
+	return codec.dec.Decode(r)
+}
+
+func (codec *identityCodec) ReadRequestBody(body interface{}) error {
+	err := codec.dec.Decode(body)
+	if err != nil {
+		return err
+	}
+
+	if args, ok := body.(authenticated); ok {
+		args.setClient(codec.name)
+	}
+	return nil
+}
+
+func (codec *identityCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	err := codec.enc.Encode(r)
+	if err == nil {
+		err = codec.enc.Encode(body)
+	}
+	if err != nil {
+		if codec.encBuf.Flush() == nil {
+			log.Printf("Could not encode RPC response: %v\n", err)
+			codec.Close() // the stream is out of step now
+		}
+		return err
+	}
+
+	return codec.encBuf.Flush()
+}
+
+func (codec *identityCodec) Close() error {
+	if codec.closed {
+		return nil
+	}
+	codec.closed = true
+	return codec.rwc.Close()
+}
+
+// identified serves server's RPCs with every write's Client taken from the caller's certificate, doing the
+// same CONNECT handshake as rpc.HandleHTTP
+func identified(server *rpc.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			io.WriteString(w, "405 must CONNECT\n")
+			return
+		}
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "no client certificate", http.StatusForbidden)
+			return
+		}
+		name := tlsconf.CertName(r.TLS.PeerCertificates[0])
+
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			log.Printf("RPC hijacking %v: %v\n", r.RemoteAddr, err)
+			return
+		}
+		io.WriteString(conn, "HTTP/1.0 200 Connected to Go RPC\n\n")
+
+		server.ServeCodec(newIdentityCodec(conn, name))
+	})
+}
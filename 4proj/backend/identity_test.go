@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net"
+	"net/rpc"
+	"testing"
+)
+
+// Auditee echoes back who a delete says it's from
+type Auditee struct{}
+
+func (auditee *Auditee) Delete(args *DeleteGiraffeArgs, reply *DeleteGiraffeArgs) error {
+	*reply = *args
+	return nil
+}
+
+func TestClientComesFromCertificate(t *testing.T) {
+	server := rpc.NewServer()
+	server.Register(&Auditee{})
+
+	serverConn, clientConn := net.Pipe()
+	go server.ServeCodec(newIdentityCodec(serverConn, "frontend-1"))
+
+	client := rpc.NewClient(clientConn)
+	defer client.Close()
+
+	var reply DeleteGiraffeArgs
+	err := client.Call("Auditee.Delete", &DeleteGiraffeArgs{Idx: 4, Client: "admin", OnBehalfOf: "10.0.0.7:5555"}, &reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reply.Client != "frontend-1" {
+		t.Fatalf("the caller claimed to be %v and got away with it", reply.Client)
+	}
+	if reply.OnBehalfOf != "10.0.0.7:5555" || reply.Idx != 4 {
+		t.Fatalf("the rest of the args didn't make it through: %+v", reply)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"../protos"
+)
+
+// QueryArgs filters, sorts and limits a giraffe query. Filters left empty match everything
+type QueryArgs struct {
+	Name          string
+	NamePrefix    string
+	MinNeckLength *uint64
+	MaxNeckLength *uint64
+
+	SortBy     string // one of "idx", "name" or "necklength", defaults to "idx"
+	Descending bool
+	Limit      int // 0 means DefaultQueryLimit, never more than MaxQueryLimit
+
+	Staleness Staleness
+}
+
+// The secondary orderings live in the store next to the giraffes, as keys with no value, so queries walk them
+// instead of scanning every giraffe and nothing has to be loaded when we start
+const (
+	nameIndexPrefix = "name/" // name/<name>\x00<idx>
+	neckIndexPrefix = "neck/" // neck/<neck length>/<idx>
+	indexedKey      = "meta/indexed"
+)
+
+// errPastRange stops a scan over an index at the first key past what the query wants
+var errPastRange = errors.New("past the end of the range")
+
+func nameIndexKey(name string, idx uint64) string {
+	return fmt.Sprintf("%v%v\x00%016x", nameIndexPrefix, name, idx)
+}
+
+func neckIndexKey(neckLength uint64, idx uint64) string {
+	return fmt.Sprintf("%v%016x/%016x", neckIndexPrefix, neckLength, idx)
+}
+
+// indexedIdx gets the idx back out of an index key, which always ends with it
+func indexedIdx(key string) (uint64, error) {
+	if len(key) < 16 {
+		return 0, fmt.Errorf("bad index key %q", key)
+	}
+	return strconv.ParseUint(key[len(key)-16:], 16, 64)
+}
+
+// indexOps indexes a giraffe
+func indexOps(giraffe *protos.Giraffe) []StoreOp {
+	return []StoreOp{
+		{Key: nameIndexKey(giraffe.Name, giraffe.Idx), Value: []byte{}},
+		{Key: neckIndexKey(giraffe.NeckLength, giraffe.Idx), Value: []byte{}},
+	}
+}
+
+// unindexOps unindexes a giraffe, it must be passed the values it was indexed with
+func unindexOps(giraffe *protos.Giraffe) []StoreOp {
+	return []StoreOp{
+		{Key: nameIndexKey(giraffe.Name, giraffe.Idx), Delete: true},
+		{Key: neckIndexKey(giraffe.NeckLength, giraffe.Idx), Delete: true},
+	}
+}
+
+// buildIndex indexes every giraffe in a store from before the index was kept on disk. It only has to run once
+func (backend *Backend) buildIndex() error {
+	_, indexed, err := backend.disk.Get(indexedKey)
+	if err != nil || indexed {
+		return err
+	}
+
+	ops := []StoreOp{}
+	err = backend.eachGiraffe(func(giraffe *protos.Giraffe) error {
+		ops = append(ops, indexOps(giraffe)...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ops = append(ops, StoreOp{Key: indexedKey, Value: []byte{}})
+	return backend.disk.Apply(backend.disk.Applied(), ops...)
+}
+
+// giraffeIdxs gives back up to n idxs in order from from onwards, or the n before from going backwards when
+// reverse is set
+func (backend *Backend) giraffeIdxs(from uint64, n int, reverse bool) ([]uint64, error) {
+	idxs := []uint64{}
+	err := backend.disk.ScanFrom(giraffePrefix, giraffeKey(from), reverse, func(key string, value []byte) error {
+		if len(idxs) == n {
+			return errPastRange
+		}
+
+		idx, err := indexedIdx(key)
+		if err != nil {
+			return err
+		}
+		idxs = append(idxs, idx)
+		return nil
+	})
+	if err != nil && err != errPastRange {
+		return nil, err
+	}
+
+	return idxs, nil
+}
+
+// keyRange is the keys from lo up to but not including hi, all of which start with prefix
+type keyRange struct {
+	prefix string
+	lo     string
+	hi     string
+}
+
+// idxRange is every giraffe, in idx order
+func idxRange() keyRange {
+	return keyRange{prefix: giraffePrefix, lo: giraffePrefix, hi: giraffePrefix + "\xff"}
+}
+
+// nameRange is the part of the name index a query's name or name prefix covers
+func nameRange(args *QueryArgs) keyRange {
+	prefix := nameIndexPrefix + args.NamePrefix
+	if args.Name != "" {
+		prefix = nameIndexPrefix + args.Name + "\x00"
+	}
+	return keyRange{prefix: prefix, lo: prefix, hi: prefix + "\xff"}
+}
+
+// neckRange is the part of the neck length index a query's neck lengths cover
+func neckRange(args *QueryArgs) keyRange {
+	r := keyRange{prefix: neckIndexPrefix, lo: neckIndexPrefix, hi: neckIndexPrefix + "\xff"}
+	if args.MinNeckLength != nil {
+		r.lo = neckIndexKey(*args.MinNeckLength, 0)
+	}
+	if args.MaxNeckLength != nil {
+		r.hi = neckIndexKey(*args.MaxNeckLength, math.MaxUint64) + "\x00"
+	}
+	return r
+}
+
+// walkBatchSize is how many index keys walkIndex reads from the store at a time
+const walkBatchSize = 64
+
+// walkIndex calls fn with the idx in every key in r, in order or backwards, until it gives back false. Keys are
+// read a batch at a time, so fn can read the store
+func (backend *Backend) walkIndex(r keyRange, reverse bool, fn func(idx uint64) (bool, error)) error {
+	from := r.lo
+	if reverse {
+		from = r.hi
+	}
+
+	for {
+		keys := []string{}
+		err := backend.disk.ScanFrom(r.prefix, from, reverse, func(key string, value []byte) error {
+			if len(keys) == walkBatchSize || (!reverse && key >= r.hi) || (reverse && key < r.lo) {
+				return errPastRange
+			}
+			keys = append(keys, key)
+			return nil
+		})
+		if err != nil && err != errPastRange {
+			return err
+		}
+
+		for _, key := range keys {
+			idx, err := indexedIdx(key)
+			if err != nil {
+				return err
+			}
+			more, err := fn(idx)
+			if err != nil || !more {
+				return err
+			}
+		}
+
+		if len(keys) < walkBatchSize {
+			return nil
+		}
+		from = keys[len(keys)-1]
+		if !reverse {
+			from += "\x00" // the first key after it
+		}
+	}
+}
+
+// matches checks a giraffe against every filter in a query
+func (args *QueryArgs) matches(giraffe *protos.Giraffe) bool {
+	if args.Name != "" && giraffe.Name != args.Name {
+		return false
+	}
+	if args.NamePrefix != "" && !strings.HasPrefix(giraffe.Name, args.NamePrefix) {
+		return false
+	}
+	if args.MinNeckLength != nil && giraffe.NeckLength < *args.MinNeckLength {
+		return false
+	}
+	if args.MaxNeckLength != nil && giraffe.NeckLength > *args.MaxNeckLength {
+		return false
+	}
+	return true
+}
+
+// QueryGiraffes searches giraffes by name and neck length using the secondary indexes. When the index it sorts
+// by also covers its filters, or there are none, it walks that index in order and stops once it has Limit
+// giraffes. Otherwise it gathers every giraffe the filtered index covers, then sorts them
+func (backend *Backend) QueryGiraffes(args *QueryArgs, reply *[]protos.Giraffe) error {
+	err := backend.checkStaleness(args.Staleness)
+	if err != nil {
+		return err
+	}
+
+	limit := args.Limit
+	if limit <= 0 {
+		limit = DefaultQueryLimit
+	}
+	if limit > MaxQueryLimit {
+		limit = MaxQueryLimit
+	}
+
+	byName := args.Name != "" || args.NamePrefix != ""
+	byNeck := !byName && (args.MinNeckLength != nil || args.MaxNeckLength != nil)
+
+	var sorted keyRange
+	var less func(a, b *protos.Giraffe) bool
+	walk := false
+	switch args.SortBy {
+	case "", "idx":
+		sorted, walk = idxRange(), !byName && !byNeck
+		less = func(a, b *protos.Giraffe) bool { return a.Idx < b.Idx }
+	case "name":
+		sorted, walk = nameRange(args), !byNeck
+		less = func(a, b *protos.Giraffe) bool {
+			return a.Name < b.Name || (a.Name == b.Name && a.Idx < b.Idx)
+		}
+	case "necklength":
+		sorted, walk = neckRange(args), !byName
+		less = func(a, b *protos.Giraffe) bool {
+			return a.NeckLength < b.NeckLength || (a.NeckLength == b.NeckLength && a.Idx < b.Idx)
+		}
+	default:
+		return errors.New("can only sort by idx, name or necklength")
+	}
+
+	filtered := sorted
+	if !walk && byName {
+		filtered = nameRange(args)
+	} else if !walk {
+		filtered = neckRange(args)
+	}
+
+	backend.storelock <- true
+	defer func() {
+		<-backend.storelock
+	}()
+
+	found := []*protos.Giraffe{}
+	err = backend.walkIndex(filtered, walk && args.Descending, func(idx uint64) (bool, error) {
+		giraffe, err := backend.getGiraffe(idx)
+		if err != nil {
+			return false, err
+		}
+
+		if giraffe != nil && args.matches(giraffe) {
+			found = append(found, giraffe)
+		}
+		return !walk || len(found) < limit, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if !walk {
+		sort.Slice(found, func(i, j int) bool {
+			if args.Descending {
+				return less(found[j], found[i])
+			}
+			return less(found[i], found[j])
+		})
+	}
+
+	if len(found) > limit {
+		found = found[:limit]
+	}
+
+	*reply = []protos.Giraffe{}
+	for _, giraffe := range found {
+		*reply = append(*reply, *giraffe)
+	}
+
+	return nil
+}
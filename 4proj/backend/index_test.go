@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"../protos"
+)
+
+func TestIndexBuiltForOldStore(t *testing.T) {
+	backend, done := openTestBackend(t)
+	defer done()
+
+	// A store from before the index was on disk has giraffes and nothing else
+	ops := []StoreOp{{Key: indexedKey, Delete: true}}
+	err := backend.disk.ScanFrom("", "", false, func(key string, value []byte) error {
+		if strings.HasPrefix(key, nameIndexPrefix) || strings.HasPrefix(key, neckIndexPrefix) {
+			ops = append(ops, StoreOp{Key: key, Delete: true})
+		}
+		return nil
+	})
+	if err == nil {
+		err = backend.disk.Apply(backend.applied, ops...)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found []protos.Giraffe
+	if err := backend.QueryGiraffes(&QueryArgs{Name: "Bob"}, &found); err != nil || len(found) != 0 {
+		t.Fatalf("expected nothing indexed, got %+v %v", found, err)
+	}
+
+	if err := backend.buildIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.QueryGiraffes(&QueryArgs{Name: "Bob"}, &found); err != nil || len(found) != 1 || found[0].Idx != 2 {
+		t.Fatalf("expected Bob once the index was built, got %+v %v", found, err)
+	}
+
+	max := uint64(20)
+	if err := backend.QueryGiraffes(&QueryArgs{MaxNeckLength: &max, SortBy: "necklength"}, &found); err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 || found[0].Name != "Bob" || found[1].Name != "leon" {
+		t.Fatalf("expected Bob and leon by neck length, got %+v", found)
+	}
+}
+
+func TestIndexFollowsEdits(t *testing.T) {
+	backend, done := openTestBackend(t)
+	defer done()
+
+	createAt(t, backend, 100, "Bobby", 0, 1000)
+	if _, err := applyNext(backend, NewCommand("EditGiraffe", LogEditGiraffeArgs{Idx: 100, Name: "Alf", NeckLength: 30})); err != nil {
+		t.Fatal(err)
+	}
+
+	var found []protos.Giraffe
+	if err := backend.QueryGiraffes(&QueryArgs{NamePrefix: "Bob"}, &found); err != nil || len(found) != 1 || found[0].Idx != 2 {
+		t.Fatalf("the old name is still indexed: %+v %v", found, err)
+	}
+
+	min := uint64(30)
+	if err := backend.QueryGiraffes(&QueryArgs{MinNeckLength: &min}, &found); err != nil || len(found) != 2 {
+		t.Fatalf("expected the edited giraffe and Giraffe3, got %+v %v", found, err)
+	}
+
+	if _, err := applyNext(backend, NewCommand("DeleteGiraffe", LogDeleteGiraffeArgs{Idx: 100})); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.QueryGiraffes(&QueryArgs{Name: "Alf"}, &found); err != nil || len(found) != 0 {
+		t.Fatalf("a deleted giraffe is still indexed: %+v %v", found, err)
+	}
+
+	// Its idx isn't handed out again even though it's gone
+	next, err := backend.nextIdx()
+	if err != nil || next != 101 {
+		t.Fatalf("expected 101 next, got %v %v", next, err)
+	}
+}
+
+func TestQueryLimits(t *testing.T) {
+	backend, done := openTestBackend(t)
+	defer done()
+
+	for i := uint64(0); i < MaxQueryLimit+10; i++ {
+		createAt(t, backend, 100+i, fmt.Sprintf("many%03d", i), 0, 1000)
+	}
+
+	var found []protos.Giraffe
+	if err := backend.QueryGiraffes(&QueryArgs{}, &found); err != nil || len(found) != DefaultQueryLimit || found[0].Idx != 0 {
+		t.Fatalf("expected the first %v giraffes by default, got %v %v", DefaultQueryLimit, len(found), err)
+	}
+	if err := backend.QueryGiraffes(&QueryArgs{Limit: MaxQueryLimit * 2}, &found); err != nil || len(found) != MaxQueryLimit {
+		t.Fatalf("expected no more than %v giraffes, got %v %v", MaxQueryLimit, len(found), err)
+	}
+
+	// Walking the name index backwards stops at the limit, past a batch boundary
+	err := backend.QueryGiraffes(&QueryArgs{NamePrefix: "many", SortBy: "name", Descending: true, Limit: walkBatchSize + 5}, &found)
+	if err != nil || len(found) != walkBatchSize+5 {
+		t.Fatalf("expected %v giraffes, got %v %v", walkBatchSize+5, len(found), err)
+	}
+	for i, giraffe := range found {
+		if want := fmt.Sprintf("many%03d", MaxQueryLimit+9-i); giraffe.Name != want {
+			t.Fatalf("expected %v at %v, got %v", want, i, giraffe.Name)
+		}
+	}
+
+	// Filtering on one index and sorting by another sorts everything that matched
+	min := uint64(1)
+	err = backend.QueryGiraffes(&QueryArgs{MinNeckLength: &min, SortBy: "name", Limit: 2}, &found)
+	if err != nil || len(found) != 2 || found[0].Name != "Bob" || found[1].Name != "Giraffe3" {
+		t.Fatalf("expected Bob and Giraffe3, got %+v %v", found, err)
+	}
+}
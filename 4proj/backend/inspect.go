@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// InspectArgs says what to do with a stopped node's data directory
+type InspectArgs struct {
+	Dir     string
+	Against string // another node's data directory to diff with
+
+	From uint64
+	To   uint64 // 0 means the end of the log, or the store's applied index when replaying
+
+	Replay bool
+}
+
+// InspectedEntry is a log entry as printed by --inspect
+type InspectedEntry struct {
+	Index   uint64
+	Term    uint64
+	Action  string
+	Version uint32
+	Data    json.RawMessage
+
+	Client     string `json:",omitempty"`
+	OnBehalfOf string `json:",omitempty"`
+	Time       int64  `json:",omitempty"`
+}
+
+// StateEntry is one key of the state machine as printed by --inspect --replay
+type StateEntry struct {
+	Key   string
+	Value json.RawMessage
+}
+
+// StateDiff is a key two states disagree on, a missing side is null
+type StateDiff struct {
+	Key    string
+	Mine   json.RawMessage
+	Theirs json.RawMessage
+}
+
+// readLogFile reads a raft log without touching it, stopping at a torn entry at the end. The first entry is the
+// log's base, a placeholder at index 0 unless the log has been compacted
+func readLogFile(dir string) ([]*Entry, error) {
+	file, err := os.Open(filepath.Join(dir, "raft.log"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := []*Entry{&Entry{}}
+	reader := bufio.NewReader(file)
+	for {
+		entry, _, err := readLogEntry(reader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF || err == errTornEntry {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 1 && entries[0].Index == 0 && entry.Command.Action == logBaseAction {
+			entries[0] = entry
+			continue
+		}
+		if expected := entries[0].Index + uint64(len(entries)); entry.Index != expected {
+			return nil, fmt.Errorf("raft log is out of order, expected index %v but found %v", expected, entry.Index)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// readStoreFile reads every key out of a store file without touching it
+func readStoreFile(dir string) (uint64, map[string][]byte, error) {
+	file, err := os.Open(filepath.Join(dir, "giraffes.db"))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer file.Close()
+
+	state := map[string][]byte{}
+	var applied uint64
+	reader := bufio.NewReader(file)
+	for {
+		recordApplied, ops, _, _, err := readRecord(reader, 0)
+		if err != nil {
+			break // the end, or a torn record the store would truncate on open
+		}
+
+		for _, op := range ops {
+			if op.Delete {
+				delete(state, op.Key)
+			} else {
+				state[op.Key] = op.Value
+			}
+		}
+		applied = recordApplied
+	}
+
+	return applied, state, nil
+}
+
+// replay applies entries up to index to a state machine, giving back everything in its store. A whole log is
+// replayed onto a brand new state machine. What a compacted log dropped is only in the node's store, so its
+// replay starts from a copy of the store in dataDir, which has to be at or behind index
+func replay(dataDir string, entries []*Entry, index uint64) (map[string][]byte, error) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	if base := entries[0].Index; base != 0 {
+		applied, state, err := readStoreFile(dataDir)
+		if err != nil {
+			return nil, err
+		}
+		if applied > index {
+			return nil, fmt.Errorf("the log was compacted up to %v and the store is already at %v, it can't be "+
+				"replayed to %v", base, applied, index)
+		}
+		err = seedStore(dir, applied, state)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	log.SetOutput(ioutil.Discard) // the state machine is chatty
+	defer log.SetOutput(os.Stderr)
+
+	backend := CreateBackend("replay", "replay", "", dir)
+	err = backend.open()
+	if err != nil {
+		return nil, err
+	}
+	defer backend.disk.Close()
+	defer backend.raft.logFile.Close()
+
+	for _, entry := range entries[backend.applied-entries[0].Index+1 : index-entries[0].Index+1] {
+		backend.CommitEntry(entry.Index, entry.Command) // errors are part of the state machine's behavior
+	}
+
+	state := map[string][]byte{}
+	err = backend.disk.Scan("", func(key string, value []byte) error {
+		state[key] = value
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// seedStore writes state out as the store in dir, applied up to applied, with a raft log starting from there like
+// a restored backup's
+func seedStore(dir string, applied uint64, state map[string][]byte) error {
+	store, err := OpenDiskStore(filepath.Join(dir, "giraffes.db"))
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	ops := []StoreOp{}
+	for _, key := range sortedKeys(state) {
+		ops = append(ops, StoreOp{Key: key, Value: state[key]})
+	}
+	err = store.Apply(applied, ops...)
+	if err != nil {
+		return err
+	}
+
+	frame, err := encodeLogEntry(&Entry{Index: applied, Command: NewCommand(logBaseAction, LogBaseArgs{})})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "raft.log"), frame, 0644)
+}
+
+// printable gives back a store value as JSON, hex encoding the ones that aren't
+func printable(value []byte) json.RawMessage {
+	if value == nil {
+		return nil
+	}
+	if json.Valid(value) {
+		return value
+	}
+	encoded, _ := json.Marshal(fmt.Sprintf("%x", value))
+	return encoded
+}
+
+func sortedKeys(states ...map[string][]byte) []string {
+	seen := map[string]bool{}
+	keys := []string{}
+	for _, state := range states {
+		for key := range state {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func diffStates(mine map[string][]byte, theirs map[string][]byte) []StateDiff {
+	diffs := []StateDiff{}
+	for _, key := range sortedKeys(mine, theirs) {
+		if !bytes.Equal(mine[key], theirs[key]) || (mine[key] == nil) != (theirs[key] == nil) {
+			diffs = append(diffs, StateDiff{Key: key, Mine: printable(mine[key]), Theirs: printable(theirs[key])})
+		}
+	}
+	return diffs
+}
+
+// firstDivergence finds the first index two logs disagree on, or where the shorter one ends. Only the indexes
+// both logs still have are compared, whatever was compacted out of either is taken to agree
+func firstDivergence(mine []*Entry, theirs []*Entry) (uint64, bool) {
+	mineBase, theirBase := mine[0].Index, theirs[0].Index
+	mineLast, theirLast := mineBase+uint64(len(mine)-1), theirBase+uint64(len(theirs)-1)
+
+	from := mineBase + 1
+	if theirBase >= from {
+		from = theirBase + 1
+	}
+	for i := from; i <= mineLast && i <= theirLast; i++ {
+		a, b := mine[i-mineBase], theirs[i-theirBase]
+		if a.Term != b.Term || a.Command.Action != b.Command.Action || !bytes.Equal(a.Command.Data, b.Command.Data) {
+			return i, true
+		}
+	}
+
+	if mineLast < theirLast {
+		return mineLast + 1, true
+	}
+	if theirLast < mineLast {
+		return theirLast + 1, true
+	}
+
+	return 0, false
+}
+
+// Inspect prints a stopped node's log, replays it, or diffs it against another node, writing JSON lines to out
+func Inspect(args InspectArgs, out io.Writer) error {
+	entries, err := readLogFile(args.Dir)
+	if err != nil {
+		return err
+	}
+	base := entries[0].Index
+	last := base + uint64(len(entries)-1)
+
+	applied, stored, err := readStoreFile(args.Dir)
+	if err != nil {
+		return err
+	}
+	log.Printf("%v: log goes from %v to %v, store has applied up to %v\n", args.Dir, base, last, applied)
+
+	encoder := json.NewEncoder(out)
+
+	if args.Against != "" {
+		return inspectAgainst(args, entries, encoder)
+	}
+
+	if !args.Replay {
+		to := args.To
+		if to == 0 || to > last {
+			to = last
+		}
+		from := args.From
+		if from <= base {
+			from = base + 1 // the base is a placeholder, and everything before it has been compacted
+		}
+		for i := from; i <= to; i++ {
+			entry := entries[i-base]
+			err = encoder.Encode(InspectedEntry{entry.Index, entry.Term, entry.Command.Action, entry.Command.Version,
+				entry.Command.Data, entry.Command.Client, entry.Command.OnBehalfOf, entry.Command.Time})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	to := args.To
+	if to == 0 {
+		to = applied
+	}
+	if to > last {
+		return fmt.Errorf("can't replay to %v, the log only goes to %v", to, last)
+	}
+
+	state, err := replay(args.Dir, entries, to)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range sortedKeys(state) {
+		err = encoder.Encode(StateEntry{Key: key, Value: printable(state[key])})
+		if err != nil {
+			return err
+		}
+	}
+
+	if to == applied {
+		diffs := diffStates(state, stored)
+		if len(diffs) == 0 {
+			log.Printf("replaying to %v matches the store\n", to)
+		} else {
+			log.Printf("replaying to %v disagrees with the store on %v keys, such as %v\n", to, len(diffs), diffs[0].Key)
+		}
+	}
+
+	return nil
+}
+
+// inspectAgainst finds where two nodes' logs part ways, then replays both to the same index and diffs the results.
+// A compacted log is replayed from its node's store, so the index has to be at or past what that store applied
+func inspectAgainst(args InspectArgs, entries []*Entry, encoder *json.Encoder) error {
+	theirs, err := readLogFile(args.Against)
+	if err != nil {
+		return err
+	}
+
+	diverged, found := firstDivergence(entries, theirs)
+	if found {
+		log.Printf("logs diverge at index %v\n", diverged)
+	} else {
+		log.Println("logs are identical")
+	}
+
+	mineLast := entries[0].Index + uint64(len(entries)-1)
+	theirLast := theirs[0].Index + uint64(len(theirs)-1)
+
+	to := args.To
+	if to == 0 {
+		to = mineLast
+		if theirLast < to {
+			to = theirLast
+		}
+	}
+	if to > mineLast || to > theirLast {
+		return fmt.Errorf("can't replay to %v, one of the logs is shorter", to)
+	}
+
+	mine, err := replay(args.Dir, entries, to)
+	if err != nil {
+		return err
+	}
+	other, err := replay(args.Against, theirs, to)
+	if err != nil {
+		return err
+	}
+
+	diffs := diffStates(mine, other)
+	log.Printf("replayed both logs to %v, %v keys differ\n", to, len(diffs))
+
+	for _, diff := range diffs {
+		err = encoder.Encode(diff)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
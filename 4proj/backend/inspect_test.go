@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"../protos"
+)
+
+// logAndApply puts command in backend's raft log at the next index and applies it, like a committed entry
+func logAndApply(t *testing.T, backend *Backend, command Command) {
+	entry := &Entry{Index: backend.raft.lastIndex() + 1, Term: 1, Command: command}
+	backend.raft.storeEntry(entry)
+	backend.CommitEntry(entry.Index, command)
+}
+
+// logOnly puts command in backend's raft log at the next index without applying it
+func logOnly(backend *Backend, command Command) {
+	backend.raft.storeEntry(&Entry{Index: backend.raft.lastIndex() + 1, Term: 1, Command: command})
+}
+
+func createCommand(idx uint64, name string) Command {
+	command := NewCommand("CreateGiraffe", LogCreateGiraffeArgs{Name: name, Idx: idx})
+	command.Time = 1000
+	return command
+}
+
+func TestReplayFromACompactedLog(t *testing.T) {
+	backend, done := openTestBackend(t)
+	defer done()
+
+	logAndApply(t, backend, createCommand(100, "first"))
+	logAndApply(t, backend, NewCommand("KVPut", KVArgs{Key: []byte("k"), Value: []byte("v")}))
+	logAndApply(t, backend, NewCommand("EditGiraffe", LogEditGiraffeArgs{Idx: 100, Name: "second"}))
+	if err := backend.raft.compactLog(2); err != nil {
+		t.Fatal(err)
+	}
+	logOnly(backend, createCommand(101, "later"))
+	dir := backend.dataDir
+
+	if err := Inspect(InspectArgs{Dir: dir, Replay: true, To: 2}, &bytes.Buffer{}); err == nil {
+		t.Fatal("replayed a compacted log to before what its store has applied")
+	}
+
+	// Replaying the entry the store hasn't applied yet has to land where applying it does
+	var out bytes.Buffer
+	if err := Inspect(InspectArgs{Dir: dir, Replay: true, To: 4}, &out); err != nil {
+		t.Fatal(err)
+	}
+	backend.CommitEntry(4, createCommand(101, "later"))
+	_, stored, err := readStoreFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replayed := map[string][]byte{}
+	decoder := json.NewDecoder(&out)
+	for decoder.More() {
+		var entry StateEntry
+		if err := decoder.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		replayed[entry.Key] = entry.Value
+	}
+	for _, key := range sortedKeys(stored, replayed) {
+		if !bytes.Equal(printable(stored[key]), replayed[key]) {
+			t.Fatalf("replaying disagrees with applying on %v: %s against %s", key, replayed[key], printable(stored[key]))
+		}
+	}
+	if _, found := replayed[giraffeKey(101)]; !found {
+		t.Fatal("the entry past the store wasn't replayed")
+	}
+}
+
+func TestInspectAgainstACompactedLog(t *testing.T) {
+	mine, done := openTestBackend(t)
+	defer done()
+	theirs, done := openTestBackend(t)
+	defer done()
+
+	for _, backend := range []*Backend{mine, theirs} {
+		logAndApply(t, backend, createCommand(100, "first"))
+		logAndApply(t, backend, NewCommand("KVPut", KVArgs{Key: []byte("k"), Value: []byte("v")}))
+		logAndApply(t, backend, NewCommand("EditGiraffe", LogEditGiraffeArgs{Idx: 100, Name: "second"}))
+	}
+	if err := mine.raft.compactLog(2); err != nil {
+		t.Fatal(err)
+	}
+
+	diffs := func() []StateDiff {
+		var out bytes.Buffer
+		if err := Inspect(InspectArgs{Dir: mine.dataDir, Against: theirs.dataDir}, &out); err != nil {
+			t.Fatal(err)
+		}
+
+		diffs := []StateDiff{}
+		decoder := json.NewDecoder(&out)
+		for decoder.More() {
+			var diff StateDiff
+			if err := decoder.Decode(&diff); err != nil {
+				t.Fatal(err)
+			}
+			diffs = append(diffs, diff)
+		}
+		return diffs
+	}
+
+	if found := diffs(); len(found) != 0 {
+		t.Fatalf("a compacted log replayed from its store differs from the whole log it matches: %+v", found)
+	}
+
+	logAndApply(t, mine, NewCommand("EditGiraffe", LogEditGiraffeArgs{Idx: 100, Name: "mine"}))
+	logAndApply(t, theirs, NewCommand("EditGiraffe", LogEditGiraffeArgs{Idx: 100, Name: "theirs"}))
+
+	for _, diff := range diffs() {
+		if diff.Key != giraffeKey(100) {
+			continue
+		}
+		var a, b protos.Giraffe
+		if json.Unmarshal(diff.Mine, &a) != nil || json.Unmarshal(diff.Theirs, &b) != nil || a.Name != "mine" || b.Name != "theirs" {
+			t.Fatalf("expected giraffe 100 to differ by name, got %s against %s", diff.Mine, diff.Theirs)
+		}
+		return
+	}
+	t.Fatal("the logs' diverging edits weren't in the diff")
+}
+
+func TestFirstDivergenceSkipsCompactedEntries(t *testing.T) {
+	whole := []*Entry{{}, {Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 1}, {Index: 4, Term: 2}}
+	compacted := []*Entry{{Index: 2, Term: 1, Command: Command{Action: logBaseAction}}, {Index: 3, Term: 1}, {Index: 4, Term: 3}}
+
+	if index, found := firstDivergence(compacted, whole); !found || index != 4 {
+		t.Fatalf("expected the logs to diverge at 4, got %v %v", index, found)
+	}
+	if index, found := firstDivergence(compacted, whole[:4]); !found || index != 4 {
+		t.Fatalf("expected the shorter log to end at 4, got %v %v", index, found)
+	}
+	if _, found := firstDivergence(compacted[:2], whole[:4]); found {
+		t.Fatal("logs that agree on everything they both have diverged")
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+// kvPrefix is where the general purpose key value namespace lives in the disk store
+const kvPrefix = "kv/"
+
+// ErrCompareFailed is returned when a compare and swap doesn't find what it expected
+var ErrCompareFailed = errors.New("compare failed")
+
+// KVPair is a key, its value, and the log index it was last written at
+type KVPair struct {
+	Key     []byte
+	Value   []byte
+	Version uint64
+}
+
+// KVArgs describes a put, delete or compare and swap. For a swap, Expect has to match the current
+// value, or ExpectMissing has to be set and the key must not exist
+type KVArgs struct {
+	Key   []byte
+	Value []byte
+
+	Expect        []byte
+	ExpectMissing bool
+}
+
+// KVGetArgs picks a key and how stale an answer can be
+type KVGetArgs struct {
+	Key       []byte
+	Staleness Staleness
+}
+
+// KVScanArgs asks for the keys starting with Prefix, carrying on after After when it's set
+type KVScanArgs struct {
+	Prefix []byte
+	After  []byte // the Next of the last scan's reply
+	Limit  int    // 0 means DefaultScanLimit, never more than MaxScanLimit
+
+	Staleness Staleness
+}
+
+// KVScanReply holds a scan's pairs in key order. Next is the key to pass as After for the rest, nil once there
+// are no more
+type KVScanReply struct {
+	Pairs []KVPair
+	Next  []byte
+}
+
+func kvKey(key []byte) string {
+	return kvPrefix + string(key)
+}
+
+func decodeKVPair(value []byte) (*KVPair, error) {
+	var pair KVPair
+	err := json.Unmarshal(value, &pair)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pair, nil
+}
+
+// getKV reads a pair, giving back nil if there isn't one
+func (backend *Backend) getKV(key []byte) (*KVPair, error) {
+	value, found, err := backend.disk.Get(kvKey(key))
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return decodeKVPair(value)
+}
+
+// putKV writes a pair at index, storelock must be held
+func (backend *Backend) putKV(index uint64, key []byte, value []byte) (interface{}, error) {
+	pair := KVPair{
+		Key:     key,
+		Value:   value,
+		Version: index,
+	}
+
+	encoded, _ := json.Marshal(pair)
+	err := backend.disk.Apply(index, StoreOp{Key: kvKey(key), Value: encoded})
+	if err != nil {
+		return nil, err
+	}
+
+	return pair, nil
+}
+
+func (backend *Backend) kvPut(index uint64, command Command) (interface{}, error) {
+	var args KVArgs
+	err := command.decode(&args)
+	if err != nil {
+		return nil, err
+	}
+
+	backend.storelock <- true
+	defer func() {
+		<-backend.storelock
+	}()
+
+	return backend.putKV(index, args.Key, args.Value)
+}
+
+func (backend *Backend) kvDelete(index uint64, command Command) (interface{}, error) {
+	var args KVArgs
+	err := command.decode(&args)
+	if err != nil {
+		return false, err
+	}
+
+	backend.storelock <- true
+	defer func() {
+		<-backend.storelock
+	}()
+
+	existing, err := backend.getKV(args.Key)
+	if err != nil {
+		return false, err
+	}
+
+	if existing == nil {
+		return false, nil
+	}
+
+	err = backend.disk.Apply(index, StoreOp{Key: kvKey(args.Key), Delete: true})
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (backend *Backend) kvCas(index uint64, command Command) (interface{}, error) {
+	var args KVArgs
+	err := command.decode(&args)
+	if err != nil {
+		return nil, err
+	}
+
+	backend.storelock <- true
+	defer func() {
+		<-backend.storelock
+	}()
+
+	existing, err := backend.getKV(args.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	if args.ExpectMissing {
+		if existing != nil {
+			return nil, ErrCompareFailed
+		}
+	} else if existing == nil || !bytes.Equal(existing.Value, args.Expect) {
+		return nil, ErrCompareFailed
+	}
+
+	return backend.putKV(index, args.Key, args.Value)
+}
+
+// KVPut exposes RPC to set a key
+func (backend *Backend) KVPut(args *KVArgs, reply *KVPair) error {
+	if !backend.raft.isLeader() {
+		return backend.notLeader()
+	}
+
+	pair, err := backend.propose(NewCommand("KVPut", *args))
+	if err != nil {
+		return err
+	}
+
+	*reply = pair.(KVPair)
+
+	return nil
+}
+
+// KVDelete exposes RPC to remove a key, replying with whether it existed
+func (backend *Backend) KVDelete(args *KVArgs, reply *bool) error {
+	if !backend.raft.isLeader() {
+		return backend.notLeader()
+	}
+
+	deleted, err := backend.propose(NewCommand("KVDelete", *args))
+	if err != nil {
+		return err
+	}
+
+	*reply = deleted.(bool)
+
+	return nil
+}
+
+// KVCas exposes RPC to set a key only if it currently holds what the caller expects
+func (backend *Backend) KVCas(args *KVArgs, reply *KVPair) error {
+	if !backend.raft.isLeader() {
+		return backend.notLeader()
+	}
+
+	pair, err := backend.propose(NewCommand("KVCas", *args))
+	if err != nil {
+		return err
+	}
+
+	*reply = pair.(KVPair)
+
+	return nil
+}
+
+// KVGet exposes RPC to read a key. This adds nothing to the log
+func (backend *Backend) KVGet(args *KVGetArgs, reply *KVPair) error {
+	err := backend.checkStaleness(args.Staleness)
+	if err != nil {
+		return err
+	}
+
+	backend.storelock <- true
+	defer func() {
+		<-backend.storelock
+	}()
+
+	pair, err := backend.getKV(args.Key)
+	if err != nil {
+		return err
+	}
+
+	if pair == nil {
+		return errors.New("key not found")
+	}
+
+	*reply = *pair
+
+	return nil
+}
+
+// KVScan exposes RPC to read the keys with a prefix, in key order, at most Limit at a time
+func (backend *Backend) KVScan(args *KVScanArgs, reply *KVScanReply) error {
+	err := backend.checkStaleness(args.Staleness)
+	if err != nil {
+		return err
+	}
+
+	limit := args.Limit
+	if limit <= 0 {
+		limit = DefaultScanLimit
+	}
+	if limit > MaxScanLimit {
+		limit = MaxScanLimit
+	}
+
+	from := kvKey(args.Prefix)
+	if args.After != nil && kvKey(args.After) >= from {
+		from = kvKey(args.After) + "\x00" // the first key after it
+	}
+
+	backend.storelock <- true
+	defer func() {
+		<-backend.storelock
+	}()
+
+	*reply = KVScanReply{Pairs: []KVPair{}}
+
+	err = backend.disk.ScanFrom(kvKey(args.Prefix), from, false, func(key string, value []byte) error {
+		if len(reply.Pairs) == limit {
+			reply.Next = reply.Pairs[limit-1].Key // there's more past it
+			return errPastRange
+		}
+
+		pair, err := decodeKVPair(value)
+		if err != nil {
+			return err
+		}
+
+		reply.Pairs = append(reply.Pairs, *pair)
+		return nil
+	})
+	if err != nil && err != errPastRange {
+		return err
+	}
+
+	return nil
+}
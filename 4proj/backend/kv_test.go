@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestKVCasConflicts(t *testing.T) {
+	backend, done := openTestBackend(t)
+	defer done()
+
+	cas := func(key, expect, value string, missing bool) (interface{}, error) {
+		args := KVArgs{Key: []byte(key), Value: []byte(value), ExpectMissing: missing}
+		if expect != "" {
+			args.Expect = []byte(expect)
+		}
+		return applyNext(backend, NewCommand("KVCas", args))
+	}
+	get := func(key string) *KVPair {
+		pair, err := backend.getKV([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pair
+	}
+
+	if _, err := cas("color", "", "spotted", true); err != nil {
+		t.Fatalf("a swap expecting a missing key failed on one that's missing: %v", err)
+	}
+	first := get("color")
+	if first == nil || string(first.Value) != "spotted" || first.Version != backend.applied {
+		t.Fatalf("expected spotted at %v, got %+v", backend.applied, first)
+	}
+
+	if _, err := cas("color", "", "plain", true); err != ErrCompareFailed {
+		t.Fatalf("expected a swap expecting a missing key to fail on one that's there, got %v", err)
+	}
+	if _, err := cas("color", "plain", "striped", false); err != ErrCompareFailed {
+		t.Fatalf("expected a swap with the wrong value to fail, got %v", err)
+	}
+	if pair := get("color"); string(pair.Value) != "spotted" || pair.Version != first.Version {
+		t.Fatalf("a failed swap changed the key: %+v", pair)
+	}
+
+	reply, err := cas("color", "spotted", "striped", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pair := reply.(KVPair); string(pair.Value) != "striped" || pair.Version != backend.applied {
+		t.Fatalf("expected striped at %v, got %+v", backend.applied, pair)
+	}
+
+	// Two writers that both read spotted, only the first gets to swap
+	if _, err := cas("color", "spotted", "dotted", false); err != ErrCompareFailed {
+		t.Fatalf("expected a swap against a value that's since changed to fail, got %v", err)
+	}
+
+	if _, err := applyNext(backend, NewCommand("KVDelete", KVArgs{Key: []byte("color")})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cas("color", "striped", "dotted", false); err != ErrCompareFailed {
+		t.Fatalf("expected a swap on a deleted key to fail, got %v", err)
+	}
+	if _, err := cas("color", "", "dotted", true); err != nil {
+		t.Fatalf("a deleted key couldn't be created again: %v", err)
+	}
+}
+
+func TestKVScanPages(t *testing.T) {
+	backend, done := openTestBackend(t)
+	defer done()
+
+	ops := []StoreOp{}
+	for i := 0; i < MaxScanLimit+5; i++ {
+		key := []byte(fmt.Sprintf("giraffe/%04d", i))
+		value, _ := json.Marshal(KVPair{Key: key, Value: []byte("v"), Version: backend.applied})
+		ops = append(ops, StoreOp{Key: kvKey(key), Value: value})
+	}
+	ops = append(ops, StoreOp{Key: kvKey([]byte("zebra")), Value: []byte("{}")})
+	backend.storelock <- true
+	err := backend.disk.Apply(backend.applied, ops...)
+	<-backend.storelock
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scan := func(args KVScanArgs) KVScanReply {
+		var reply KVScanReply
+		if err := backend.KVScan(&args, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+
+	if reply := scan(KVScanArgs{Prefix: []byte("giraffe/")}); len(reply.Pairs) != DefaultScanLimit || reply.Next == nil {
+		t.Fatalf("expected %v pairs and more to come without a limit, got %v next %q", DefaultScanLimit,
+			len(reply.Pairs), reply.Next)
+	}
+	if reply := scan(KVScanArgs{Prefix: []byte("giraffe/"), Limit: MaxScanLimit * 2}); len(reply.Pairs) != MaxScanLimit {
+		t.Fatalf("expected the limit capped at %v, got %v", MaxScanLimit, len(reply.Pairs))
+	}
+
+	seen := 0
+	args := KVScanArgs{Prefix: []byte("giraffe/"), Limit: 300}
+	for pages := 0; ; pages++ {
+		if pages > 4 {
+			t.Fatal("the scan never finished")
+		}
+		reply := scan(args)
+		for _, pair := range reply.Pairs {
+			if want := fmt.Sprintf("giraffe/%04d", seen); string(pair.Key) != want {
+				t.Fatalf("expected %v next, got %q", want, pair.Key)
+			}
+			seen++
+		}
+		if reply.Next == nil {
+			break
+		}
+		args.After = reply.Next
+	}
+	if seen != MaxScanLimit+5 {
+		t.Fatalf("paging through the scan saw %v keys", seen)
+	}
+}
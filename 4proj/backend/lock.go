@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// lockPrefix is where leases live in the disk store
+const lockPrefix = "lock/"
+
+// clockKey holds the last time a leader proposed, leases expire against this rather than local clocks
+const clockKey = "meta/clock"
+
+// Lease is a lock held by Owner until Expires (in leader milliseconds). Token is the log index it was
+// acquired at, so it only ever goes up and can be used as a fencing token
+type Lease struct {
+	Name    string
+	Owner   string
+	Token   uint64
+	Expires int64
+}
+
+// LockArgs describes a lock request. TTL is in milliseconds, Token is needed to renew or release
+type LockArgs struct {
+	Name  string
+	Owner string
+	Token uint64
+	TTL   int64
+
+	Now int64 // set by the leader when proposing
+}
+
+// LogTickArgs carries the leader's clock into the log
+type LogTickArgs struct {
+	Time int64
+}
+
+func lockKey(name string) string {
+	return lockPrefix + name
+}
+
+// getLease reads a lease that hasn't expired yet, giving back nil if there isn't one
+func (backend *Backend) getLease(name string) (*Lease, error) {
+	value, found, err := backend.disk.Get(lockKey(name))
+	if err != nil || !found {
+		return nil, err
+	}
+
+	var lease Lease
+	err = json.Unmarshal(value, &lease)
+	if err != nil {
+		return nil, err
+	}
+
+	if lease.Expires <= backend.clock {
+		return nil, nil // the next tick will clean it up
+	}
+
+	return &lease, nil
+}
+
+func putLeaseOp(lease *Lease) StoreOp {
+	value, _ := json.Marshal(lease)
+	return StoreOp{Key: lockKey(lease.Name), Value: value}
+}
+
+func clockOp(now int64) StoreOp {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(now))
+	return StoreOp{Key: clockKey, Value: value}
+}
+
+// loadClock reads the last leader time back off disk
+func (backend *Backend) loadClock() error {
+	value, found, err := backend.disk.Get(clockKey)
+	if err != nil || !found {
+		return err
+	}
+
+	backend.clock = int64(binary.BigEndian.Uint64(value))
+	return nil
+}
+
+func (backend *Backend) acquireLock(index uint64, command Command) (interface{}, error) {
+	var args LockArgs
+	err := command.decode(&args)
+	if err != nil {
+		return nil, err
+	}
+
+	backend.storelock <- true
+	defer func() {
+		<-backend.storelock
+	}()
+
+	held, err := backend.getLease(args.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	if held != nil {
+		if held.Owner == args.Owner {
+			return *held, nil // a retried acquire from the holder
+		}
+		return nil, fmt.Errorf("lock %v is held by %v", args.Name, held.Owner)
+	}
+
+	lease := &Lease{
+		Name:    args.Name,
+		Owner:   args.Owner,
+		Token:   index,
+		Expires: backend.leaseStart(args) + args.TTL,
+	}
+
+	err = backend.disk.Apply(index, putLeaseOp(lease))
+	if err != nil {
+		return nil, err
+	}
+
+	return *lease, nil
+}
+
+// leaseStart is when a lease taken now starts counting down from
+func (backend *Backend) leaseStart(args LockArgs) int64 {
+	if args.Now > backend.clock {
+		return args.Now
+	}
+	return backend.clock
+}
+
+// heldLease checks the caller really holds a lock, storelock must be held
+func (backend *Backend) heldLease(args LockArgs) (*Lease, error) {
+	held, err := backend.getLease(args.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	if held == nil || held.Owner != args.Owner || held.Token != args.Token {
+		return nil, fmt.Errorf("lock %v is not held by %v with token %v", args.Name, args.Owner, args.Token)
+	}
+
+	return held, nil
+}
+
+func (backend *Backend) renewLock(index uint64, command Command) (interface{}, error) {
+	var args LockArgs
+	err := command.decode(&args)
+	if err != nil {
+		return nil, err
+	}
+
+	backend.storelock <- true
+	defer func() {
+		<-backend.storelock
+	}()
+
+	lease, err := backend.heldLease(args)
+	if err != nil {
+		return nil, err
+	}
+
+	lease.Expires = backend.leaseStart(args) + args.TTL
+
+	err = backend.disk.Apply(index, putLeaseOp(lease))
+	if err != nil {
+		return nil, err
+	}
+
+	return *lease, nil
+}
+
+func (backend *Backend) releaseLock(index uint64, command Command) (interface{}, error) {
+	var args LockArgs
+	err := command.decode(&args)
+	if err != nil {
+		return false, err
+	}
+
+	backend.storelock <- true
+	defer func() {
+		<-backend.storelock
+	}()
+
+	_, err = backend.heldLease(args)
+	if err != nil {
+		return false, err
+	}
+
+	err = backend.disk.Apply(index, StoreOp{Key: lockKey(args.Name), Delete: true})
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// tick moves the replicated clock forward and expires every lease, giraffe and request past it
+func (backend *Backend) tick(index uint64, command Command) (interface{}, error) {
+	var args LogTickArgs
+	err := command.decode(&args)
+	if err != nil {
+		return nil, err
+	}
+
+	backend.storelock <- true
+	defer func() {
+		<-backend.storelock
+	}()
+
+	now := backend.clock
+	if args.Time > now {
+		now = args.Time // a new leader's clock might be behind, never go backwards
+	}
+
+	ops := []StoreOp{clockOp(now)}
+	err = backend.disk.Scan(lockPrefix, func(key string, value []byte) error {
+		var lease Lease
+		err := json.Unmarshal(value, &lease)
+		if err != nil {
+			return err
+		}
+
+		if lease.Expires <= now {
+			log.Printf("Lease on %v held by %v expired\n", lease.Name, lease.Owner)
+			ops = append(ops, StoreOp{Key: key, Delete: true})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	giraffeOps, expired, err := backend.expireOps(index, now)
+	if err != nil {
+		return nil, err
+	}
+	ops = append(ops, giraffeOps...)
+
+	requestOps, err := backend.expireRequestOps(now)
+	if err != nil {
+		return nil, err
+	}
+	ops = append(ops, requestOps...)
+
+	err = backend.disk.Apply(index, ops...)
+	if err != nil {
+		return nil, err
+	}
+
+	backend.clock = now
+	backend.publishExpired(expired)
+
+	return now, nil
+}
+
+// errDue stops needsTick's scans at the first deadline that's come
+var errDue = errors.New("found something to expire")
+
+// needsTick is whether any lease, giraffe TTL or remembered request is due to expire at leader time now, so
+// a tick would do something
+func (backend *Backend) needsTick(now int64) bool {
+	backend.storelock <- true
+	defer func() {
+		<-backend.storelock
+	}()
+
+	due := func(deadline int64) error {
+		if deadline <= now {
+			return errDue
+		}
+		return nil
+	}
+
+	err := backend.disk.Scan(lockPrefix, func(key string, value []byte) error {
+		var lease Lease
+		err := json.Unmarshal(value, &lease)
+		if err != nil {
+			return err
+		}
+		return due(lease.Expires)
+	})
+	if err == nil {
+		err = backend.disk.Scan(ttlPrefix, func(key string, value []byte) error {
+			return due(int64(binary.BigEndian.Uint64(value)))
+		})
+	}
+	if err == nil {
+		err = backend.disk.Scan(requestExpiryPrefix, func(key string, value []byte) error {
+			deadline, _, err := parseRequestExpiryKey(key)
+			if err != nil {
+				return err
+			}
+			if due(deadline) != nil {
+				return errDue
+			}
+			return errNotYet // they're in deadline order, so the rest aren't due either
+		})
+		if err == errNotYet {
+			err = nil
+		}
+	}
+
+	return err != nil // if the store can't be read let the tick find out
+}
+
+// proposeTicks has the leader check every LeaseTickInterval whether a lease, TTL or request has expired, and
+// only then put its clock in the log. They all count from the leader's clock when they're proposed, so a stale
+// clock in the store while nothing is due doesn't matter, and an idle cluster with long leases doesn't grow
+// its log every second
+func (backend *Backend) proposeTicks() {
+	for {
+		<-time.After(LeaseTickInterval * time.Millisecond)
+
+		now := leaderNow()
+		if !backend.raft.isLeader() || !backend.needsTick(now) {
+			continue
+		}
+
+		backend.raft.proposeEntry(NewCommand("Tick", LogTickArgs{Time: now})) // no point piling up ticks either
+	}
+}
+
+// AcquireLock exposes RPC to take a lock for TTL milliseconds
+func (backend *Backend) AcquireLock(args *LockArgs, reply *Lease) error {
+	if !backend.raft.isLeader() {
+		return backend.notLeader()
+	}
+	if args.TTL <= 0 {
+		return errors.New("lock TTL has to be positive")
+	}
+
+	args.Now = leaderNow()
+
+	lease, err := backend.propose(NewCommand("AcquireLock", *args))
+	if err != nil {
+		return err
+	}
+
+	*reply = lease.(Lease)
+
+	return nil
+}
+
+// RenewLock exposes RPC to extend a held lock by another TTL milliseconds
+func (backend *Backend) RenewLock(args *LockArgs, reply *Lease) error {
+	if !backend.raft.isLeader() {
+		return backend.notLeader()
+	}
+	if args.TTL <= 0 {
+		return errors.New("lock TTL has to be positive")
+	}
+
+	args.Now = leaderNow()
+
+	lease, err := backend.propose(NewCommand("RenewLock", *args))
+	if err != nil {
+		return err
+	}
+
+	*reply = lease.(Lease)
+
+	return nil
+}
+
+// ReleaseLock exposes RPC to give up a held lock
+func (backend *Backend) ReleaseLock(args *LockArgs, reply *bool) error {
+	if !backend.raft.isLeader() {
+		return backend.notLeader()
+	}
+
+	released, err := backend.propose(NewCommand("ReleaseLock", *args))
+	if err != nil {
+		return err
+	}
+
+	*reply = released.(bool)
+
+	return nil
+}
+
+// ReadLockArgs picks a lock and how stale an answer can be
+type ReadLockArgs struct {
+	Name      string
+	Staleness Staleness
+}
+
+// ReadLock exposes RPC to see who holds a lock. This adds nothing to the log
+func (backend *Backend) ReadLock(args *ReadLockArgs, reply *Lease) error {
+	err := backend.checkStaleness(args.Staleness)
+	if err != nil {
+		return err
+	}
+
+	backend.storelock <- true
+	defer func() {
+		<-backend.storelock
+	}()
+
+	lease, err := backend.getLease(args.Name)
+	if err != nil {
+		return err
+	}
+
+	if lease == nil {
+		return fmt.Errorf("lock %v is not held", args.Name)
+	}
+
+	*reply = *lease
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import "testing"
+
+// lockAt applies a lock command for owner at leader time now
+func lockAt(backend *Backend, action string, owner string, token uint64, ttl int64, now int64) (interface{}, error) {
+	return applyNext(backend, NewCommand(action, LockArgs{Name: "l", Owner: owner, Token: token, TTL: ttl, Now: now}))
+}
+
+func TestLeaseExpiresOnlyOnTick(t *testing.T) {
+	backend, done := openTestBackend(t)
+	defer done()
+
+	reply, err := lockAt(backend, "AcquireLock", "a", 0, 1000, 5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := reply.(Lease)
+
+	if backend.needsTick(5999) {
+		t.Fatal("a tick was wanted before the lease was due")
+	}
+	if !backend.needsTick(6000) {
+		t.Fatal("an expired lease doesn't ask for a tick")
+	}
+
+	// Until the expiry is in the log every replica still sees the lease, whatever its own clock says
+	if _, err := lockAt(backend, "AcquireLock", "b", 0, 1000, 5500); err == nil {
+		t.Fatal("took a lock someone else holds")
+	}
+
+	if _, err := applyNext(backend, NewCommand("Tick", LogTickArgs{Time: 6000})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lockAt(backend, "RenewLock", "a", first.Token, 1000, 6000); err == nil {
+		t.Fatal("renewed a lease that expired")
+	}
+
+	reply, err = lockAt(backend, "AcquireLock", "b", 0, 1000, 6000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := reply.(Lease)
+
+	// The old holder's token fences it out of whatever the lock guards
+	if second.Token <= first.Token {
+		t.Fatalf("the next holder's token %v isn't past the old one %v", second.Token, first.Token)
+	}
+	if _, err := lockAt(backend, "ReleaseLock", "a", first.Token, 0, 6000); err == nil {
+		t.Fatal("released a lock with a stale token")
+	}
+}
+
+func TestRenewKeepsToken(t *testing.T) {
+	backend, done := openTestBackend(t)
+	defer done()
+
+	reply, err := lockAt(backend, "AcquireLock", "a", 0, 1000, 5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lease := reply.(Lease)
+
+	reply, err = lockAt(backend, "RenewLock", "a", lease.Token, 1000, 5900)
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewed := reply.(Lease)
+	if renewed.Token != lease.Token || renewed.Expires != 6900 {
+		t.Fatalf("renewing %+v gave %+v", lease, renewed)
+	}
+
+	if _, err := applyNext(backend, NewCommand("Tick", LogTickArgs{Time: 6000})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lockAt(backend, "ReleaseLock", "a", lease.Token, 0, 6000); err != nil {
+		t.Fatalf("the renewed lease expired on its old deadline: %v", err)
+	}
+}
@@ -4,19 +4,156 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"../tlsconf"
 )
 
 func main() {
-	fmt.Println("Hello World!")
-
 	addr := flag.String("listen", ":8080", "The address for this server to listen on")
 
-	backends := flag.String("backend", ":8081,:8082", "The other backends available")
+	backends := flag.String("backend", ":8081,:8082", "The other backends available, as id=addr (or just addr, which is then also the ID)")
+
+	id := flag.String("id", "", "This node's ID, remembered in its data directory (defaults to the listen address)")
+
+	dataDir := flag.String("data", "", "Where to keep the store and raft log (defaults to data/<listen>)")
+
+	restore := flag.String("restore", "", "Bootstrap this node's empty data directory from a backup file before starting")
+
+	join := flag.Bool("join", false, "Wait to be added with raftctl add-node before taking part in elections")
+
+	verify := flag.String("verify", "", "Check a backup file's integrity and exit")
+
+	tlsCert := flag.String("tls-cert", "", "PEM certificate naming this backend's --listen address, turns on mutual TLS")
+
+	tlsKey := flag.String("tls-key", "", "PEM key for --tls-cert")
+
+	tlsCA := flag.String("tls-ca", "", "PEM CA that peers', frontends' and operators' certificates must be signed by")
+
+	tlsOperators := flag.String("tls-operators", "raftctl", "Comma separated certificate names (common name or DNS name) allowed to use admin RPCs when TLS is on")
+
+	heartbeat := flag.Duration("heartbeat", HeartbeatTimeout*time.Millisecond, "How often the leader sends heartbeats")
+
+	electionMin := flag.Duration("election-min", ElectionMinTimeout*time.Millisecond, "The shortest a follower waits for a heartbeat before starting an election")
+
+	electionMax := flag.Duration("election-max", ElectionMaxTimeout*time.Millisecond, "The longest a follower waits for a heartbeat before starting an election")
+
+	priority := flag.Int("priority", 0, "This node's election priority, from 0 to 10. The leader hands off to higher priority nodes once they catch up")
+
+	witness := flag.Bool("witness", false, "Only vote and keep the raft log's indexes and terms, no giraffe store. A witness never leads")
+
+	maxUncommitted := flag.Int("max-uncommitted", MaxUncommittedEntries, "How many uncommitted entries the leader allows before turning writes away, 0 for no limit")
+
+	maxUncommittedBytes := flag.Int64("max-uncommitted-bytes", MaxUncommittedBytes, "How many bytes of uncommitted commands the leader allows before turning writes away, 0 for no limit")
+
+	compactEntries := flag.Uint64("log-compact-entries", LogCompactEntries, "How many applied entries pile up in the raft log before it's compacted, 0 to never compact")
+
+	keepEntries := flag.Uint64("log-keep-entries", LogKeepEntries, "How many applied entries compacting the raft log keeps for followers that are a little behind")
+
+	trace := flag.String("trace", "", "Append election and replication events to this file as JSON lines, merge nodes' traces with raftctl merge-traces")
+
+	seed := flag.Int64("seed", 0, "Seed for randomized election timeouts, 0 seeds from the time")
+
+	inspect := flag.String("inspect", "", "Print the raft log in a stopped node's data directory as JSON and exit")
+
+	against := flag.String("against", "", "With --inspect, find where the log diverges from this data directory's and diff the replayed states")
+
+	replayLog := flag.Bool("replay", false, "With --inspect, replay the log into a fresh state machine and print the state")
+
+	from := flag.Uint64("from", 0, "With --inspect, the first log index to print")
+
+	to := flag.Uint64("to", 0, "With --inspect, the last log index to print or replay to")
 
 	flag.Parse()
 
-	backend := CreateBackend(*addr, *backends)
-	err := backend.Run()
+	if *inspect != "" {
+		err := Inspect(InspectArgs{
+			Dir:     *inspect,
+			Against: *against,
+			From:    *from,
+			To:      *to,
+			Replay:  *replayLog,
+		}, os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *verify != "" {
+		file, err := os.Open(*verify)
+		if err != nil {
+			log.Fatal(err)
+		}
+		info, err := VerifyBackup(file)
+		file.Close()
+		if err != nil {
+			log.Fatalf("%v is not a good backup: %v", *verify, err)
+		}
+		fmt.Printf("%v is good: %v records at applied index %v, %v bytes\n", *verify, info.Records, info.Applied, info.Bytes)
+		return
+	}
+
+	if *dataDir == "" {
+		*dataDir = filepath.Join("data", strings.Replace(*addr, ":", "_", -1))
+	}
+
+	if *restore != "" {
+		file, err := os.Open(*restore)
+		if err != nil {
+			log.Fatal(err)
+		}
+		info, err := RestoreBackup(file, *dataDir)
+		file.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Restored %v records from index %v of the old cluster into %v\n", info.Records, info.Applied, *dataDir)
+	}
+
+	fmt.Println("Hello World!")
+
+	backend := CreateBackend(*id, *addr, *backends, *dataDir)
+	backend.raft.joining = *join
+
+	if *trace != "" {
+		tracer, err := OpenTracer(*trace)
+		if err != nil {
+			log.Fatal(err)
+		}
+		backend.raft.tracer = tracer
+	}
+
+	err := backend.raft.Configure(RaftConfig{
+		HeartbeatTimeout:   *heartbeat,
+		ElectionMinTimeout: *electionMin,
+		ElectionMaxTimeout: *electionMax,
+		Priority:           *priority,
+		Witness:            *witness,
+		Seed:               *seed,
+
+		MaxUncommittedEntries: *maxUncommitted,
+		MaxUncommittedBytes:   *maxUncommittedBytes,
+
+		LogCompactEntries: *compactEntries,
+		LogKeepEntries:    *keepEntries,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *tlsCert != "" || *tlsKey != "" || *tlsCA != "" {
+		config, err := tlsconf.Load(*tlsCert, *tlsKey, *tlsCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		backend.UseTLS(config, strings.Split(*tlsOperators, ","))
+	}
+
+	err = backend.Run()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// MembershipArgs names a node joining or leaving the cluster. Adding a node that's already a member at a new
+// address moves it there. Entries from before node IDs only have an address, which is then also the ID
+type MembershipArgs struct {
+	ID   string
+	Addr string
+}
+
+func (args *MembershipArgs) id() string {
+	if args.ID == "" {
+		return args.Addr
+	}
+	return args.ID
+}
+
+// Membership changes are raft's own commands. They take effect as soon as they are in a node's log,
+// committed or not, the state machine only has to mark them applied
+const (
+	addNodeAction    = "AddNode"
+	removeNodeAction = "RemoveNode"
+)
+
+func isMembershipChange(action string) bool {
+	return action == addNodeAction || action == removeNodeAction
+}
+
+// applyMembership adds or removes a node for a membership entry that just made it into our log
+func (server *Server) applyMembership(command Command) {
+	var args MembershipArgs
+	err := command.decode(&args)
+	if err != nil {
+		log.Printf("Bad membership change: %v\n", err)
+		return
+	}
+
+	id := args.id()
+	if id == server.Self {
+		server.joining = false
+		server.removed = command.Action == removeNodeAction
+		return
+	}
+
+	node, found := server.nodes[id]
+	switch command.Action {
+	case addNodeAction:
+		if !found {
+			node = CreateNode(server, id, args.Addr)
+			node.nextIndex = server.lastIndex() + 1
+			server.nodes[id] = node
+			log.Printf("%v joined the cluster at %v\n", id, args.Addr)
+		} else if node.Addr != args.Addr {
+			node.Close()
+			node.lock <- true
+			node.Addr = args.Addr
+			<-node.lock
+			log.Printf("%v moved to %v\n", id, args.Addr)
+		}
+	case removeNodeAction:
+		if found {
+			delete(server.nodes, id)
+			node.Close()
+			log.Printf("%v left the cluster\n", id)
+		}
+	}
+}
+
+// rebuildMembership works the current membership back out from the initial peers, or the membership our log's
+// base recorded if it has been compacted, and every change in our log. It's needed whenever the log is loaded,
+// truncated or replaced by a snapshot
+func (server *Server) rebuildMembership() {
+	existing := server.nodes
+
+	server.nodes = map[string]*Node{}
+	server.removed = false
+	for id, addr := range server.initialPeers {
+		if id != server.Self {
+			server.nodes[id] = CreateNode(server, id, addr)
+		}
+	}
+
+	for _, entry := range server.log {
+		if entry.Command.Action == logBaseAction {
+			server.applyLogBase(entry.Command)
+		}
+		if isMembershipChange(entry.Command.Action) {
+			server.applyMembership(entry.Command)
+		}
+	}
+
+	for id, node := range server.nodes {
+		if old, found := existing[id]; found && old.Addr == node.Addr {
+			server.nodes[id] = old // keep the connection and replication progress we already have
+		} else {
+			node.nextIndex = server.lastIndex() + 1
+		}
+	}
+
+	for id, old := range existing {
+		if server.nodes[id] != old {
+			old.Close()
+		}
+	}
+}
+
+// loggedAddr is the address the last membership entry in our log gave a node. We can't tell from our own
+// address whether the others know we moved, only from whether it was ever announced
+func (server *Server) loggedAddr(id string) string {
+	for i := len(server.log) - 1; i > 0; i-- {
+		command := server.log[i].Command
+		if command.Action != addNodeAction {
+			continue
+		}
+		var args MembershipArgs
+		if command.decode(&args) == nil && args.id() == id {
+			return args.Addr
+		}
+	}
+
+	var base LogBaseArgs
+	if server.log[0].Command.decode(&base) == nil {
+		for _, member := range base.Members {
+			if member.id() == id {
+				return member.Addr
+			}
+		}
+	}
+	return ""
+}
+
+// changeMembership proposes adding or removing a node and waits for it to commit. Only one change
+// can be in flight at a time, so that the old and new majorities always overlap
+func (server *Server) changeMembership(action string, args MembershipArgs) error {
+	entry, leaving, err := server.appendMembership(action, args)
+	if err != nil {
+		return err
+	}
+	if leaving != nil && action == removeNodeAction {
+		go server.tellRemoved(leaving, entry.Index, entry.Term)
+	}
+
+	_, err = server.awaitEntry(entry)
+	if err == nil {
+		server.lock <- true
+		if server.removed && server.isLeader() {
+			server.stepDown("removed ourselves from the cluster")
+		}
+		<-server.lock
+	}
+
+	return err
+}
+
+// appendMembership checks a membership change and appends it in one go, so two changes can't both find
+// nothing in flight. It gives back the node being removed, if it's one of our peers
+func (server *Server) appendMembership(action string, args MembershipArgs) (*Entry, *Node, error) {
+	server.lock <- true
+	defer func() {
+		<-server.lock
+	}()
+	if !server.isLeader() {
+		return nil, nil, errors.New("only the leader can change membership")
+	}
+
+	server.logLock <- true
+	defer func() {
+		<-server.logLock
+	}()
+
+	for _, entry := range server.entriesFrom(server.commitIndex + 1) {
+		if isMembershipChange(entry.Command.Action) {
+			return nil, nil, fmt.Errorf("membership change at index %v has not committed yet", entry.Index)
+		}
+	}
+
+	if action == addNodeAction && args.Addr == "" {
+		return nil, nil, errors.New("a node needs an address to be added")
+	}
+
+	id := args.id()
+	node, member := server.nodes[id]
+	if action == addNodeAction && ((id == server.Self && server.loggedAddr(id) == args.Addr) || (member && node.Addr == args.Addr)) {
+		return nil, nil, fmt.Errorf("%v is already a member at that address", id)
+	}
+	if action == removeNodeAction && !member && id != server.Self {
+		return nil, nil, fmt.Errorf("%v is not a member", id)
+	}
+
+	return server.appendEntryLocked(NewCommand(action, args)), node, nil
+}
+
+// tellRemoved keeps replicating to a node we just removed until it has the entry removing it, so it
+// knows to stop running elections instead of disrupting us. It's no longer counted, so this is best effort
+func (server *Server) tellRemoved(node *Node, index uint64, term uint64) {
+	for attempt := 0; attempt < RemoveNotifyAttempts && node.matchIndex < index; attempt++ {
+		node.AppendEntries(term)
+		<-server.config.Clock.After(server.config.HeartbeatTimeout / 3)
+	}
+	node.Close()
+}
+
+// TransferLeadership hands leadership to target once it has caught up with our log
+func (server *Server) TransferLeadership(target string) error {
+	server.lock <- true
+	leading := server.isLeader()
+	node, found := server.nodes[target]
+	<-server.lock
+
+	if !leading {
+		return errors.New("only the leader can transfer leadership")
+	}
+	if !found {
+		return fmt.Errorf("%v is not a member", target)
+	}
+	if node.witness {
+		return fmt.Errorf("%v is a witness, it can't lead", target)
+	}
+
+	deadline := server.config.Clock.After(TransferTimeout * time.Millisecond)
+	for !server.caughtUp(node) {
+		select {
+		case <-deadline:
+			return fmt.Errorf("%v did not catch up in time", target)
+		case <-server.config.Clock.After(server.config.HeartbeatTimeout):
+		}
+	}
+
+	server.lock <- true
+	if !server.isLeader() {
+		<-server.lock
+		return errors.New("lost leadership before handing it over")
+	}
+	log.Printf("Transferring leadership to %v\n", target)
+	server.stepDown("handing leadership to " + target)
+	<-server.lock
+
+	var started bool
+	return node.call("Server.TimeoutNow", 0, &started)
+}
+
+// caughtUp is whether node has every entry in our log
+func (server *Server) caughtUp(node *Node) bool {
+	server.logLock <- true
+	defer func() {
+		<-server.logLock
+	}()
+
+	return node.matchIndex >= server.lastIndex()
+}
+
+// TimeoutNow lets the leader tell us to start an election right away, as part of handing leadership to us
+func (server *Server) TimeoutNow(args int, reply *bool) error {
+	if server.removed {
+		return errors.New("this node has been removed from the cluster")
+	}
+	if server.config.Witness {
+		return errWitness
+	}
+
+	go server.startCandidacy()
+
+	*reply = true
+
+	return nil
+}
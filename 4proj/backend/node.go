@@ -2,25 +2,39 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"net/rpc"
+	"time"
+
+	"../tlsconf"
 )
 
 // Node describes the state of a member of the cluster
 type Node struct {
+	ID     string
 	Addr   string
 	client *rpc.Client
 
 	nextIndex  uint64
 	matchIndex uint64
 
-	server *Server // We need a reference here
-	lock   chan bool
+	priority int       // learned when either of us says hello
+	witness  bool      // likewise
+	lastAck  time.Time // when it last answered our AppendEntries without knowing of a newer term, under server.lock
+
+	server      *Server // We need a reference here
+	lock        chan bool
+	replicating chan bool // held while an AppendEntries is out, so a slow node doesn't pile them up
 }
 
+// errRPCTimeout is what a peer call gives back when the peer took too long to answer
+var errRPCTimeout = errors.New("peer took too long to answer")
+
 // CreateNode is a consstructor for node
-func CreateNode(server *Server, addr string) *Node {
+func CreateNode(server *Server, id string, addr string) *Node {
 	return &Node{
+		ID:   id,
 		Addr: addr,
 
 		client: nil,
@@ -29,7 +43,8 @@ func CreateNode(server *Server, addr string) *Node {
 		nextIndex:  1,
 		matchIndex: 0,
 
-		lock: make(chan bool, 1),
+		lock:        make(chan bool, 1),
+		replicating: make(chan bool, 1),
 	}
 }
 
@@ -44,12 +59,34 @@ func (node *Node) Connect() error {
 		return nil
 	}
 
-	client, err := rpc.DialHTTP("tcp", node.Addr)
+	timeout := node.server.rpcTimeout()
+	client, err := tlsconf.DialRPCTimeout(node.Addr, node.ID, node.server.rpcPath(), node.server.tls, timeout)
+	if err != nil {
+		return err
+	}
+
+	var hello HelloReply
+	err = node.server.callTimeout(client, "Server.Hello", &HelloArgs{
+		Node:     node.server.Self,
+		Version:  ProtocolVersion,
+		Priority: node.server.config.Priority,
+		Witness:  node.server.config.Witness,
+	}, &hello)
+	if err == nil && !compatibleVersion(hello.Version) {
+		err = incompatibleVersion(hello.Version)
+	}
+	if err == nil && hello.Node != "" && hello.Node != node.ID { // peers from before node IDs don't say
+		err = fmt.Errorf("expected node %v at %v but found %v", node.ID, node.Addr, hello.Node)
+	}
 	if err != nil {
+		log.Printf("Not replicating with %v: %v\n", node.ID, err)
+		client.Close()
 		return err
 	}
 
 	node.client = client
+	node.priority = hello.Priority
+	node.witness = hello.Witness
 
 	return nil
 }
@@ -69,60 +106,81 @@ func (node *Node) Close() {
 	node.client = nil
 }
 
-// RequestVote will send a request to this node for a vote for this term
-func (node *Node) RequestVote(votes chan bool) error {
-	err := node.Connect()
-	if err != nil {
-		log.Printf("Node %v is dead, no votes granted\n", node.Addr)
-		votes <- false
-		return err
-	}
-
-	lastLog := node.server.log[len(node.server.log)-1]
+// rpcTimeout is how long we wait on a peer. Past an election timeout the cluster has moved on without the answer
+func (server *Server) rpcTimeout() time.Duration {
+	return server.config.ElectionMaxTimeout
+}
 
-	args := &RequestVoteArgs{
-		Candidate: node.server.Self,
-		Term:      node.server.Term,
+// callTimeout makes an RPC on client, giving up after rpcTimeout. A call we gave up on may still finish later,
+// so reply mustn't be used unless this succeeds
+func (server *Server) callTimeout(client *rpc.Client, method string, args interface{}, reply interface{}) error {
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
 
-		LastLogIndex: lastLog.Index,
-		LastLogTerm:  lastLog.Term,
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-server.config.Clock.After(server.rpcTimeout()):
+		return errRPCTimeout
 	}
+}
 
-	log.Printf("Requested votes from %v as candidate %v for term %v\n", node.Addr, args.Candidate, args.Term)
+// call makes an RPC on this node, connecting first if we have to. The connection is dropped if it broke or the
+// node took too long, so the next call starts over with a fresh one
+func (node *Node) call(method string, args interface{}, reply interface{}) error {
+	err := node.Connect()
+	if err != nil {
+		return err
+	}
 
 	node.lock <- true
-	defer func() {
-		<-node.lock
-	}()
+	client := node.client
+	<-node.lock
 
-	if node.client == nil {
+	if client == nil {
 		return errors.New("Client died mid connection")
 	}
 
-	var reply RequestVoteReply
-	err = node.client.Call("Server.RequestVote", args, &reply)
-
-	if err != nil {
-		log.Printf("RequestVote error %v\n", err)
-		votes <- false
-		<-node.lock
-		node.Close()
+	err = node.server.callTimeout(client, method, args, reply)
+	if _, ok := err.(rpc.ServerError); err != nil && !ok {
 		node.lock <- true
-		return err
+		if node.client == client {
+			node.client.Close()
+			node.client = nil
+		}
+		<-node.lock
 	}
 
-	votes <- reply.VoteGranted
-
-	return nil
+	return err
 }
 
-// AppendEntries is a goroutine for the client to synchronize the target node's log
-func (node *Node) AppendEntries() {
-	err := node.Connect()
+// RequestVote asks this node for its vote in an election, sending its reply on votes. A node we couldn't reach
+// didn't grant it, and its zero term is older than any we'd be in
+func (node *Node) RequestVote(args RequestVoteArgs, votes chan RequestVoteReply) {
+	log.Printf("Requested votes from %v as candidate %v for term %v\n", node.ID, args.Candidate, args.Term)
+
+	var reply RequestVoteReply
+	err := node.call("Server.RequestVote", &args, &reply)
 	if err != nil {
+		log.Printf("RequestVote to %v failed, no vote granted: %v\n", node.ID, err)
+		votes <- RequestVoteReply{}
 		return
 	}
 
+	votes <- reply
+}
+
+// AppendEntries is a goroutine for the client to synchronize the target node's log. It only goes out while we
+// still lead term, a leader that stepped down mustn't replicate as if it had won the newer term too
+func (node *Node) AppendEntries(term uint64) {
+	select {
+	case node.replicating <- true:
+	default:
+		return // the last one hasn't been answered yet
+	}
+	defer func() {
+		<-node.replicating
+	}()
+
 	defer func() {
 		if r := recover(); r != nil {
 			log.Printf("Panicked with node %v\n", node)
@@ -130,61 +188,97 @@ func (node *Node) AppendEntries() {
 		}
 	}()
 
-	entries := []Entry{}
-	if len(node.server.log) > 0 {
-		for _, entry := range node.server.log[node.nextIndex:] {
-			entries = append(entries, *entry)
-		}
-	}
-
-	args := &AppendEntriesArgs{
-		Term:         node.server.Term,
-		Leader:       node.server.Self,
-		Entries:      entries,
-		PrevLogIndex: 0,
-		PrevLogTerm:  node.server.Term,
-		LeaderCommit: node.server.commitIndex,
-	}
-
-	if node.nextIndex != 0 {
-		args.PrevLogIndex = node.nextIndex - 1
-		args.PrevLogTerm = node.server.log[node.nextIndex-1].Term
+	args, compacted := node.appendEntriesArgs(term)
+	if compacted {
+		node.sendSnapshot(term)
+		return
 	}
-
-	node.lock <- true
-	defer func() {
-		<-node.lock
-	}()
-
-	if node.client == nil {
+	if args == nil {
 		return
 	}
+	entries := args.Entries
 
 	var reply AppendEntriesReply
-	err = node.client.Call("Server.AppendEntries", args, &reply)
+	err := node.call("Server.AppendEntries", args, &reply)
 	if err != nil {
-		<-node.lock
-		node.Close()
-		node.lock <- true
 		return
 	}
 
+	node.server.lock <- true
+	if reply.Term <= args.Term {
+		node.lastAck = node.server.config.Clock.Now()
+	}
+	<-node.server.lock
+
 	if reply.Success == false {
 		node.server.lock <- true
 		if reply.Term > node.server.Term {
-			node.server.Term = reply.Term
+			node.server.newTerm(reply.Term, node.ID+" is on a newer term")
+			node.server.saveState()
 		}
 		<-node.server.lock
 
-		if node.nextIndex > 0 {
+		if reply.Term > args.Term {
+			return
+		}
+		if reply.LastIndex+1 < node.nextIndex {
+			node.nextIndex = reply.LastIndex + 1
+		} else if node.nextIndex > 0 {
 			node.nextIndex--
 		}
 		return
 	}
 
-	if len(entries) != 0 {
-		top := entries[len(entries)-1]
-		node.nextIndex = top.Index + 1
-		node.matchIndex = top.Index
+	node.matchIndex = args.PrevLogIndex + uint64(len(entries)) // heartbeats tell us a follower is caught up too
+	node.nextIndex = node.matchIndex + 1
+}
+
+// appendEntriesArgs builds what we send node next, or nil if we no longer lead term. It says so instead if
+// the entries node needs have been compacted away, and it has to be sent a snapshot
+func (node *Node) appendEntriesArgs(term uint64) (*AppendEntriesArgs, bool) {
+	server := node.server
+
+	server.lock <- true
+	defer func() {
+		<-server.lock
+	}()
+	if server.Term != term || !server.isLeader() {
+		return nil, false
+	}
+
+	server.logLock <- true
+	defer func() {
+		<-server.logLock
+	}()
+
+	if server.logBase() > 0 && node.nextIndex <= server.logBase() {
+		return nil, true
+	}
+
+	entries := []Entry{}
+	for _, entry := range server.entriesFrom(node.nextIndex) {
+		if node.witness {
+			stripped := *entry
+			stripped.Command = entry.Command.metadataOnly()
+			entry = &stripped
+		}
+		entries = append(entries, *entry)
+	}
+
+	args := &AppendEntriesArgs{
+		Version:      ProtocolVersion,
+		Term:         term,
+		Leader:       server.Self,
+		Entries:      entries,
+		PrevLogIndex: 0,
+		PrevLogTerm:  term,
+		LeaderCommit: server.commitIndex,
 	}
+
+	if node.nextIndex != 0 {
+		args.PrevLogIndex = node.nextIndex - 1
+		args.PrevLogTerm = server.entry(node.nextIndex - 1).Term
+	}
+
+	return args, false
 }
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// persistentState is the part of raft's state that has to survive a restart besides the log
+type persistentState struct {
+	Term     uint64
+	VotedFor string
+}
+
+// Open loads this server's term, vote and log from dir. Everything up to applied is already in the state machine
+func (server *Server) Open(dir string, applied uint64) error {
+	server.dataDir = dir
+
+	err := server.loadNodeID()
+	if err != nil {
+		return err
+	}
+
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "raft.state"))
+	if err == nil {
+		var state persistentState
+		err = json.Unmarshal(raw, &state)
+		if err != nil {
+			return err
+		}
+		server.Term = state.Term
+		server.votedFor = state.VotedFor
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, "raft.log"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	server.logFile = file
+
+	err = server.loadLog()
+	if err != nil {
+		return err
+	}
+	server.rebuildMembership()
+
+	last := server.lastIndex()
+	if applied > last {
+		return fmt.Errorf("store has applied up to %v but the raft log only goes to %v", applied, last)
+	}
+	if applied < server.logBase() && !server.config.Witness {
+		return fmt.Errorf("store has applied up to %v but the raft log was compacted up to %v", applied, server.logBase())
+	}
+	if applied < server.logBase() {
+		applied = server.logBase() // a witness applies nothing, everything up to the base committed long ago
+	}
+
+	server.lastApplied = applied
+	server.commitIndex = applied
+
+	log.Printf("Loaded term %v and log entries %v to %v as node %v\n", server.Term, server.logBase(), last, server.Self)
+
+	return nil
+}
+
+// loadNodeID works out which node this data directory belongs to, remembering it the first time. Without an ID
+// of its own, a new node goes by its listen address like nodes did before they had IDs
+func (server *Server) loadNodeID() error {
+	path := filepath.Join(server.dataDir, "node-id")
+
+	raw, err := ioutil.ReadFile(path)
+	if err == nil {
+		id := strings.TrimSpace(string(raw))
+		if server.Self != "" && server.Self != id {
+			return fmt.Errorf("%v belongs to node %v, not %v", server.dataDir, id, server.Self)
+		}
+		server.Self = id
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	if server.Self == "" {
+		server.Self = server.Addr
+	}
+
+	return ioutil.WriteFile(path, []byte(server.Self+"\n"), 0644)
+}
+
+// errTornEntry means the end of the log was only partly written, usually because we crashed mid write
+var errTornEntry = errors.New("log entry checksum mismatch")
+
+// readLogEntry reads a single length and checksum framed entry
+func readLogEntry(r io.Reader) (*Entry, int64, error) {
+	header := make([]byte, 8)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	body := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, errTornEntry
+	}
+
+	var entry Entry
+	err = json.Unmarshal(body, &entry)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not decode log entry: %v", err)
+	}
+
+	return &entry, int64(len(header) + len(body)), nil
+}
+
+// encodeLogEntry frames an entry for the log file. Entries are JSON so the file can be read by any build
+func encodeLogEntry(entry *Entry) ([]byte, error) {
+	body, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	frame := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(body))
+
+	return append(frame, body...), nil
+}
+
+// loadLog reads the log file back into memory, dropping a torn entry at the end. A compacted log starts with the
+// entry standing in for everything up to its base
+func (server *Server) loadLog() error {
+	reader := bufio.NewReader(server.logFile)
+
+	var offset int64
+	for {
+		entry, size, err := readLogEntry(reader)
+		if err == io.EOF {
+			break
+		}
+		if err == nil && offset == 0 && entry.Command.Action == logBaseAction {
+			server.log = []*Entry{entry}
+			offset += size
+			continue
+		}
+		if err == nil && entry.Index != server.lastIndex()+1 {
+			return fmt.Errorf("raft log is out of order, expected index %v but found %v", server.lastIndex()+1, entry.Index)
+		}
+		if err != nil && err != errTornEntry && err != io.ErrUnexpectedEOF {
+			return err // don't throw away entries just because we can't read them
+		}
+		if err != nil {
+			log.Printf("Bad raft log entry at offset %v (%v), truncating\n", offset, err)
+			err = server.logFile.Truncate(offset)
+			if err != nil {
+				return err
+			}
+			break
+		}
+
+		server.log = append(server.log, entry)
+		server.logOffsets = append(server.logOffsets, offset)
+		offset += size
+	}
+
+	server.logSize = offset
+	_, err := server.logFile.Seek(offset, io.SeekStart)
+	return err
+}
+
+// storeEntry appends an entry to the log in memory and on disk
+func (server *Server) storeEntry(entry *Entry) {
+	server.log = append(server.log, entry)
+
+	if isMembershipChange(entry.Command.Action) {
+		server.applyMembership(entry.Command)
+	}
+
+	if server.logFile == nil {
+		return
+	}
+
+	frame, err := encodeLogEntry(entry)
+	if err == nil {
+		_, err = server.logFile.Write(frame)
+	}
+	if err == nil {
+		err = server.logFile.Sync()
+	}
+	if err != nil {
+		log.Fatalf("Could not persist log entry %v: %v\n", entry.Index, err)
+	}
+
+	server.logOffsets = append(server.logOffsets, server.logSize)
+	server.logSize += int64(len(frame))
+}
+
+// truncateLog drops every entry from index onwards, in memory and on disk. index is always past the base, which
+// has committed
+func (server *Server) truncateLog(index uint64) {
+	at := index - server.logBase()
+	dropped := server.log[at:]
+	server.log = server.log[:at]
+
+	for _, entry := range dropped {
+		entry.drop()
+	}
+	for _, entry := range dropped {
+		if isMembershipChange(entry.Command.Action) {
+			server.rebuildMembership() // a membership change we acted on never committed
+			break
+		}
+	}
+
+	if server.logFile == nil {
+		return
+	}
+
+	server.logSize = server.logOffsets[at]
+	server.logOffsets = server.logOffsets[:at]
+
+	err := server.logFile.Truncate(server.logSize)
+	if err == nil {
+		_, err = server.logFile.Seek(server.logSize, io.SeekStart)
+	}
+	if err != nil {
+		log.Fatalf("Could not truncate log at %v: %v\n", index, err)
+	}
+}
+
+// saveState persists the current term and vote, it should be called before answering anyone with them
+func (server *Server) saveState() {
+	if server.dataDir == "" {
+		return
+	}
+
+	raw, _ := json.Marshal(persistentState{
+		Term:     server.Term,
+		VotedFor: server.votedFor,
+	})
+
+	path := filepath.Join(server.dataDir, "raft.state")
+	err := ioutil.WriteFile(path+".tmp", raw, 0644)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		log.Fatalf("Could not persist raft state: %v\n", err)
+	}
+}
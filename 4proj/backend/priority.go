@@ -0,0 +1,56 @@
+package main
+
+import "log"
+
+// priorityGap is how many priority levels the highest peer we know of is above us. Every level waits out one more
+// spread of election timeouts, so a higher priority node always times out first but we still step in if it's gone
+func (server *Server) priorityGap() int {
+	gap := 0
+	for _, node := range server.peers() {
+		if node.priority-server.config.Priority > gap {
+			gap = node.priority - server.config.Priority
+		}
+	}
+	return gap
+}
+
+// preferLeader hands leadership to the highest priority node above us once it's connected and caught up with
+// our log. It's checked every heartbeat, and only one handoff is started per term we lead
+func (server *Server) preferLeader() {
+	server.lock <- true
+	defer func() {
+		<-server.lock
+	}()
+	if server.handingOff {
+		return
+	}
+
+	server.logLock <- true
+	last := server.lastIndex()
+	<-server.logLock
+
+	var best *Node
+	for _, node := range server.peersLocked() {
+		if node.witness || node.priority <= server.config.Priority || node.client == nil || node.matchIndex < last {
+			continue
+		}
+		if best == nil || node.priority > best.priority {
+			best = node
+		}
+	}
+
+	if best == nil {
+		return
+	}
+
+	server.handingOff = true
+	log.Printf("%v has priority %v over our %v and is caught up, handing leadership to it\n", best.ID, best.priority,
+		server.config.Priority)
+
+	go func() {
+		err := server.TransferLeadership(best.ID)
+		if err != nil {
+			log.Printf("Could not hand leadership to %v: %v\n", best.ID, err)
+		}
+	}()
+}
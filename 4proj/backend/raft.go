@@ -1,8 +1,13 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"math/rand"
+	"os"
 	"strings"
 	"time"
 )
@@ -14,13 +19,15 @@ type Entry struct {
 	Command Command
 
 	done  chan bool
+	lost  chan bool // closed when the leader that appended this stops leading
 	reply interface{}
 	error error
 }
 
 // Server describes the entire backend
 type Server struct {
-	Self string
+	Self string // our node ID, which is how the rest of the cluster knows us
+	Addr string // where we listen
 
 	nodes  map[string]*Node
 	Term   uint64
@@ -30,27 +37,52 @@ type Server struct {
 
 	State string
 
+	initialPeers map[string]string // node ID to address, from the command line
+	joining      bool
+	removed      bool
+	handingOff   bool
+
 	votedFor string
 	votes    uint64
 
+	leading chan bool // closed once we stop leading, so waiters on our entries give up
+
 	commitIndex uint64
 	lastApplied uint64
 
+	leaderCommit uint64    // the leader's commit index as of its last AppendEntries
+	lastContact  time.Time // when we last heard from the leader, by our clock
+
 	log []*Entry
 
 	logLock chan bool
 
-	lock        chan bool
-	heartbeat   chan bool
-	stopLeading chan bool
+	tls *tls.Config
+
+	tracer *Tracer // nil unless tracing
+
+	config RaftConfig
+	random *rand.Rand
+
+	dataDir    string
+	logFile    *os.File
+	logOffsets []int64
+	logSize    int64
 
-	commit func(Command) (interface{}, error)
+	lock      chan bool
+	heartbeat chan bool
+
+	commit func(uint64, Command) (interface{}, error)
+
+	snapshot func(io.Writer) (uint64, error) // writes a backup of the state machine, giving back its applied index
+	restore  func(path string) error         // replaces the state machine with a snapshot from the leader
 }
 
-// CreateServer initializes a server
-func CreateServer(listen string, backends string, commit func(Command) (interface{}, error)) *Server {
+// CreateServer initializes a server. id can be empty, Open then works it out
+func CreateServer(id string, listen string, backends string, commit func(uint64, Command) (interface{}, error)) *Server {
 	server := &Server{
-		Self:      listen,
+		Self:      id,
+		Addr:      listen,
 		Term:      0,
 		Leader:    "",
 		nodes:     map[string]*Node{},
@@ -64,14 +96,17 @@ func CreateServer(listen string, backends string, commit func(Command) (interfac
 		commitIndex: 0,
 		lastApplied: 0,
 
-		log:         []*Entry{&Entry{Index: 0, Term: 0, Command: Command{}}},
-		logLock:     make(chan bool, 1),
-		stopLeading: make(chan bool, 1),
+		log:        []*Entry{&Entry{Index: 0, Term: 0, Command: Command{}}},
+		logLock:    make(chan bool, 1),
+		logOffsets: []int64{0},
+
+		initialPeers: map[string]string{},
 
 		commit: commit,
 	}
 
 	server.parseBackends(backends)
+	server.Configure(DefaultRaftConfig())
 
 	return server
 }
@@ -80,22 +115,64 @@ func (server *Server) isLeader() bool {
 	return server.Leader == server.Self
 }
 
+// peers copies out our peers, membership changes swap server.nodes under the lock while others range over them
+func (server *Server) peers() []*Node {
+	server.lock <- true
+	defer func() {
+		<-server.lock
+	}()
+	return server.peersLocked()
+}
+
+// peersLocked is peers for callers already holding the lock
+func (server *Server) peersLocked() []*Node {
+	nodes := []*Node{}
+	for _, node := range server.nodes {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
 func (server *Server) getLeader() *Node {
 	return server.nodes[server.Leader]
 }
 
+// leaderAddr is where the leader can be reached, as far as we know
+func (server *Server) leaderAddr() string {
+	if server.isLeader() {
+		return server.Addr
+	}
+
+	if node := server.getLeader(); node != nil {
+		return node.Addr
+	}
+
+	return ""
+}
+
+// parsePeer splits an id=addr peer. A bare address is its own ID, the way nodes were known before they had IDs
+func parsePeer(peer string) (string, string) {
+	parts := strings.SplitN(peer, "=", 2)
+	if len(parts) == 1 {
+		return peer, peer
+	}
+	return parts[0], parts[1]
+}
+
 func (server *Server) parseBackends(backends string) {
-	for _, addr := range strings.FieldsFunc(backends, func(c rune) bool {
+	for _, peer := range strings.FieldsFunc(backends, func(c rune) bool {
 		return c == ','
 	}) {
-		server.nodes[addr] = CreateNode(server, addr)
+		id, addr := parsePeer(peer)
+		server.initialPeers[id] = addr
+		server.nodes[id] = CreateNode(server, id, addr)
 	}
 }
 
 // Timeouts keeps track of the election timeout
 func (server *Server) timeouts() {
 	for {
-		timeout := rand.Intn(ElectionMaxTimeout-ElectionMinTimeout) + ElectionMinTimeout
+		timeout := server.electionTimeout()
 
 		go server.applyLogs()
 
@@ -106,103 +183,199 @@ func (server *Server) timeouts() {
 				server.Ready = true
 				<-server.lock
 			}
-		case <-time.After(time.Duration(timeout) * time.Millisecond):
+		case <-server.config.Clock.After(timeout):
+			if server.joining || server.removed {
+				continue // we aren't part of the cluster, so we don't get a say in who leads it
+			}
+			if server.config.Witness {
+				continue // we only vote
+			}
+			if server.isLeader() {
+				continue // our own heartbeats are late, that's no reason to start over
+			}
 			log.Println("Heartbeat timeout passed, election starting")
 			go server.startCandidacy()
 		}
 	}
 }
 
+// startCandidacy runs an election for the next term. Votes are collected without holding the lock, so we can
+// still answer other candidates and leaders while waiting on slow or unreachable peers
 func (server *Server) startCandidacy() {
-	if server.State == "candidate" {
-		log.Println("Am a candidate, continuing")
+	if server.config.Witness {
 		return
 	}
 
 	server.lock <- true
-	defer func() {
+
+	if server.State == "candidate" || server.State == "leader" {
 		<-server.lock
-	}()
+		log.Printf("Am a %v, continuing\n", server.State)
+		return
+	}
 
 	log.Println("Starting Candidacy")
-	server.Term++
+	server.setTerm(server.Term+1, "starting an election")
 	server.votes = 1
 	server.votedFor = server.Self
-	server.State = "candidate"
+	server.setState("candidate", "starting an election")
+	server.saveState()
 
-	votes := make(chan bool, len(server.nodes))
+	lastLog := server.log[len(server.log)-1]
+	args := RequestVoteArgs{
+		Version:   ProtocolVersion,
+		Candidate: server.Self,
+		Term:      server.Term,
 
-	for _, node := range server.nodes {
-		go node.RequestVote(votes)
+		LastLogIndex: lastLog.Index,
+		LastLogTerm:  lastLog.Term,
+	}
+
+	nodes := server.peersLocked()
+
+	<-server.lock
+
+	votes := make(chan RequestVoteReply, len(nodes))
+	for _, node := range nodes {
+		go node.RequestVote(args, votes)
 	}
 
-	for range server.nodes {
-		vote := <-votes
-		if vote {
-			server.votes++
+	granted := uint64(1)
+	newest := args.Term
+	for range nodes {
+		reply := <-votes
+		if reply.VoteGranted {
+			granted++
+		}
+		if reply.Term > newest {
+			newest = reply.Term
 		}
 	}
 
-	close(votes)
+	server.lock <- true
+	defer func() {
+		<-server.lock
+	}()
+
+	if newest > server.Term {
+		server.newTerm(newest, "a voter is on a newer term")
+		server.saveState()
+		return
+	}
+	if server.State != "candidate" || server.Term != args.Term {
+		// Someone else's term or leader got to us while we were waiting, and they've already moved us on
+		log.Printf("Election for term %v was overtaken, now %v in term %v\n", args.Term, server.State, server.Term)
+		return
+	}
 
+	server.votes = granted
 	log.Printf("Acquired %v votes\n", server.votes)
 
 	if server.votes > uint64(len(server.nodes))/2 {
-		server.State = "leader"
+		server.setState("leader", fmt.Sprintf("won %v of %v votes", server.votes, len(server.nodes)+1))
 		server.Leader = server.Self
+		for _, node := range server.nodes {
+			node.nextIndex = server.lastIndex() + 1
+			node.matchIndex = 0
+		}
+		server.logLock <- true
+		server.appendEntryLocked(NewCommand(startTermAction, nil))
+		<-server.logLock
 		go server.Lead()
 		return
 	}
 
-	server.State = "follower"
+	server.setState("follower", fmt.Sprintf("lost with %v of %v votes", server.votes, len(server.nodes)+1))
 }
 
-func (server *Server) appendEntry(data Command) *Entry {
-	server.logLock <- true
-	defer func() {
-		<-server.logLock
-	}()
+// startTermAction is the entry a new leader opens its term with. Entries from earlier terms only commit along
+// with one from the leader's own term, without it they'd wait for the next write
+const startTermAction = "StartTerm"
+
+// errNotLeading is what appending gives back once we've stepped down, the entry would claim a term we didn't win
+var errNotLeading = errors.New("no longer the leader")
 
+func (server *Server) appendEntryLocked(data Command) *Entry {
 	entry := &Entry{
-		Index:   uint64(len(server.log)),
+		Index:   server.lastIndex() + 1,
 		Term:    server.Term,
 		Command: data,
 
 		done: make(chan bool, 1),
+		lost: server.leading,
 	}
 
-	server.log = append(server.log, entry)
+	server.storeEntry(entry)
+	server.trace(TraceEvent{Event: traceAppend, From: entry.Index, Index: entry.Index, Action: data.Action})
 
 	return entry
 }
 
+// newTerm moves us to a newer term we've heard of, with no vote cast in it yet. A leader or candidate from an
+// older term steps down, it's the lock holder's job to save the state
+func (server *Server) newTerm(term uint64, reason string) {
+	server.setTerm(term, reason)
+	server.votedFor = ""
+
+	if server.isLeader() {
+		server.stepDown(reason)
+	}
+	if server.State == "candidate" {
+		server.setState("follower", reason)
+	}
+}
+
+// stepDown stops us leading, it's the lock holder's job. Our Lead sees this on its next heartbeat and stops
+func (server *Server) stepDown(reason string) {
+	log.Printf("No longer leader, %v\n", reason)
+	server.Leader = ""
+	server.setState("follower", reason)
+}
+
 // Lead is for the server that will start leadering
 func (server *Server) Lead() {
-	log.Printf("Attempting to lead term %v\n", server.Term)
-
 	server.lock <- true
+	term := server.Term
 	server.Ready = true // I am the leader so I am always ready
+	server.handingOff = false
 	<-server.lock
 
-	for {
-		select {
-		case <-server.stopLeading:
-			log.Println("Stopping leading!")
-			server.lock <- true
-			defer func() {
-				<-server.lock
-			}()
-			server.State = "follower"
-			return
-		case <-time.After(HeartbeatTimeout * time.Millisecond):
-			for _, node := range server.nodes {
-				go node.AppendEntries()
-			}
+	log.Printf("Attempting to lead term %v\n", term)
+	server.sendHeartbeats(term) // followers who voted for us are waiting on these to stay put
 
-			go server.commitMajority()
+	for {
+		<-server.config.Clock.After(server.config.HeartbeatTimeout)
 
-			server.heartbeat <- true
+		server.lock <- true
+		leading := server.isLeader() && server.State == "leader" && server.Term == term
+		<-server.lock
+		if !leading {
+			log.Printf("No longer leading term %v\n", term)
+			return // we stepped down, or we're leading a later term from another Lead
 		}
+
+		server.sendHeartbeats(term)
+	}
+}
+
+// sendHeartbeats replicates to every peer, which doubles as telling them we're still leading term
+func (server *Server) sendHeartbeats(term uint64) {
+	for _, node := range server.peers() {
+		go node.AppendEntries(term)
+	}
+
+	go server.commitMajority()
+
+	server.preferLeader()
+
+	server.resetElectionTimer()
+}
+
+// resetElectionTimer puts off our next election. It never blocks, a reset that's already pending is as good
+func (server *Server) resetElectionTimer() {
+	select {
+	case server.heartbeat <- true:
+	default:
 	}
 }
 
@@ -220,15 +393,18 @@ func (server *Server) applyLogs() {
 		<-server.logLock
 	}()
 
-	if server.lastApplied < server.commitIndex {
-		server.apply(server.log[server.lastApplied+1])
+	for server.lastApplied < server.commitIndex && server.lastApplied < server.lastIndex() {
+		server.apply(server.entry(server.lastApplied + 1))
 		server.lastApplied++
 	}
+
+	server.maybeCompactLog()
 }
 
 func (server *Server) apply(entry *Entry) {
 	log.Println("Applying entry!")
-	reply, err := server.commit(entry.Command)
+	reply, err := server.commit(entry.Index, entry.Command)
+	server.trace(TraceEvent{Event: traceApply, Index: entry.Index, Action: entry.Command.Action})
 	if err != nil {
 		entry.error = err
 		log.Println(err)
@@ -244,31 +420,125 @@ func (server *Server) apply(entry *Entry) {
 	}
 }
 
+// drop fails anyone waiting on an entry that's being cut from the log before we applied it, logLock must be held
+func (entry *Entry) drop() {
+	if entry.done != nil {
+		entry.error = errNotLeading
+		close(entry.done)
+	}
+}
+
+// awaitEntry waits for an entry we appended as leader to be applied. We can't know whether it will ever commit
+// once we've stopped leading or it's been dropped, so then it gives back errNotLeading, and an error after ProposeTimeout
+func (server *Server) awaitEntry(entry *Entry) (interface{}, error) {
+	select {
+	case <-entry.done:
+		return entry.reply, entry.error
+	case <-entry.lost:
+	case <-server.config.Clock.After(ProposeTimeout * time.Millisecond):
+		return nil, fmt.Errorf("entry %v was not applied within %vms", entry.Index, ProposeTimeout)
+	}
+
+	select {
+	case <-entry.done: // it was applied just before we stepped down
+		return entry.reply, entry.error
+	default:
+		return nil, errNotLeading
+	}
+}
+
 // commitMajority will attempt to figure out an appropriate commitIndex
 func (server *Server) commitMajority() {
 	// calculate an N such that N > commitIndex, a majority of matchIndex[i] ≥ N, and log[N].term == currentTerm
 
-	if uint64(len(server.log)-1) == server.commitIndex {
+	server.lock <- true
+	defer func() {
+		<-server.lock
+	}()
+
+	server.logLock <- true
+	defer func() {
+		<-server.logLock
+	}()
+
+	if server.lastIndex() == server.commitIndex {
 		return
 	}
 
-	for n := server.commitIndex + 1; n < uint64(len(server.log)); n++ {
-		count := 0
+	members := len(server.nodes)
+	if !server.removed {
+		members++ // we count too, unless we are on our way out
+	}
+
+	for n := server.commitIndex + 1; n <= server.lastIndex(); n++ {
+		count := members - len(server.nodes)
 		for _, node := range server.nodes {
 			if node.matchIndex >= n {
 				count++
 			}
 		}
-		if count > len(server.nodes)/2 && server.log[n].Term == server.Term {
-			server.commitIndex = n
-		} else {
+		if count <= members/2 {
 			break
 		}
+		if server.entry(n).Term == server.Term {
+			server.setCommitIndex(n) // earlier terms' entries only commit along with one from our own term
+		}
 	}
 }
 
+// HelloArgs introduces a peer by ID along with the protocol version it speaks, its election priority and
+// whether it's a witness
+type HelloArgs struct {
+	Node     string
+	Version  uint32
+	Priority int
+	Witness  bool
+}
+
+// HelloReply answers with our own ID, protocol version, election priority and whether we're a witness
+type HelloReply struct {
+	Node     string
+	Version  uint32
+	Priority int
+	Witness  bool
+}
+
+func compatibleVersion(version uint32) bool {
+	return version >= MinProtocolVersion && version <= ProtocolVersion
+}
+
+func incompatibleVersion(version uint32) error {
+	return fmt.Errorf("incompatible protocol version %v, this node speaks %v to %v",
+		version, MinProtocolVersion, ProtocolVersion)
+}
+
+// Hello lets peers check they speak a compatible protocol before they replicate anything
+func (server *Server) Hello(args *HelloArgs, reply *HelloReply) error {
+	reply.Node = server.Self
+	reply.Version = ProtocolVersion
+	reply.Priority = server.config.Priority
+	reply.Witness = server.config.Witness
+
+	if !compatibleVersion(args.Version) {
+		log.Printf("Refusing %v, it speaks protocol version %v\n", args.Node, args.Version)
+		return incompatibleVersion(args.Version)
+	}
+
+	server.lock <- true
+	node, found := server.nodes[args.Node]
+	<-server.lock
+	if found {
+		node.priority = args.Priority
+		node.witness = args.Witness
+	}
+
+	return nil
+}
+
 // AppendEntriesArgs contains heartbeat and log update information
 type AppendEntriesArgs struct {
+	Version uint32
+
 	Term         uint64
 	Leader       string
 	PrevLogIndex uint64
@@ -281,15 +551,27 @@ type AppendEntriesArgs struct {
 type AppendEntriesReply struct {
 	Term    uint64
 	Success bool
+
+	LastIndex uint64 // the end of the follower's log, so a leader can skip past what it's missing
 }
 
 // AppendEntries is both heartbeat and update in a single RPC
 func (server *Server) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	if !compatibleVersion(args.Version) {
+		return incompatibleVersion(args.Version)
+	}
+
 	server.lock <- true
 	defer func() {
 		<-server.lock
 	}()
 
+	// applyLogs reads the log under logLock, so we can't change it from under it
+	server.logLock <- true
+	defer func() {
+		<-server.logLock
+	}()
+
 	reply.Term = server.Term
 
 	if args.Term < server.Term {
@@ -299,40 +581,44 @@ func (server *Server) AppendEntries(args *AppendEntriesArgs, reply *AppendEntrie
 	}
 
 	if args.Term > server.Term {
-		if server.Leader == server.Self {
-			log.Println("No longer leader")
-			server.stopLeading <- true
-		}
+		server.newTerm(args.Term, "heard from leader "+args.Leader)
+		server.saveState()
+	}
 
-		server.Term = args.Term
-		server.Leader = args.Leader
-		server.votedFor = ""
-		log.Printf("Changing leader to %v\n", args.Leader)
+	if server.State == "candidate" {
+		server.setState("follower", "heard from leader "+args.Leader) // it won the election we're in
 	}
 
-	if args.Term == server.Term && server.Leader != args.Leader {
+	if server.Leader != args.Leader {
 		if server.State == "leader" {
 			log.Println("Competing leader in the group!")
-			go server.startCandidacy()
+			reply.Success = false // only one of us can have won this term, don't take its entries
+			return nil
 		} else {
 			server.Leader = args.Leader
 			log.Printf("Changing leader to %v\n", args.Leader)
 		}
 	}
 
-	if args.PrevLogIndex > uint64(len(server.log)) {
+	server.leaderCommit = args.LeaderCommit
+	server.lastContact = server.config.Clock.Now()
+	server.resetElectionTimer() // even if our log doesn't line up yet, the leader is alive
+	reply.LastIndex = server.lastIndex()
+
+	if args.PrevLogIndex > server.lastIndex() {
 		log.Println("They are starting way after we are")
 		reply.Success = false
 		return nil
 	}
 
-	if args.PrevLogIndex >= uint64(len(server.log)) {
-		reply.Success = false
-		return nil
+	if args.PrevLogIndex < server.logBase() {
+		// Everything up to our base is committed, so it matches whatever the leader has. Skip what we've dropped
+		args.Entries, args.PrevLogIndex = skipEntries(args.Entries, server.logBase()), server.logBase()
+		args.PrevLogTerm = server.entry(server.logBase()).Term
 	}
 
 	if args.PrevLogIndex != 0 {
-		entry := server.log[args.PrevLogIndex]
+		entry := server.entry(args.PrevLogIndex)
 		if entry.Term != args.PrevLogTerm {
 			log.Println("Log history does not match, go back more")
 			reply.Success = false
@@ -341,12 +627,16 @@ func (server *Server) AppendEntries(args *AppendEntriesArgs, reply *AppendEntrie
 	}
 
 	reply.Success = true
-	server.heartbeat <- true
 
 	if len(args.Entries) == 0 {
-		if args.LeaderCommit > server.commitIndex {
-			server.commitIndex = args.LeaderCommit
-		} // We move the commit index back to the leader (in case)
+		// Anything after PrevLogIndex may be left over from an old leader, so it can't be committed yet
+		commit := args.LeaderCommit
+		if commit > args.PrevLogIndex {
+			commit = args.PrevLogIndex
+		}
+		if commit > server.commitIndex {
+			server.setCommitIndex(commit)
+		}
 		return nil
 	}
 
@@ -354,24 +644,32 @@ func (server *Server) AppendEntries(args *AppendEntriesArgs, reply *AppendEntrie
 
 	log.Printf("Received entries %v\n", args.Entries)
 
-	var entry Entry
-	for _, entry := range args.Entries {
-		if entry.Index >= uint64(len(server.log)) {
-			server.log = append(server.log, &entry)
-		} else {
-			existing := server.log[entry.Index]
-			if existing.Term != entry.Term {
-				server.log = server.log[:entry.Index]
-				server.log = append(server.log, &entry)
+	var appended uint64
+	for i := range args.Entries {
+		entry := args.Entries[i]
+		if entry.Index <= server.lastIndex() {
+			if server.entry(entry.Index).Term == entry.Term {
+				continue
 			}
+			server.trace(TraceEvent{Event: traceTruncate, Index: entry.Index, Reason: "conflicts with leader " + args.Leader})
+			server.truncateLog(entry.Index)
+		}
+		server.storeEntry(&entry)
+		if appended == 0 {
+			appended = entry.Index
 		}
 	}
 
+	entry := args.Entries[len(args.Entries)-1]
+	if appended != 0 {
+		server.trace(TraceEvent{Event: traceAppend, From: appended, Index: entry.Index})
+	}
+
 	if args.LeaderCommit > server.commitIndex {
 		if args.LeaderCommit < entry.Index {
-			server.commitIndex = args.LeaderCommit
+			server.setCommitIndex(args.LeaderCommit)
 		} else {
-			server.commitIndex = entry.Index
+			server.setCommitIndex(entry.Index)
 		}
 	} // We move the commit index back to the leader (in case)
 
@@ -380,6 +678,8 @@ func (server *Server) AppendEntries(args *AppendEntriesArgs, reply *AppendEntrie
 
 // RequestVoteArgs defines the params required to request a vote from this node
 type RequestVoteArgs struct {
+	Version uint32
+
 	Candidate string
 	Term      uint64
 
@@ -393,38 +693,56 @@ type RequestVoteReply struct {
 	VoteGranted bool
 }
 
+// logUpToDate is raft's election restriction, a candidate's log has to end in a later term than ours, or be at
+// least as long in the same one. Anything less and it could be missing entries we helped commit
+func (server *Server) logUpToDate(args *RequestVoteArgs) bool {
+	last := server.log[len(server.log)-1]
+	return args.LastLogTerm > last.Term || (args.LastLogTerm == last.Term && args.LastLogIndex >= last.Index)
+}
+
 // RequestVote allows candidates to request votes
 func (server *Server) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	if !compatibleVersion(args.Version) {
+		return incompatibleVersion(args.Version)
+	}
+
 	server.lock <- true
 	defer func() {
 		<-server.lock
 	}()
 
-	reply.Term = server.Term
-
 	if args.Term < server.Term {
+		reply.Term = server.Term
 		reply.VoteGranted = false
+		server.traceVote(args.Candidate, false, fmt.Sprintf("its term %v is behind ours", args.Term))
 		return nil
 	}
 
-	if args.Term > server.Term && args.LastLogIndex >= server.lastApplied {
-		server.votedFor = args.Candidate
-		server.Term = args.Term
-		server.heartbeat <- true
-		reply.VoteGranted = true
-		return nil
+	newer := args.Term > server.Term
+	if newer {
+		server.newTerm(args.Term, args.Candidate+" asked for our vote")
+		server.saveState()
 	}
+	reply.Term = server.Term
 
-	server.Term = args.Term
-
-	if (server.votedFor == "" || server.votedFor == args.Candidate) &&
-		args.LastLogIndex >= server.lastApplied {
+	if (server.votedFor == "" || server.votedFor == args.Candidate) && server.logUpToDate(args) {
 		server.votedFor = args.Candidate
-		server.heartbeat <- true
+		server.saveState()
+		server.resetElectionTimer()
 		reply.VoteGranted = true
+		if newer {
+			server.traceVote(args.Candidate, true, "first to ask in a newer term")
+		} else {
+			server.traceVote(args.Candidate, true, "haven't voted for anyone else this term")
+		}
 		return nil
 	}
 
 	reply.VoteGranted = false
+	if !server.logUpToDate(args) {
+		server.traceVote(args.Candidate, false, fmt.Sprintf("its log ends at %v in term %v, behind ours", args.LastLogIndex, args.LastLogTerm))
+	} else {
+		server.traceVote(args.Candidate, false, "already voted for "+server.votedFor)
+	}
 	return nil
 }
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock only moves when Advance is called
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return clock.now
+}
+
+func (clock *fakeClock) After(d time.Duration) <-chan time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	clock.timers = append(clock.timers, fakeTimer{clock.now.Add(d), ch})
+	return ch
+}
+
+func (clock *fakeClock) Advance(d time.Duration) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	clock.now = clock.now.Add(d)
+	pending := clock.timers[:0]
+	for _, timer := range clock.timers {
+		if timer.at.After(clock.now) {
+			pending = append(pending, timer)
+		} else {
+			timer.ch <- clock.now
+		}
+	}
+	clock.timers = pending
+}
+
+func (clock *fakeClock) waiting() int {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return len(clock.timers)
+}
+
+func noCommit(index uint64, command Command) (interface{}, error) {
+	return nil, nil
+}
+
+func TestConfigValidate(t *testing.T) {
+	if err := DefaultRaftConfig().Validate(); err != nil {
+		t.Fatalf("default config is invalid: %v", err)
+	}
+
+	bad := []RaftConfig{
+		{HeartbeatTimeout: 0, ElectionMinTimeout: time.Second, ElectionMaxTimeout: 2 * time.Second},
+		{HeartbeatTimeout: time.Second, ElectionMinTimeout: time.Second, ElectionMaxTimeout: 2 * time.Second},
+		{HeartbeatTimeout: time.Second, ElectionMinTimeout: 2 * time.Second, ElectionMaxTimeout: 2 * time.Second},
+	}
+	for _, config := range bad {
+		if config.Validate() == nil {
+			t.Errorf("expected %+v to be invalid", config)
+		}
+		if CreateServer("a", ":0", "", noCommit).Configure(config) == nil {
+			t.Errorf("expected Configure to refuse %+v", config)
+		}
+	}
+}
+
+func TestElectionTimeoutsFollowSeed(t *testing.T) {
+	config := DefaultRaftConfig()
+	config.Seed = 41
+
+	first := CreateServer("a", ":0", "", noCommit)
+	second := CreateServer("a", ":0", "", noCommit)
+	first.Configure(config)
+	second.Configure(config)
+
+	for i := 0; i < 100; i++ {
+		a, b := first.electionTimeout(), second.electionTimeout()
+		if a != b {
+			t.Fatalf("timeout %v differs with the same seed: %v and %v", i, a, b)
+		}
+		if a < config.ElectionMinTimeout || a >= config.ElectionMaxTimeout {
+			t.Fatalf("timeout %v is outside [%v, %v)", a, config.ElectionMinTimeout, config.ElectionMaxTimeout)
+		}
+	}
+}
+
+func TestHigherPriorityPeerDelaysElections(t *testing.T) {
+	config := DefaultRaftConfig()
+	spread := config.ElectionMaxTimeout - config.ElectionMinTimeout
+
+	server := CreateServer("a", ":0", "b=:1,c=:2", noCommit)
+	server.Configure(config)
+	server.nodes["b"].priority = 2
+
+	for i := 0; i < 100; i++ {
+		timeout := server.electionTimeout()
+		if timeout < config.ElectionMaxTimeout+spread {
+			t.Fatalf("timeout %v doesn't wait out the higher priority node's whole range", timeout)
+		}
+	}
+
+	config.Priority = 2
+	server.Configure(config)
+	if timeout := server.electionTimeout(); timeout >= config.ElectionMaxTimeout {
+		t.Fatalf("timeout %v is delayed by a peer of the same priority", timeout)
+	}
+}
+
+func TestLoneServerElectsItselfOnVirtualTime(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	config := DefaultRaftConfig()
+	config.Clock = clock
+	config.Seed = 1
+
+	server := CreateServer("a", ":0", "", noCommit)
+	err := server.Configure(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Start()
+
+	waitFor(t, func() bool { return clock.waiting() > 0 })
+	if server.State != "follower" {
+		t.Fatalf("became %v before any time passed", server.State)
+	}
+
+	clock.Advance(config.ElectionMaxTimeout)
+	waitFor(t, func() bool {
+		server.lock <- true
+		defer func() {
+			<-server.lock
+		}()
+		return server.isLeader()
+	})
+
+	if server.Term != 1 {
+		t.Fatalf("expected to lead term 1, got %v", server.Term)
+	}
+}
+
+func TestWitnessOnlyVotesForUpToDateLogs(t *testing.T) {
+	config := DefaultRaftConfig()
+	config.Witness = true
+
+	server := CreateServer("w", ":0", "a=:1,b=:2", noCommit)
+	err := server.Configure(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.storeEntry(&Entry{Index: 1, Term: 2})
+
+	server.startCandidacy()
+	if server.State != witnessState || server.Term != 0 {
+		t.Fatalf("witness stood for election, it's %v in term %v", server.State, server.Term)
+	}
+
+	var reply RequestVoteReply
+	server.RequestVote(&RequestVoteArgs{Version: ProtocolVersion, Candidate: "a", Term: 3, LastLogIndex: 5, LastLogTerm: 1}, &reply)
+	if reply.VoteGranted {
+		t.Fatal("voted for a longer log from an older term")
+	}
+
+	server.RequestVote(&RequestVoteArgs{Version: ProtocolVersion, Candidate: "b", Term: 3, LastLogIndex: 1, LastLogTerm: 2}, &reply)
+	if !reply.VoteGranted {
+		t.Fatal("didn't vote for a log as up to date as ours")
+	}
+
+	config.Priority = 1
+	if server.Configure(config) == nil {
+		t.Fatal("expected a witness with a priority to be refused")
+	}
+}
+
+func TestVotesOnlyForUpToDateLogs(t *testing.T) {
+	server := CreateServer("a", ":0", "b=:1,c=:2", noCommit)
+	server.storeEntry(&Entry{Index: 1, Term: 1})
+	server.storeEntry(&Entry{Index: 2, Term: 2})
+	server.lastApplied = 2
+
+	var reply RequestVoteReply
+	server.RequestVote(&RequestVoteArgs{Version: ProtocolVersion, Candidate: "b", Term: 3, LastLogIndex: 4, LastLogTerm: 1}, &reply)
+	if reply.VoteGranted {
+		t.Fatal("voted for a longer log that ends in an older term")
+	}
+
+	server.RequestVote(&RequestVoteArgs{Version: ProtocolVersion, Candidate: "c", Term: 3, LastLogIndex: 2, LastLogTerm: 2}, &reply)
+	if !reply.VoteGranted {
+		t.Fatal("didn't vote for a log as up to date as ours")
+	}
+}
+
+func TestNewerTermStepsLeaderDown(t *testing.T) {
+	server := CreateServer("a", ":0", "b=:1,c=:2", noCommit)
+	server.Term = 1
+	server.State = "leader"
+	server.Leader = server.Self
+
+	var reply RequestVoteReply
+	server.RequestVote(&RequestVoteArgs{Version: ProtocolVersion, Candidate: "b", Term: 2}, &reply)
+	if !reply.VoteGranted || reply.Term != 2 {
+		t.Fatalf("expected a vote in term 2, got %+v", reply)
+	}
+	if server.isLeader() || server.State != "follower" {
+		t.Fatalf("still %v with leader %q after voting in a newer term", server.State, server.Leader)
+	}
+}
+
+func TestHeartbeatOnlyCommitsWhatMatchesTheLeader(t *testing.T) {
+	server := CreateServer("a", ":0", "b=:1,c=:2", noCommit)
+	server.storeEntry(&Entry{Index: 1, Term: 1})
+	server.storeEntry(&Entry{Index: 2, Term: 1}) // never made it past us, the next leader has something else here
+
+	var reply AppendEntriesReply
+	server.AppendEntries(&AppendEntriesArgs{Version: ProtocolVersion, Term: 2, Leader: "b", PrevLogIndex: 1, PrevLogTerm: 1,
+		LeaderCommit: 5}, &reply)
+	if !reply.Success {
+		t.Fatal("heartbeat matching our log was refused")
+	}
+	if server.commitIndex != 1 {
+		t.Fatalf("committed up to %v, past the %v entries the leader vouched for", server.commitIndex, 1)
+	}
+	if reply.LastIndex != 2 {
+		t.Fatalf("expected our last index 2 in the reply, got %v", reply.LastIndex)
+	}
+}
+
+func TestOneMembershipChangeInFlight(t *testing.T) {
+	server := CreateServer("a", ":0", "b=:1,c=:2", noCommit)
+	server.Term = 1
+	server.State = "leader"
+	server.Leader = server.Self
+
+	entry, _, err := server.appendMembership(addNodeAction, MembershipArgs{ID: "d", Addr: ":3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := server.nodes["d"]; !found {
+		t.Fatal("d isn't a member once its entry is in the log")
+	}
+
+	_, _, err = server.appendMembership(removeNodeAction, MembershipArgs{ID: "b"})
+	if err == nil {
+		t.Fatalf("a second change went in while the one at %v hasn't committed", entry.Index)
+	}
+
+	server.commitIndex = entry.Index
+	_, leaving, err := server.appendMembership(removeNodeAction, MembershipArgs{ID: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaving == nil || leaving.ID != "b" {
+		t.Fatalf("expected b to be leaving, got %v", leaving)
+	}
+}
+
+func TestOnlyTheLeaderTransfersLeadership(t *testing.T) {
+	server := CreateServer("a", ":0", "b=:1,c=:2", noCommit)
+	if server.TransferLeadership("b") == nil {
+		t.Fatal("a follower handed off leadership")
+	}
+}
+
+func TestHealthNeedsAMajorityInTouch(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(100, 0)}
+	config := DefaultRaftConfig()
+	config.Clock = clock
+
+	server := CreateServer("a", ":0", "b=:1,c=:2", noCommit)
+	server.Configure(config)
+	server.Term = 1
+	server.State = "leader"
+	server.Leader = server.Self
+
+	if health := server.health(); health.Ready || health.CanWrite {
+		t.Fatalf("leader with no peer answering says it's ready: %+v", health)
+	}
+
+	server.nodes["b"].lastAck = clock.Now()
+	health := server.health()
+	if !health.Ready || !health.CanWrite || !health.CanReadLinearized || health.Role != "leader" {
+		t.Fatalf("leader with a majority in touch isn't ready: %+v", health)
+	}
+}
+
+func TestWaitersGiveUpWhenLeaderStepsDown(t *testing.T) {
+	server := CreateServer("a", ":0", "b=:1,c=:2", noCommit)
+	server.Term = 1
+	server.setState("leader", "test")
+	server.Leader = server.Self
+
+	entry, err := server.proposeEntry(Command{Action: "KVPut"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.lock <- true
+	server.newTerm(2, "test")
+	<-server.lock
+
+	if _, err := server.awaitEntry(entry); err != errNotLeading {
+		t.Fatalf("expected a waiter to give up once we stepped down, got %v", err)
+	}
+}
+
+func TestWaitersFailWhenTheirEntryIsTruncated(t *testing.T) {
+	server := CreateServer("a", ":0", "b=:1,c=:2", noCommit)
+	server.Term = 1
+	server.setState("leader", "test")
+	server.Leader = server.Self
+
+	entry, err := server.proposeEntry(Command{Action: "KVPut"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reply AppendEntriesReply
+	server.AppendEntries(&AppendEntriesArgs{Version: ProtocolVersion, Term: 2, Leader: "b",
+		Entries: []Entry{{Index: entry.Index, Term: 2}}}, &reply)
+	if !reply.Success {
+		t.Fatal("the new leader's entries were refused")
+	}
+
+	<-entry.done
+	if entry.error != errNotLeading {
+		t.Fatalf("expected the truncated entry to fail, got %v", entry.error)
+	}
+}
+
+func TestWaitersTimeOut(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(100, 0)}
+	config := DefaultRaftConfig()
+	config.Clock = clock
+
+	server := CreateServer("a", ":0", "b=:1,c=:2", noCommit)
+	server.Configure(config)
+	server.Term = 1
+	server.setState("leader", "test")
+	server.Leader = server.Self
+
+	entry, err := server.proposeEntry(Command{Action: "KVPut"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := server.awaitEntry(entry)
+		errs <- err
+	}()
+	waitFor(t, func() bool { return clock.waiting() > 0 })
+	clock.Advance(ProposeTimeout * time.Millisecond)
+
+	if err := <-errs; err == nil || err == errNotLeading {
+		t.Fatalf("expected a timeout for an entry that never commits, got %v", err)
+	}
+}
+
+// fakeVoter answers a candidate's vote requests however answer says to
+type fakeVoter struct {
+	answer func(args *RequestVoteArgs) RequestVoteReply
+}
+
+func (voter *fakeVoter) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	*reply = voter.answer(args)
+	return nil
+}
+
+// withVoters connects server's peers to fake voters over pipes
+func withVoters(server *Server, answer func(id string, args *RequestVoteArgs) RequestVoteReply) {
+	for id, node := range server.nodes {
+		id := id
+		voter := rpc.NewServer()
+		voter.RegisterName("Server", &fakeVoter{answer: func(args *RequestVoteArgs) RequestVoteReply {
+			return answer(id, args)
+		}})
+
+		serverConn, clientConn := net.Pipe()
+		go voter.ServeConn(serverConn)
+		node.client = rpc.NewClient(clientConn)
+	}
+}
+
+func TestCandidateStepsDownForANewerVoter(t *testing.T) {
+	server := CreateServer("a", ":0", "b=:1,c=:2", noCommit)
+	withVoters(server, func(id string, args *RequestVoteArgs) RequestVoteReply {
+		if id == "b" {
+			return RequestVoteReply{Term: args.Term + 3}
+		}
+		return RequestVoteReply{Term: args.Term, VoteGranted: true}
+	})
+
+	server.startCandidacy()
+	if server.State != "follower" || server.Term != 4 || server.votedFor != "" {
+		t.Fatalf("expected to follow in term 4 without a vote, got %v in term %v having voted for %q", server.State, server.Term, server.votedFor)
+	}
+}
+
+func TestOvertakenCandidateKeepsWhereItMovedOn(t *testing.T) {
+	server := CreateServer("a", ":0", "b=:1,c=:2", noCommit)
+	withVoters(server, func(id string, args *RequestVoteArgs) RequestVoteReply {
+		if id == "b" {
+			// c stands in a newer term while we wait, and we vote for it
+			var reply RequestVoteReply
+			server.RequestVote(&RequestVoteArgs{Version: ProtocolVersion, Candidate: "c", Term: args.Term + 1}, &reply)
+		}
+		return RequestVoteReply{Term: args.Term}
+	})
+
+	server.startCandidacy()
+	if server.State != "follower" || server.Term != 2 || server.votedFor != "c" {
+		t.Fatalf("expected to follow in term 2 having voted for c, got %v in term %v having voted for %q", server.State, server.Term, server.votedFor)
+	}
+}
+
+// waitFor polls for goroutines reacting to the fake clock, on real time
+func waitFor(t *testing.T, done func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"../protos"
+)
+
+// requestPrefix is where the idx each create or delete request touched is kept in the disk store, so a client
+// retrying a write it never heard back about gets what it already did instead of doing it twice
+const requestPrefix = "request/"
+
+// requestExpiryPrefix keys every request by its deadline then ID, so a tick finds the ones to forget in order
+// without reading the rest
+const requestExpiryPrefix = "requestexpiry/"
+
+// errNotYet stops a scan over deadlines at the first one still in the future
+var errNotYet = errors.New("not due yet")
+
+func requestKey(id string) string {
+	return requestPrefix + id
+}
+
+func requestExpiryKey(deadline int64, id string) string {
+	return fmt.Sprintf("%v%016x/%v", requestExpiryPrefix, deadline, id)
+}
+
+// parseRequestExpiryKey gives back the deadline and request ID a requestExpiryKey was made from
+func parseRequestExpiryKey(key string) (int64, string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(key, requestExpiryPrefix), "/", 2)
+	if len(parts) != 2 {
+		return 0, "", fmt.Errorf("bad request expiry key %v", key)
+	}
+
+	deadline, err := strconv.ParseUint(parts[0], 16, 64)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return int64(deadline), parts[1], nil
+}
+
+// putRequestOps remembers that request id touched idx until deadline
+func putRequestOps(id string, idx uint64, deadline int64) []StoreOp {
+	value := make([]byte, 16)
+	binary.BigEndian.PutUint64(value[0:8], idx)
+	binary.BigEndian.PutUint64(value[8:16], uint64(deadline))
+	return []StoreOp{
+		{Key: requestKey(id), Value: value},
+		{Key: requestExpiryKey(deadline, id), Value: []byte{}},
+	}
+}
+
+// requestOps remembers a write's request ID for RequestRetention, if it has one. storelock must be held
+func (backend *Backend) requestOps(id string, idx uint64, command Command) []StoreOp {
+	if id == "" {
+		return nil
+	}
+	return putRequestOps(id, idx, backend.deadline(command, RequestRetention))
+}
+
+// requestIdx gives back the idx a request touched, if we still remember it
+func (backend *Backend) requestIdx(id string) (uint64, bool, error) {
+	if id == "" {
+		return 0, false, nil
+	}
+
+	value, found, err := backend.disk.Get(requestKey(id))
+	if err != nil || !found {
+		return 0, false, err
+	}
+
+	return binary.BigEndian.Uint64(value[0:8]), true, nil
+}
+
+// requested gives back the giraffe a create request already made, nil if it hasn't made one. It's an error if
+// the giraffe has been deleted since
+func (backend *Backend) requested(id string) (*protos.Giraffe, error) {
+	idx, found, err := backend.requestIdx(id)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	giraffe, err := backend.getGiraffe(idx)
+	if err != nil {
+		return nil, err
+	}
+	if giraffe == nil {
+		return nil, fmt.Errorf("request %v already created giraffe %v, which has since been deleted", id, idx)
+	}
+
+	return giraffe, nil
+}
+
+// deleted is whether request id already deleted giraffe idx
+func (backend *Backend) deleted(id string, idx uint64) (bool, error) {
+	earlier, found, err := backend.requestIdx(id)
+	return found && earlier == idx, err
+}
+
+// expireRequestOps forgets every request whose deadline is at or before now. storelock must be held
+func (backend *Backend) expireRequestOps(now int64) ([]StoreOp, error) {
+	ops := []StoreOp{}
+	err := backend.disk.Scan(requestExpiryPrefix, func(key string, value []byte) error {
+		deadline, id, err := parseRequestExpiryKey(key)
+		if err != nil {
+			return err
+		}
+
+		if deadline > now {
+			return errNotYet
+		}
+		ops = append(ops, StoreOp{Key: key, Delete: true}, StoreOp{Key: requestKey(id), Delete: true})
+		return nil
+	})
+	if err != nil && err != errNotYet {
+		return nil, err
+	}
+
+	return ops, nil
+}
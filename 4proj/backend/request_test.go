@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+
+	"../protos"
+)
+
+func TestRetriedDeleteSucceeds(t *testing.T) {
+	backend, done := openTestBackend(t)
+	defer done()
+
+	createAt(t, backend, 7, "gone", 0, 1000)
+
+	del := func(requestID string) (interface{}, error) {
+		command := NewCommand("DeleteGiraffe", LogDeleteGiraffeArgs{Idx: 7, RequestID: requestID})
+		command.Time = 2000
+		return applyNext(backend, command)
+	}
+
+	deleted, err := del("first")
+	if err != nil || deleted != true {
+		t.Fatalf("delete failed: %v %v", deleted, err)
+	}
+
+	// The reply was lost and the client tries again, possibly after the entry already committed
+	deleted, err = del("first")
+	if err != nil || deleted != true {
+		t.Fatalf("retried delete failed: %v %v", deleted, err)
+	}
+	var reply bool
+	err = backend.DeleteGiraffe(&DeleteGiraffeArgs{Idx: 7, RequestID: "first"}, &reply)
+	if err != nil || !reply {
+		t.Fatalf("retried delete on the leader failed: %v %v", reply, err)
+	}
+
+	// Someone else deleting it finds nothing
+	if _, err := del("second"); err == nil {
+		t.Fatal("deleting a giraffe that's gone went through")
+	}
+}
+
+func TestRequestsExpireOnTick(t *testing.T) {
+	backend, done := openTestBackend(t)
+	defer done()
+
+	command := NewCommand("CreateGiraffe", LogCreateGiraffeArgs{Name: "once", Idx: 3, RequestID: "r"})
+	command.Time = 1000
+	if _, err := applyNext(backend, command); err != nil {
+		t.Fatal(err)
+	}
+
+	tick := func(now int64) {
+		_, err := applyNext(backend, NewCommand("Tick", LogTickArgs{Time: now}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tick(1000 + RequestRetention - 1)
+	var giraffe protos.Giraffe
+	err := backend.CreateGiraffe(&CreateGiraffeArgs{Name: "once", RequestID: "r"}, &giraffe)
+	if err != nil || giraffe.Idx != 3 {
+		t.Fatalf("retry before the request expired didn't find the giraffe: %+v %v", giraffe, err)
+	}
+
+	tick(1000 + RequestRetention)
+	if _, found, _ := backend.disk.Get(requestKey("r")); found {
+		t.Fatal("request outlived RequestRetention")
+	}
+	if backend.needsTick(1 << 62) {
+		t.Fatal("a tick is still wanted with nothing left to expire")
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// InstallSnapshotArgs is a piece of the leader's store as of LastIndex, in the backup format, for a follower
+// whose next entry has been compacted out of the leader's log. Members is the membership as of LastIndex.
+// Pieces go out in order from Offset 0, and Done is set on the last
+type InstallSnapshotArgs struct {
+	Version uint32
+
+	Term   uint64
+	Leader string
+
+	LastIndex uint64
+	LastTerm  uint64
+	Members   []MembershipArgs
+
+	Offset int64
+	Data   []byte
+	Done   bool
+}
+
+// InstallSnapshotReply is the follower's term, so a leader that's been overtaken finds out
+type InstallSnapshotReply struct {
+	Term uint64
+}
+
+// snapshotPath is where a follower collects a snapshot until it has all of it
+func (server *Server) snapshotPath() string {
+	return filepath.Join(server.dataDir, "snapshot.incoming")
+}
+
+// sendSnapshot brings node up to a snapshot of our store, a BackupChunkSize piece at a time. A witness keeps no
+// store, so it only gets the snapshot's index, term and membership
+func (node *Node) sendSnapshot(term uint64) {
+	server := node.server
+	if server.snapshot == nil {
+		log.Printf("%v needs entries we've compacted, but we can't take a snapshot\n", node.ID)
+		return
+	}
+
+	if node.Connect() != nil {
+		return // no point writing out the whole store for a node we can't reach
+	}
+
+	path := filepath.Join(server.dataDir, fmt.Sprintf("snapshot-%x.tmp", node.ID))
+	defer os.Remove(path)
+
+	var applied uint64
+	if !node.witness {
+		file, err := os.Create(path)
+		if err != nil {
+			log.Printf("Could not spool a snapshot for %v: %v\n", node.ID, err)
+			return
+		}
+		writer := bufio.NewWriter(file)
+		applied, err = server.snapshot(writer)
+		if err == nil {
+			err = writer.Flush()
+		}
+		file.Close()
+		if err != nil {
+			log.Printf("Could not spool a snapshot for %v: %v\n", node.ID, err)
+			return
+		}
+	}
+
+	server.logLock <- true
+	if node.witness {
+		applied = server.lastApplied
+	}
+	if applied < server.logBase() {
+		<-server.logLock
+		return // we compacted past it while it was being written, the next heartbeat takes another
+	}
+	args := InstallSnapshotArgs{
+		Version:   ProtocolVersion,
+		Term:      term,
+		Leader:    server.Self,
+		LastIndex: applied,
+		LastTerm:  server.entry(applied).Term,
+		Members:   server.membersAt(applied),
+	}
+	<-server.logLock
+
+	log.Printf("Sending %v a snapshot as of %v\n", node.ID, applied)
+
+	var file *os.File
+	if !node.witness {
+		var err error
+		file, err = os.Open(path)
+		if err != nil {
+			log.Printf("Could not read the snapshot for %v: %v\n", node.ID, err)
+			return
+		}
+		defer file.Close()
+	}
+
+	chunk := make([]byte, BackupChunkSize)
+	for !args.Done {
+		n := 0
+		if file != nil {
+			var err error
+			n, err = io.ReadFull(file, chunk)
+			if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+				log.Printf("Could not read the snapshot for %v: %v\n", node.ID, err)
+				return
+			}
+		}
+		args.Data = chunk[:n]
+		args.Done = n < len(chunk)
+
+		var reply InstallSnapshotReply
+		err := node.call("Server.InstallSnapshot", &args, &reply)
+		if err != nil {
+			log.Printf("Sending %v a snapshot failed: %v\n", node.ID, err)
+			return
+		}
+
+		if reply.Term > term {
+			server.lock <- true
+			if reply.Term > server.Term {
+				server.newTerm(reply.Term, node.ID+" is on a newer term")
+				server.saveState()
+			}
+			<-server.lock
+			return
+		}
+
+		args.Offset += int64(n)
+	}
+
+	node.matchIndex = args.LastIndex
+	node.nextIndex = args.LastIndex + 1
+}
+
+// InstallSnapshot takes a snapshot from the leader a piece at a time. Once it has all of it, the snapshot
+// replaces our store and our log starts over from its index
+func (server *Server) InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	if !compatibleVersion(args.Version) {
+		return incompatibleVersion(args.Version)
+	}
+
+	server.lock <- true
+	defer func() {
+		<-server.lock
+	}()
+
+	reply.Term = server.Term
+	if args.Term < server.Term {
+		return nil
+	}
+
+	if args.Term > server.Term {
+		server.newTerm(args.Term, "heard from leader "+args.Leader)
+		server.saveState()
+	}
+	if server.State == "candidate" {
+		server.setState("follower", "heard from leader "+args.Leader)
+	}
+	if server.Leader != args.Leader {
+		if server.State == "leader" {
+			return fmt.Errorf("competing leader %v in term %v", args.Leader, args.Term)
+		}
+		server.Leader = args.Leader
+	}
+
+	server.lastContact = server.config.Clock.Now()
+	server.resetElectionTimer() // a big snapshot takes a while, the leader is still there
+
+	flags := os.O_WRONLY | os.O_APPEND
+	if args.Offset == 0 {
+		flags |= os.O_CREATE | os.O_TRUNC
+	}
+	file, err := os.OpenFile(server.snapshotPath(), flags, 0644)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err == nil && stat.Size() != args.Offset {
+		err = fmt.Errorf("snapshot piece is at offset %v but we have %v bytes of it", args.Offset, stat.Size())
+	}
+	if err == nil {
+		_, err = file.Write(args.Data)
+	}
+	file.Close()
+	if err != nil || !args.Done {
+		return err
+	}
+	defer os.Remove(server.snapshotPath())
+
+	server.logLock <- true
+	defer func() {
+		<-server.logLock
+	}()
+
+	if args.LastIndex <= server.commitIndex {
+		return nil // we got there through the log while this was on its way
+	}
+
+	if !server.config.Witness && server.restore != nil {
+		err = server.restore(server.snapshotPath())
+		if err != nil {
+			return fmt.Errorf("could not install the snapshot as of %v: %v", args.LastIndex, err)
+		}
+	}
+
+	// Entries past the snapshot can stay if our log agrees with the leader's up to it
+	entries := []*Entry{&Entry{
+		Index:   args.LastIndex,
+		Term:    args.LastTerm,
+		Command: NewCommand(logBaseAction, LogBaseArgs{Members: args.Members}),
+	}}
+	if args.LastIndex <= server.lastIndex() && server.entry(args.LastIndex).Term == args.LastTerm {
+		entries = append(entries, server.entriesFrom(args.LastIndex+1)...)
+	}
+
+	// What we hadn't applied and aren't keeping is covered by the snapshot, it won't be applied here
+	for _, entry := range server.entriesFrom(server.lastApplied + 1) {
+		if len(entries) == 1 || entry.Index <= args.LastIndex {
+			entry.drop()
+		}
+	}
+
+	err = server.replaceLog(entries)
+	if err != nil {
+		log.Fatalf("Installed a snapshot as of %v but could not start the log from it: %v\n", args.LastIndex, err)
+	}
+	server.rebuildMembership()
+
+	server.lastApplied = args.LastIndex
+	server.setCommitIndex(args.LastIndex)
+
+	log.Printf("Installed a snapshot as of %v from %v\n", args.LastIndex, args.Leader)
+
+	return nil
+}
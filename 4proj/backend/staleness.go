@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Staleness bounds how far behind the leader a follower can be and still serve a read, by how many committed
+// entries it has yet to apply or how long since it heard from the leader. A zero field isn't checked, so the
+// zero Staleness lets any node answer like reads always have
+type Staleness struct {
+	MaxLag uint64
+	MaxAge time.Duration
+}
+
+func (bound Staleness) bounded() bool {
+	return bound.MaxLag != 0 || bound.MaxAge != 0
+}
+
+// StaleReadError is given back for a read this node is too far behind to serve, the client should try another.
+// Leader is empty when we don't know of a leader, and so can't tell how far behind we are
+type StaleReadError struct {
+	Lag    uint64
+	Age    time.Duration
+	Leader string
+}
+
+func (err *StaleReadError) Error() string {
+	return fmt.Sprintf("stale read: lag=%v age=%v leader=%v, retry elsewhere", err.Lag, err.Age, err.Leader)
+}
+
+// lag is how many entries the leader has committed that we haven't applied, how long it's been since we heard
+// from it, and who it is, empty when we don't know of a leader at all. The leader is never behind itself, but it
+// may have been deposed without hearing of it, so its age is since a majority last acknowledged it. It's read
+// under the locks that guard it, so the answer holds together even while entries are coming in
+func (server *Server) lag() (uint64, time.Duration, string) {
+	server.logLock <- true
+	applied := server.lastApplied
+	<-server.logLock
+
+	server.lock <- true
+	defer func() {
+		<-server.lock
+	}()
+
+	if server.isLeader() {
+		return 0, server.config.Clock.Now().Sub(server.quorumContact()), server.Leader
+	}
+	if server.Leader == "" || server.lastContact.IsZero() {
+		return 0, 0, ""
+	}
+
+	var behind uint64
+	if server.leaderCommit > applied {
+		behind = server.leaderCommit - applied
+	}
+
+	return behind, server.config.Clock.Now().Sub(server.lastContact), server.Leader
+}
+
+// checkStaleness makes sure we're close enough to the leader to serve a read within bound. The leader is only
+// stale once it's been out of touch with a majority for longer than MaxAge. Every read a follower can answer
+// checks it before touching the store
+func (backend *Backend) checkStaleness(bound Staleness) error {
+	if !bound.bounded() {
+		return nil
+	}
+
+	lag, age, leader := backend.raft.lag()
+	if leader == "" {
+		return &StaleReadError{}
+	}
+	if (bound.MaxLag != 0 && lag > bound.MaxLag) || (bound.MaxAge != 0 && age > bound.MaxAge) {
+		return &StaleReadError{Lag: lag, Age: age, Leader: leader}
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"../protos"
+)
+
+func TestFollowerReadsCheckStaleness(t *testing.T) {
+	backend, done := openTestBackend(t)
+	defer done()
+
+	createAt(t, backend, 100, "kept", 0, 1000)
+	if _, err := applyNext(backend, NewCommand("KVPut", KVArgs{Key: []byte("k"), Value: []byte("v")})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyNext(backend, NewCommand("AcquireLock", LockArgs{Name: "l", Owner: "o", TTL: 1000, Now: 1000})); err != nil {
+		t.Fatal(err)
+	}
+
+	clock := &fakeClock{now: time.Unix(100, 0)}
+	server := backend.raft
+	server.config.Clock = clock
+	server.State = "follower"
+	server.Leader = "b"
+	server.lastContact = clock.Now()
+	server.leaderCommit = server.lastApplied + 3
+
+	reads := map[string]func(bound Staleness) error{
+		"ReadGiraffe": func(bound Staleness) error {
+			return backend.ReadGiraffe(&ReadGiraffeArgs{Idx: 100, Staleness: bound}, &protos.Giraffe{})
+		},
+		"ListEntries": func(bound Staleness) error {
+			return backend.ListEntries(&ListEntriesArgs{Staleness: bound}, &ListEntriesReply{})
+		},
+		"QueryGiraffes": func(bound Staleness) error {
+			return backend.QueryGiraffes(&QueryArgs{Staleness: bound}, &[]protos.Giraffe{})
+		},
+		"GiraffeHistory": func(bound Staleness) error {
+			return backend.GiraffeHistory(&GiraffeHistoryArgs{Idx: 100, Staleness: bound}, &[]AuditRecord{})
+		},
+		"KVGet": func(bound Staleness) error {
+			return backend.KVGet(&KVGetArgs{Key: []byte("k"), Staleness: bound}, &KVPair{})
+		},
+		"KVScan": func(bound Staleness) error {
+			return backend.KVScan(&KVScanArgs{Staleness: bound}, &KVScanReply{})
+		},
+		"ReadLock": func(bound Staleness) error {
+			return backend.ReadLock(&ReadLockArgs{Name: "l", Staleness: bound}, &Lease{})
+		},
+	}
+
+	clock.Advance(time.Second)
+	for name, read := range reads {
+		if err := read(Staleness{}); err != nil {
+			t.Fatalf("%v without a bound failed: %v", name, err)
+		}
+		if err := read(Staleness{MaxLag: 3, MaxAge: 2 * time.Second}); err != nil {
+			t.Fatalf("%v within its bound failed: %v", name, err)
+		}
+		if _, ok := read(Staleness{MaxLag: 2}).(*StaleReadError); !ok {
+			t.Fatalf("%v answered while too many entries behind", name)
+		}
+		if _, ok := read(Staleness{MaxAge: time.Second / 2}).(*StaleReadError); !ok {
+			t.Fatalf("%v answered after too long without the leader", name)
+		}
+	}
+
+	// Not knowing of a leader at all means we can't tell how far behind we are
+	server.Leader = ""
+	if _, ok := reads["KVGet"](Staleness{MaxLag: 100}).(*StaleReadError); !ok {
+		t.Fatal("read within a bound answered without knowing of a leader")
+	}
+}
+
+func TestLeaderReadsNeedAMajorityInTouch(t *testing.T) {
+	backend, done := openTestBackend(t)
+	defer done()
+
+	clock := &fakeClock{now: time.Unix(100, 0)}
+	server := backend.raft
+	server.config.Clock = clock
+	server.nodes["b"] = CreateNode(server, "b", ":1")
+	server.nodes["c"] = CreateNode(server, "c", ":2")
+
+	bound := Staleness{MaxAge: time.Second}
+	read := func() error {
+		return backend.KVScan(&KVScanArgs{Staleness: bound}, &KVScanReply{})
+	}
+
+	if _, ok := read().(*StaleReadError); !ok {
+		t.Fatal("a leader no peer has answered served a bounded read")
+	}
+
+	server.nodes["b"].lastAck = clock.Now()
+	if err := read(); err != nil {
+		t.Fatalf("a leader in touch with a majority refused a read: %v", err)
+	}
+
+	// Cut off from the others, it may have been replaced by a leader it hasn't heard of
+	clock.Advance(2 * time.Second)
+	if _, ok := read().(*StaleReadError); !ok {
+		t.Fatal("a leader out of touch for longer than MaxAge served a read")
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// StoreOp is a single put or delete in a batch written to the DiskStore
+type StoreOp struct {
+	Delete bool
+	Key    string
+	Value  []byte
+}
+
+// storeLoc is where a key's current value lives in the store file
+type storeLoc struct {
+	offset int64
+	size   uint32
+}
+
+// DiskStore is an append-only key value file. Every batch is written as a single checksummed
+// record along with the log index it brings the store up to, so a torn write loses the whole batch.
+//
+// Record layout: crc32 | body length | body
+// Body layout: applied index | op count | (delete flag | key length | value length | key | value)...
+type DiskStore struct {
+	path string
+	file *os.File
+	size int64
+
+	keys    map[string]storeLoc
+	sorted  []string
+	live    int64 // bytes compacting would write, so counts headers and keys as well as values
+	applied uint64
+
+	lock chan bool
+}
+
+const recordHeaderSize = 8
+
+// OpenDiskStore opens or creates a store file, replaying it to find every key and the applied index
+func OpenDiskStore(path string) (*DiskStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &DiskStore{
+		path: path,
+		file: file,
+
+		keys:   map[string]storeLoc{},
+		sorted: []string{},
+
+		lock: make(chan bool, 1),
+	}
+
+	err = store.load()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// readRecord reads the record at offset from r, returning its applied index and ops
+func readRecord(r io.Reader, offset int64) (uint64, []StoreOp, []storeLoc, int64, error) {
+	header := make([]byte, recordHeaderSize)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return 0, nil, nil, 0, err
+	}
+
+	sum := binary.BigEndian.Uint32(header[0:4])
+	body := make([]byte, binary.BigEndian.Uint32(header[4:8]))
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return 0, nil, nil, 0, err
+	}
+
+	if crc32.ChecksumIEEE(body) != sum || len(body) < 12 {
+		return 0, nil, nil, 0, errors.New("store record checksum mismatch")
+	}
+
+	applied := binary.BigEndian.Uint64(body[0:8])
+	count := binary.BigEndian.Uint32(body[8:12])
+
+	ops := []StoreOp{}
+	locs := []storeLoc{}
+	at := 12
+	for i := uint32(0); i < count; i++ {
+		if len(body) < at+9 {
+			return 0, nil, nil, 0, errors.New("store record is truncated")
+		}
+
+		del := body[at] == 1
+		keyLen := int(binary.BigEndian.Uint32(body[at+1 : at+5]))
+		valLen := int(binary.BigEndian.Uint32(body[at+5 : at+9]))
+		at += 9
+
+		if len(body) < at+keyLen+valLen {
+			return 0, nil, nil, 0, errors.New("store record is truncated")
+		}
+
+		ops = append(ops, StoreOp{
+			Delete: del,
+			Key:    string(body[at : at+keyLen]),
+			Value:  body[at+keyLen : at+keyLen+valLen],
+		})
+		locs = append(locs, storeLoc{
+			offset: offset + recordHeaderSize + int64(at+keyLen),
+			size:   uint32(valLen),
+		})
+		at += keyLen + valLen
+	}
+
+	return applied, ops, locs, int64(recordHeaderSize + len(body)), nil
+}
+
+// encodeRecord lays out a batch as a record
+func encodeRecord(applied uint64, ops []StoreOp) ([]byte, []int64) {
+	body := make([]byte, 12)
+	binary.BigEndian.PutUint64(body[0:8], applied)
+	binary.BigEndian.PutUint32(body[8:12], uint32(len(ops)))
+
+	valueAt := []int64{}
+	for _, op := range ops {
+		head := make([]byte, 9)
+		if op.Delete {
+			head[0] = 1
+		}
+		binary.BigEndian.PutUint32(head[1:5], uint32(len(op.Key)))
+		binary.BigEndian.PutUint32(head[5:9], uint32(len(op.Value)))
+
+		body = append(body, head...)
+		body = append(body, op.Key...)
+		valueAt = append(valueAt, int64(recordHeaderSize+len(body)))
+		body = append(body, op.Value...)
+	}
+
+	record := make([]byte, recordHeaderSize, recordHeaderSize+len(body))
+	binary.BigEndian.PutUint32(record[0:4], crc32.ChecksumIEEE(body))
+	binary.BigEndian.PutUint32(record[4:8], uint32(len(body)))
+
+	return append(record, body...), valueAt
+}
+
+// load replays the store file, throwing away anything after the last whole record
+func (store *DiskStore) load() error {
+	reader := bufio.NewReader(store.file)
+
+	var offset int64
+	for {
+		applied, ops, locs, size, err := readRecord(reader, offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Store %v has a bad record at %v (%v), truncating\n", store.path, offset, err)
+			err = store.file.Truncate(offset)
+			if err != nil {
+				return err
+			}
+			break
+		}
+
+		for i, op := range ops {
+			store.index(op, locs[i])
+		}
+		store.applied = applied
+		offset += size
+	}
+
+	store.size = offset
+	_, err := store.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+// liveSize is how many bytes writeLive spends on a key, as its own single op record
+func liveSize(key string, size uint32) int64 {
+	return recordHeaderSize + 12 + 9 + int64(len(key)) + int64(size)
+}
+
+// index points a key at its newest value, lock must be held
+func (store *DiskStore) index(op StoreOp, loc storeLoc) {
+	old, found := store.keys[op.Key]
+	if found {
+		store.live -= liveSize(op.Key, old.size)
+	}
+
+	if op.Delete {
+		if found {
+			delete(store.keys, op.Key)
+			i := sort.SearchStrings(store.sorted, op.Key)
+			store.sorted = append(store.sorted[:i], store.sorted[i+1:]...)
+		}
+		return
+	}
+
+	store.keys[op.Key] = loc
+	store.live += liveSize(op.Key, loc.size)
+
+	if !found {
+		i := sort.SearchStrings(store.sorted, op.Key)
+		store.sorted = append(store.sorted, "")
+		copy(store.sorted[i+1:], store.sorted[i:])
+		store.sorted[i] = op.Key
+	}
+}
+
+// Applied is the log index the store has been brought up to
+func (store *DiskStore) Applied() uint64 {
+	store.lock <- true
+	defer func() {
+		<-store.lock
+	}()
+
+	return store.applied
+}
+
+// Get reads the current value of a key
+func (store *DiskStore) Get(key string) ([]byte, bool, error) {
+	store.lock <- true
+	defer func() {
+		<-store.lock
+	}()
+
+	return store.get(key)
+}
+
+func (store *DiskStore) get(key string) ([]byte, bool, error) {
+	loc, found := store.keys[key]
+	if !found {
+		return nil, false, nil
+	}
+
+	value := make([]byte, loc.size)
+	_, err := store.file.ReadAt(value, loc.offset)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return value, true, nil
+}
+
+// Scan calls fn with every key starting with prefix, in order
+func (store *DiskStore) Scan(prefix string, fn func(key string, value []byte) error) error {
+	return store.ScanFrom(prefix, prefix, false, fn)
+}
+
+// ScanFrom calls fn with every key starting with prefix from the key from onwards, in order. With reverse set it
+// goes backwards from the last key before from instead
+func (store *DiskStore) ScanFrom(prefix string, from string, reverse bool, fn func(key string, value []byte) error) error {
+	store.lock <- true
+	defer func() {
+		<-store.lock
+	}()
+
+	i, step := sort.SearchStrings(store.sorted, from), 1
+	if reverse {
+		i, step = i-1, -1
+	}
+
+	for ; i >= 0 && i < len(store.sorted); i += step {
+		key := store.sorted[i]
+		if !strings.HasPrefix(key, prefix) {
+			break
+		}
+
+		value, _, err := store.get(key)
+		if err != nil {
+			return err
+		}
+
+		err = fn(key, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Apply durably writes a batch of ops and moves the applied index up to index
+func (store *DiskStore) Apply(index uint64, ops ...StoreOp) error {
+	store.lock <- true
+	defer func() {
+		<-store.lock
+	}()
+
+	record, valueAt := encodeRecord(index, ops)
+
+	_, err := store.file.Write(record)
+	if err == nil {
+		err = store.file.Sync()
+	}
+	if err != nil {
+		store.file.Truncate(store.size) // don't leave half a record behind
+		store.file.Seek(store.size, io.SeekStart)
+		return err
+	}
+
+	for i, op := range ops {
+		store.index(op, storeLoc{
+			offset: store.size + valueAt[i],
+			size:   uint32(len(op.Value)),
+		})
+	}
+	store.size += int64(len(record))
+	store.applied = index
+
+	if store.size > StoreCompactMinBytes && store.size > 2*store.live {
+		err = store.compact()
+		if err != nil {
+			log.Printf("Could not compact store %v: %v\n", store.path, err)
+		}
+	}
+
+	return nil
+}
+
+// writeLive writes every live key to w as fresh records, lock must be held
+func (store *DiskStore) writeLive(w io.Writer) error {
+	for _, key := range store.sorted {
+		value, _, err := store.get(key)
+		if err != nil {
+			return err
+		}
+
+		record, _ := encodeRecord(store.applied, []StoreOp{{Key: key, Value: value}})
+		_, err = w.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+
+	record, _ := encodeRecord(store.applied, nil) // keeps the applied index even with no keys
+	_, err := w.Write(record)
+	return err
+}
+
+// compact rewrites the store with only live keys and swaps it in, lock must be held
+func (store *DiskStore) compact() error {
+	tmp := store.path + ".compact"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	err = store.writeLive(writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, store.path)
+	if err != nil {
+		return err
+	}
+
+	store.file.Close()
+	store.file, err = os.OpenFile(store.path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+
+	store.keys = map[string]storeLoc{}
+	store.sorted = []string{}
+	store.live = 0
+	return store.load()
+}
+
+// Close closes the underlying file
+func (store *DiskStore) Close() error {
+	store.lock <- true
+	defer func() {
+		<-store.lock
+	}()
+
+	return store.file.Close()
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// openTestStore opens a store in a fresh directory, giving back its path for reopening
+func openTestStore(t *testing.T) (*DiskStore, string, func()) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "giraffes.db")
+	store, err := OpenDiskStore(path)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return store, path, func() { os.RemoveAll(dir) }
+}
+
+func mustGet(t *testing.T, store *DiskStore, key string) string {
+	value, found, err := store.Get(key)
+	if err != nil || !found {
+		t.Fatalf("expected %v in the store: %v", key, err)
+	}
+	return string(value)
+}
+
+func TestStoreSurvivesReopen(t *testing.T) {
+	store, path, done := openTestStore(t)
+	defer done()
+
+	err := store.Apply(1, StoreOp{Key: "b", Value: []byte("one")}, StoreOp{Key: "a", Value: []byte("two")})
+	if err == nil {
+		err = store.Apply(2, StoreOp{Key: "b", Delete: true}, StoreOp{Key: "c", Value: []byte("three")})
+	}
+	if err == nil {
+		err = store.Apply(3, StoreOp{Key: "a", Value: []byte("four")})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = OpenDiskStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if store.Applied() != 3 {
+		t.Fatalf("expected applied 3 after reopening, got %v", store.Applied())
+	}
+	if _, found, _ := store.Get("b"); found {
+		t.Fatal("a deleted key came back")
+	}
+	if mustGet(t, store, "a") != "four" || mustGet(t, store, "c") != "three" {
+		t.Fatal("reopening didn't keep the newest values")
+	}
+
+	keys := []string{}
+	store.Scan("", func(key string, value []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if strings.Join(keys, ",") != "a,c" {
+		t.Fatalf("expected a and c in order, got %v", keys)
+	}
+}
+
+func TestStoreDropsTornAndCorruptBatches(t *testing.T) {
+	store, path, done := openTestStore(t)
+	defer done()
+
+	if err := store.Apply(1, StoreOp{Key: "kept", Value: []byte("yes")}); err != nil {
+		t.Fatal(err)
+	}
+	whole := store.size
+	if err := store.Apply(2, StoreOp{Key: "lost", Value: []byte("no")}, StoreOp{Key: "kept", Value: []byte("no")}); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	// Half of the second batch made it to disk
+	if err := os.Truncate(path, store.size-3); err != nil {
+		t.Fatal(err)
+	}
+	torn, err := OpenDiskStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torn.Applied() != 1 || torn.size != whole || mustGet(t, torn, "kept") != "yes" {
+		t.Fatalf("expected only the first batch, applied %v size %v", torn.Applied(), torn.size)
+	}
+	if _, found, _ := torn.Get("lost"); found {
+		t.Fatal("part of a torn batch was kept")
+	}
+
+	// The rest of the store carries on from the first batch
+	if err := torn.Apply(2, StoreOp{Key: "later", Value: []byte("yes")}); err != nil {
+		t.Fatal(err)
+	}
+	torn.Close()
+
+	// A flipped bit fails the batch's checksum
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 1
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	corrupt, err := OpenDiskStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer corrupt.Close()
+	if corrupt.Applied() != 1 {
+		t.Fatalf("expected the corrupt batch dropped, applied %v", corrupt.Applied())
+	}
+	if _, found, _ := corrupt.Get("later"); found {
+		t.Fatal("a batch that failed its checksum was kept")
+	}
+}
+
+func TestStoreCompacts(t *testing.T) {
+	store, path, done := openTestStore(t)
+	defer done()
+
+	big := make([]byte, 64<<10)
+	for i := uint64(1); i <= StoreCompactMinBytes/uint64(len(big))+4; i++ {
+		big[0] = byte(i)
+		if err := store.Apply(i, StoreOp{Key: "big", Value: big}, StoreOp{Key: "small", Value: []byte{byte(i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	applied := store.Applied()
+	store.Close()
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() > StoreCompactMinBytes {
+		t.Fatalf("expected the overwritten values compacted away, the store is %v bytes", stat.Size())
+	}
+
+	store, err = OpenDiskStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if store.Applied() != applied {
+		t.Fatalf("expected applied %v after compacting, got %v", applied, store.Applied())
+	}
+	value, _, err := store.Get("big")
+	if err != nil || len(value) != len(big) || value[0] != byte(applied) || mustGet(t, store, "small") != string([]byte{byte(applied)}) {
+		t.Fatalf("compacting lost the newest values: %v", err)
+	}
+}
+
+func TestStoreDoesNotCompactLiveKeys(t *testing.T) {
+	store, _, done := openTestStore(t)
+	defer done()
+	defer store.Close()
+
+	// index entries are all key and no value, and none of them are dead
+	compactions := 0
+	for i := 0; i < 2*StoreCompactMinBytes/(1000*60); i++ {
+		ops := []StoreOp{}
+		for j := 0; j < 1000; j++ {
+			ops = append(ops, StoreOp{Key: fmt.Sprintf("name/giraffe%08d\x00%016x", i, j)})
+		}
+
+		record, _ := encodeRecord(uint64(i+1), ops)
+		appended := store.size + int64(len(record))
+		if err := store.Apply(uint64(i+1), ops...); err != nil {
+			t.Fatal(err)
+		}
+		if store.size != appended {
+			compactions++ // compacting rewrote the file rather than appending to it
+		}
+	}
+
+	if store.size < StoreCompactMinBytes {
+		t.Fatalf("expected the store past %v bytes, it is %v", StoreCompactMinBytes, store.size)
+	}
+	if compactions != 0 {
+		t.Fatalf("expected no compactions when every key is live, got %v", compactions)
+	}
+}
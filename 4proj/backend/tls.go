@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/x509"
+	"log"
+	"net/http"
+	"net/rpc"
+
+	"../tlsconf"
+)
+
+// raftPath is where peer RPCs are served when TLS is on, apart from the rest so only members can reach them
+const raftPath = "/_raftRPC_"
+
+// isMember checks a certificate names ourselves or one of our peers by ID
+func (server *Server) isMember(cert *x509.Certificate) bool {
+	if tlsconf.CertNamed(cert, server.Self) {
+		return true
+	}
+
+	for _, node := range server.peers() {
+		if tlsconf.CertNamed(cert, node.ID) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// membersOnly only lets connections from current cluster members through to handler. It's checked when a
+// connection is made, which is when net/rpc takes the connection over
+func (server *Server) membersOnly(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 || !server.isMember(r.TLS.PeerCertificates[0]) {
+			log.Printf("Refusing peer RPCs from %v, it is not a cluster member\n", r.RemoteAddr)
+			http.Error(w, "not a cluster member", http.StatusForbidden)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// isOperator checks a certificate names one of the operators allowed to use admin RPCs
+func (backend *Backend) isOperator(cert *x509.Certificate) bool {
+	for _, name := range backend.operators {
+		if tlsconf.CertNamed(cert, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// operatorsOnly only lets connections from operators through to handler, like membersOnly does for peers
+func (backend *Backend) operatorsOnly(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 || !backend.isOperator(r.TLS.PeerCertificates[0]) {
+			log.Printf("Refusing admin RPCs from %v, it is not an operator\n", r.RemoteAddr)
+			http.Error(w, "not an operator", http.StatusForbidden)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// rpcPath is where peers serve raft's RPCs
+func (server *Server) rpcPath() string {
+	if server.tls != nil {
+		return raftPath
+	}
+	return rpc.DefaultRPCPath
+}
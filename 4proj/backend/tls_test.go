@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminOnlyForOperators(t *testing.T) {
+	backend := CreateBackend("a", ":0", "b=:1", "")
+	backend.UseTLS(&tls.Config{}, []string{"raftctl", "ops"})
+
+	admin := backend.operatorsOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	connect := func(cert *x509.Certificate) int {
+		r := httptest.NewRequest("CONNECT", "/_adminRPC_", nil)
+		r.TLS = &tls.ConnectionState{}
+		if cert != nil {
+			r.TLS.PeerCertificates = []*x509.Certificate{cert}
+		}
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	for _, cert := range []*x509.Certificate{
+		{Subject: pkix.Name{CommonName: "raftctl"}},
+		{Subject: pkix.Name{CommonName: "someone"}, DNSNames: []string{"ops"}},
+	} {
+		if code := connect(cert); code != http.StatusOK {
+			t.Fatalf("operator %v was turned away with %v", cert.Subject.CommonName, code)
+		}
+	}
+
+	// Being signed by the CA isn't enough, frontends and peers aren't operators
+	for _, cert := range []*x509.Certificate{
+		{Subject: pkix.Name{CommonName: "frontend"}},
+		{Subject: pkix.Name{CommonName: "b"}},
+		nil,
+	} {
+		if code := connect(cert); code != http.StatusForbidden {
+			t.Fatalf("non-operator %v got admin access", cert)
+		}
+	}
+}
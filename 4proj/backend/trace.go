@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+)
+
+// Trace event kinds
+const (
+	traceRole     = "role"     // Role is what we became, Reason why
+	traceTerm     = "term"     // From is the term we left, Reason why
+	traceVote     = "vote"     // Peer is the candidate, Granted and Reason what we said
+	traceAppend   = "append"   // From to Index were added to our log
+	traceTruncate = "truncate" // Index and everything after it were dropped from our log
+	traceCommit   = "commit"   // commitIndex went from From to Index
+	traceApply    = "apply"    // Index was applied, Action is its command
+)
+
+// TraceEvent is one line of a node's trace. Time is the node's clock, for lining nodes up against each other,
+// and Mono is how long the node had been tracing across every run that added to the file, which never goes
+// backwards even if the clock does or the node restarts
+type TraceEvent struct {
+	Node  string
+	Term  uint64
+	Time  time.Time
+	Mono  time.Duration
+	Event string
+
+	Role    string `json:",omitempty"`
+	Peer    string `json:",omitempty"`
+	Granted bool   `json:",omitempty"`
+	Reason  string `json:",omitempty"`
+	From    uint64 `json:",omitempty"`
+	Index   uint64 `json:",omitempty"`
+	Action  string `json:",omitempty"`
+}
+
+// Tracer appends a node's trace events to a file as JSON lines
+type Tracer struct {
+	file    *os.File
+	encoder *json.Encoder
+	start   time.Time
+	base    time.Duration // Mono of the last event earlier runs wrote, so this run carries on from it
+	failed  bool          // a write failed, so we've stopped tracing
+	lock    chan bool
+}
+
+// OpenTracer starts tracing to path, adding to what's there from earlier runs
+func OpenTracer(path string) (*Tracer, error) {
+	base, err := lastMono(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Tracer{
+		file:    file,
+		encoder: json.NewEncoder(file),
+		start:   time.Now(),
+		base:    base,
+		lock:    make(chan bool, 1),
+	}, nil
+}
+
+// lastMono is the Mono of the last whole event in the trace at path, or 0 if there isn't one yet.
+// A line torn by a crash mid write ends the trace there
+func lastMono(path string) (time.Duration, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var last time.Duration
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for {
+		var event TraceEvent
+		if decoder.Decode(&event) != nil {
+			return last, nil
+		}
+		if event.Mono > last {
+			last = event.Mono
+		}
+	}
+}
+
+// trace records an event as of our current term, if we're tracing
+func (server *Server) trace(event TraceEvent) {
+	tracer := server.tracer
+	if tracer == nil {
+		return
+	}
+
+	event.Node = server.Self
+	event.Term = server.Term
+	event.Time = server.config.Clock.Now()
+
+	tracer.lock <- true
+	defer func() {
+		<-tracer.lock
+	}()
+
+	if tracer.failed {
+		return
+	}
+
+	event.Mono = tracer.base + time.Since(tracer.start)
+	err := tracer.encoder.Encode(event)
+	if err != nil {
+		log.Printf("Could not write trace event, no longer tracing: %v\n", err)
+		tracer.failed = true
+	}
+}
+
+// traceVote records how we answered a candidate
+func (server *Server) traceVote(candidate string, granted bool, reason string) {
+	server.trace(TraceEvent{Event: traceVote, Peer: candidate, Granted: granted, Reason: reason})
+}
+
+// setTerm moves us to a newer term, tracing why
+func (server *Server) setTerm(term uint64, reason string) {
+	from := server.Term
+	server.Term = term
+	server.trace(TraceEvent{Event: traceTerm, From: from, Reason: reason})
+}
+
+// setState changes our role, tracing why
+func (server *Server) setState(state string, reason string) {
+	if server.State == state {
+		return
+	}
+	if server.State == "leader" && server.leading != nil {
+		close(server.leading)
+		server.leading = nil
+	}
+	if state == "leader" {
+		server.leading = make(chan bool)
+	}
+
+	server.State = state
+	server.trace(TraceEvent{Event: traceRole, Role: state, Reason: reason})
+}
+
+// setCommitIndex moves commitIndex, tracing it when it moves
+func (server *Server) setCommitIndex(index uint64) {
+	if index == server.commitIndex {
+		return
+	}
+	from := server.commitIndex
+	server.commitIndex = index
+	server.trace(TraceEvent{Event: traceCommit, From: from, Index: index})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readTraceEvents(t *testing.T, path string) []TraceEvent {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	events := []TraceEvent{}
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for decoder.More() {
+		var event TraceEvent
+		if err := decoder.Decode(&event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestTraceMonoCarriesOnAcrossRestarts(t *testing.T) {
+	backend, done := openTestBackend(t)
+	defer done()
+	path := filepath.Join(backend.dataDir, "trace.jsonl")
+
+	for run := 0; run < 3; run++ {
+		tracer, err := OpenTracer(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backend.raft.tracer = tracer
+		for i := 0; i < 3; i++ {
+			backend.raft.setCommitIndex(backend.raft.commitIndex + 1)
+			time.Sleep(time.Millisecond)
+		}
+		tracer.file.Close()
+	}
+
+	events := readTraceEvents(t, path)
+	if len(events) != 9 {
+		t.Fatalf("expected 9 events, got %v", len(events))
+	}
+	for i := 1; i < len(events); i++ {
+		if events[i].Mono <= events[i-1].Mono {
+			t.Fatalf("Mono went from %v back to %v at event %v", events[i-1].Mono, events[i].Mono, i)
+		}
+	}
+}
+
+func TestTraceStopsWhenWritesFail(t *testing.T) {
+	backend, done := openTestBackend(t)
+	defer done()
+
+	tracer, err := OpenTracer(filepath.Join(backend.dataDir, "trace.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.raft.tracer = tracer
+	tracer.file.Close()
+
+	finished := make(chan bool)
+	for i := 0; i < 4; i++ {
+		go func() {
+			backend.raft.traceVote("b", false, "testing")
+			finished <- true
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		<-finished
+	}
+
+	if !tracer.failed {
+		t.Fatal("still tracing after writes failed")
+	}
+}
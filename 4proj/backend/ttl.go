@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// ttlPrefix is where giraffes' deadlines live in the disk store, in leader milliseconds. They're compared to the
+// replicated clock when a Tick is applied, so every replica expires the same giraffes at the same log index
+const ttlPrefix = "ttl/"
+
+// expireAction is what expiries are recorded as in the audit trail and watch events
+const expireAction = "ExpireGiraffe"
+
+// errNegativeTTL turns away a giraffe TTL below zero. Zero already means no expiry, so anything less is a mistake
+var errNegativeTTL = errors.New("giraffe TTL can't be negative, use 0 for never")
+
+func ttlKey(idx uint64) string {
+	return fmt.Sprintf("%v%016x", ttlPrefix, idx)
+}
+
+func putTTLOp(idx uint64, deadline int64) StoreOp {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(deadline))
+	return StoreOp{Key: ttlKey(idx), Value: value}
+}
+
+func deleteTTLOp(idx uint64) StoreOp {
+	return StoreOp{Key: ttlKey(idx), Delete: true}
+}
+
+// deadline is when a giraffe given ttl milliseconds by command expires. It counts from when the leader proposed
+// it, or the replicated clock if a new leader's clock is behind, storelock must be held
+func (backend *Backend) deadline(command Command, ttl int64) int64 {
+	start := backend.clock
+	if command.Time > start {
+		start = command.Time
+	}
+	return start + ttl
+}
+
+// ttlOps sets or leaves alone a giraffe's deadline, a ttl of 0 means no change
+func (backend *Backend) ttlOps(idx uint64, command Command, ttl int64) []StoreOp {
+	if ttl <= 0 {
+		return nil
+	}
+	return []StoreOp{putTTLOp(idx, backend.deadline(command, ttl))}
+}
+
+// expireOps deletes every giraffe whose deadline is at or before now, giving back their events so watchers can
+// be told once the ops are applied. storelock must be held
+func (backend *Backend) expireOps(index uint64, now int64) ([]StoreOp, []WatchEvent, error) {
+	due := []uint64{}
+	err := backend.disk.Scan(ttlPrefix, func(key string, value []byte) error {
+		var idx uint64
+		_, err := fmt.Sscanf(key[len(ttlPrefix):], "%x", &idx)
+		if err != nil {
+			return err
+		}
+
+		if int64(binary.BigEndian.Uint64(value)) <= now {
+			due = append(due, idx)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ops := []StoreOp{}
+	expired := []WatchEvent{}
+	for _, idx := range due {
+		ops = append(ops, deleteTTLOp(idx))
+
+		giraffe, err := backend.getGiraffe(idx)
+		if err != nil {
+			return nil, nil, err
+		}
+		if giraffe == nil {
+			continue
+		}
+
+		expired = append(expired, WatchEvent{Index: index, Action: expireAction, Giraffe: *giraffe})
+		ops = append(ops, deleteGiraffeOp(idx))
+		ops = append(ops, auditOps(index, idx, Command{Action: expireAction, Time: now}, nil)...)
+		ops = append(ops, unindexOps(giraffe)...)
+	}
+
+	if len(expired) > 0 {
+		collect, err := backend.collectHistoryOps(index)
+		if err != nil {
+			return nil, nil, err
+		}
+		ops = append(ops, collect...)
+	}
+
+	return append(ops, backend.eventOps(expired...)...), expired, nil
+}
+
+// publishExpired tells watchers about expired giraffes, storelock must be held
+func (backend *Backend) publishExpired(expired []WatchEvent) {
+	for _, event := range expired {
+		log.Printf("Giraffe %v expired\n", event.Giraffe.Idx)
+	}
+	backend.publish(expired...)
+}
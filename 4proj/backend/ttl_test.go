@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestTTLExpiresOnTick(t *testing.T) {
+	backend, done := openTestBackend(t)
+	defer done()
+
+	createAt(t, backend, 100, "mayfly", 1000, 5000)
+	createAt(t, backend, 101, "tortoise", 0, 5000)
+
+	if backend.needsTick(5999) {
+		t.Fatal("a tick was wanted before anything was due")
+	}
+	if !backend.needsTick(6000) {
+		t.Fatal("a giraffe past its TTL doesn't ask for a tick")
+	}
+
+	tick := func(now int64) {
+		_, err := applyNext(backend, NewCommand("Tick", LogTickArgs{Time: now}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tick(5999)
+	if giraffe, _ := backend.getGiraffe(100); giraffe == nil {
+		t.Fatal("giraffe expired before its deadline")
+	}
+
+	tick(6000)
+	if giraffe, _ := backend.getGiraffe(100); giraffe != nil {
+		t.Fatal("giraffe outlived its deadline")
+	}
+	if giraffe, _ := backend.getGiraffe(101); giraffe == nil {
+		t.Fatal("giraffe without a TTL expired")
+	}
+
+	// A tick from a leader whose clock is behind doesn't move time backwards
+	tick(10)
+	if backend.clock != 6000 {
+		t.Fatalf("clock went back to %v", backend.clock)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"../protos"
+)
+
+// ErrCompacted is returned to watchers asking for events we no longer have
+var ErrCompacted = errors.New("compacted, resync from snapshot")
+
+// eventPrefix is where the last WatchBufferSize events are kept, in the order they happened, so watchers can
+// carry on from where they were after a restart
+const eventPrefix = "event/"
+
+// eventFloorKey holds the index of the last event dropped from the store, watchers behind it have to resync
+const eventFloorKey = "meta/eventfloor"
+
+func eventKey(seq uint64) string {
+	return fmt.Sprintf("%v%016x", eventPrefix, seq)
+}
+
+func eventFloorOp(floor uint64) StoreOp {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, floor)
+	return StoreOp{Key: eventFloorKey, Value: value}
+}
+
+// WatchEvent describes a single committed change to a giraffe
+type WatchEvent struct {
+	Index   uint64
+	Action  string
+	Giraffe protos.Giraffe
+}
+
+// WatchArgs asks for every event after Since, waiting up to Timeout milliseconds if there are none yet
+type WatchArgs struct {
+	Since   uint64
+	Timeout int64
+}
+
+// WatchReply holds the events after WatchArgs.Since, Index is what to pass as Since next time
+type WatchReply struct {
+	Events []WatchEvent
+	Index  uint64
+}
+
+// SnapshotReply holds every giraffe as of log index Index
+type SnapshotReply struct {
+	Index    uint64
+	Giraffes []protos.Giraffe
+}
+
+// eventOps records events in the store, to go in the same batch as the change they describe, dropping the
+// oldest past WatchBufferSize. storelock must be held, and publish called with them once the batch is applied
+func (backend *Backend) eventOps(events ...WatchEvent) []StoreOp {
+	ops := []StoreOp{}
+	for i, event := range events {
+		value, _ := json.Marshal(event)
+		ops = append(ops, StoreOp{Key: eventKey(backend.eventSeq + uint64(i)), Value: value})
+	}
+
+	kept := append(backend.events[:len(backend.events):len(backend.events)], events...)
+	if dropped := len(kept) - WatchBufferSize; dropped > 0 {
+		first := backend.eventSeq - uint64(len(backend.events))
+		for i := 0; i < dropped; i++ {
+			ops = append(ops, StoreOp{Key: eventKey(first + uint64(i)), Delete: true})
+		}
+		ops = append(ops, eventFloorOp(kept[dropped-1].Index))
+	}
+
+	return ops
+}
+
+// publish keeps committed events for watchers and wakes them up, storelock must be held
+func (backend *Backend) publish(events ...WatchEvent) {
+	if len(events) == 0 {
+		return
+	}
+
+	backend.events = append(backend.events, events...)
+	backend.eventSeq += uint64(len(events))
+
+	if dropped := len(backend.events) - WatchBufferSize; dropped > 0 {
+		backend.eventFloor = backend.events[dropped-1].Index
+		backend.events = backend.events[dropped:]
+	}
+
+	close(backend.changed)
+	backend.changed = make(chan bool)
+}
+
+// loadEvents reads the events kept in the store back in, along with the floor watchers have to be past. A store
+// from before events were kept has none, so its floor starts at what it has applied
+func (backend *Backend) loadEvents() error {
+	backend.events = []WatchEvent{}
+	backend.eventSeq = 0
+
+	value, found, err := backend.disk.Get(eventFloorKey)
+	if err != nil {
+		return err
+	}
+	if !found {
+		backend.eventFloor = backend.disk.Applied()
+		return backend.disk.Apply(backend.disk.Applied(), eventFloorOp(backend.eventFloor))
+	}
+	backend.eventFloor = binary.BigEndian.Uint64(value)
+
+	return backend.disk.Scan(eventPrefix, func(key string, value []byte) error {
+		var seq uint64
+		_, err := fmt.Sscanf(key[len(eventPrefix):], "%x", &seq)
+		if err != nil {
+			return err
+		}
+
+		var event WatchEvent
+		err = json.Unmarshal(value, &event)
+		if err != nil {
+			return err
+		}
+
+		backend.events = append(backend.events, event)
+		backend.eventSeq = seq + 1
+		return nil
+	})
+}
+
+// markApplied moves our applied index forward, even for commands that failed
+func (backend *Backend) markApplied(index uint64) {
+	backend.storelock <- true
+	defer func() {
+		<-backend.storelock
+	}()
+
+	if index > backend.applied {
+		backend.applied = index
+	}
+
+	if backend.disk.Applied() < index {
+		// Commands that failed or changed nothing still need to move the store along
+		err := backend.disk.Apply(index)
+		if err != nil {
+			log.Printf("Could not mark %v as applied: %v\n", index, err)
+		}
+	}
+}
+
+// eventsSince collects events after since, storelock must be held
+func (backend *Backend) eventsSince(since uint64) ([]WatchEvent, error) {
+	if since < backend.eventFloor {
+		return nil, ErrCompacted
+	}
+
+	events := []WatchEvent{}
+	for _, event := range backend.events {
+		if event.Index > since {
+			events = append(events, event)
+		}
+	}
+
+	return events, nil
+}
+
+// Watch long-polls for committed changes after a log index
+func (backend *Backend) Watch(args *WatchArgs, reply *WatchReply) error {
+	wait := args.Timeout
+	if wait > WatchMaxTimeout {
+		wait = WatchMaxTimeout
+	}
+	timeout := time.After(time.Duration(wait) * time.Millisecond)
+
+	for {
+		backend.storelock <- true
+		events, err := backend.eventsSince(args.Since)
+		applied := backend.applied
+		changed := backend.changed
+		<-backend.storelock
+
+		if err != nil {
+			return err
+		}
+
+		if len(events) > 0 || wait <= 0 {
+			reply.Events = events
+			reply.Index = args.Since
+			if applied > reply.Index {
+				reply.Index = applied
+			}
+			// Events are published before their entry is marked applied, so they can be ahead of it
+			if len(events) > 0 && events[len(events)-1].Index > reply.Index {
+				reply.Index = events[len(events)-1].Index
+			}
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-timeout:
+			wait = 0
+		}
+	}
+}
+
+// Snapshot gives back every giraffe along with the index it is current to, for watchers to resync from
+func (backend *Backend) Snapshot(args int, reply *SnapshotReply) error {
+	backend.storelock <- true
+	defer func() {
+		<-backend.storelock
+	}()
+
+	reply.Index = backend.applied
+	reply.Giraffes = []protos.Giraffe{}
+
+	return backend.eachGiraffe(func(giraffe *protos.Giraffe) error {
+		reply.Giraffes = append(reply.Giraffes, *giraffe)
+		return nil
+	})
+}
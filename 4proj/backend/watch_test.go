@@ -0,0 +1,86 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// reopenEvents opens backend's store again in a new backend and reads its events back, the way a restart does
+func reopenEvents(t *testing.T, backend *Backend) *Backend {
+	backend.disk.Close()
+
+	reopened := CreateBackend("a", ":0", "", backend.dataDir)
+	disk, err := OpenDiskStore(filepath.Join(backend.dataDir, "giraffes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened.disk = disk
+	backend.disk = disk // for the test's cleanup
+
+	err = reopened.loadEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reopened
+}
+
+func TestWatchResumesAfterRestart(t *testing.T) {
+	backend, done := openTestBackend(t)
+	defer done()
+
+	since := backend.applied
+	createAt(t, backend, 100, "first", 0, 1000)
+	createAt(t, backend, 101, "second", 0, 1000)
+	if _, err := applyNext(backend, NewCommand("DeleteGiraffe", LogDeleteGiraffeArgs{Idx: 100})); err != nil {
+		t.Fatal(err)
+	}
+
+	var reply WatchReply
+	if err := backend.Watch(&WatchArgs{Since: since + 1}, &reply); err != nil || len(reply.Events) != 2 {
+		t.Fatalf("expected the second create and the delete, got %+v %v", reply, err)
+	}
+
+	reopened := reopenEvents(t, backend)
+	var resumed WatchReply
+	if err := reopened.Watch(&WatchArgs{Since: since + 1}, &resumed); err != nil || len(resumed.Events) != 2 {
+		t.Fatalf("expected the same events after a restart, got %+v %v", resumed, err)
+	}
+	if resumed.Events[0].Giraffe.Name != "second" || resumed.Events[1].Action != "DeleteGiraffe" {
+		t.Fatalf("events came back wrong: %+v", resumed.Events)
+	}
+	if err := reopened.Watch(&WatchArgs{Since: since}, &resumed); err != nil || len(resumed.Events) != 3 {
+		t.Fatalf("a watcher from before any events was turned away: %+v %v", resumed, err)
+	}
+}
+
+func TestWatchCompacted(t *testing.T) {
+	backend, done := openTestBackend(t)
+	defer done()
+
+	since := backend.applied
+	for i := uint64(0); i < WatchBufferSize+5; i++ {
+		createAt(t, backend, 100+i, "many", 0, 1000)
+	}
+
+	var reply WatchReply
+	if err := backend.Watch(&WatchArgs{Since: since}, &reply); err != ErrCompacted {
+		t.Fatalf("expected ErrCompacted for a watcher behind the buffer, got %v", err)
+	}
+
+	reopened := reopenEvents(t, backend)
+	if err := reopened.Watch(&WatchArgs{Since: since}, &reply); err != ErrCompacted {
+		t.Fatalf("expected ErrCompacted after a restart too, got %v", err)
+	}
+	if err := reopened.Watch(&WatchArgs{Since: reopened.eventFloor}, &reply); err != nil || len(reply.Events) != WatchBufferSize {
+		t.Fatalf("expected the last %v events from the floor, got %v %v", WatchBufferSize, len(reply.Events), err)
+	}
+
+	kept := 0
+	err := reopened.disk.Scan(eventPrefix, func(key string, value []byte) error {
+		kept++
+		return nil
+	})
+	if err != nil || kept != WatchBufferSize {
+		t.Fatalf("expected %v events in the store, found %v %v", WatchBufferSize, kept, err)
+	}
+}
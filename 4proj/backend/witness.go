@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// witnessState is a witness's State. Witnesses vote and count towards quorum like any other node, but only keep
+// their log's indexes and terms, never lead and have no giraffe store
+const witnessState = "witness"
+
+var errWitness = errors.New("this node is a witness, it can't lead")
+
+var errNoStore = errors.New("this node is a witness, it has no store")
+
+// store is the giraffe store, for RPCs that need one. Admin is registered on witnesses too, which have none.
+// storelock must be held while it's used
+func (backend *Backend) store() (*DiskStore, error) {
+	if backend.disk == nil {
+		return nil, errNoStore
+	}
+	return backend.disk, nil
+}
+
+// metadataOnly is what a witness keeps of a command. Membership changes are kept whole, witnesses need to
+// know who they're voting alongside
+func (command Command) metadataOnly() Command {
+	if isMembershipChange(command.Action) {
+		return command
+	}
+	return Command{Action: command.Action, Version: command.Version}
+}
+
+// Witness answers the frontend's health checks on a witness, the only Backend RPC it has
+type Witness struct {
+	raft *Server
+}
+
+// Healthcheck says how the witness is doing, with a Role the frontend knows not to send anything to
+func (witness *Witness) Healthcheck(args int, reply *HealthReply) error {
+	*reply = witness.raft.health()
+
+	return nil
+}
+
+// openWitness loads only the raft log, applying entries is just marking them applied
+func (backend *Backend) openWitness() error {
+	err := os.MkdirAll(backend.dataDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	backend.raft.commit = func(index uint64, command Command) (interface{}, error) {
+		return nil, nil
+	}
+
+	return backend.raft.Open(backend.dataDir, 0)
+}
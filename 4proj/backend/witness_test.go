@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestWitnessAdminHasNoStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "witness")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backend := CreateBackend("w", ":0", "a=:1,b=:2", dir)
+	config := DefaultRaftConfig()
+	config.Witness = true
+	err = backend.raft.Configure(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backend.openWitness()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin := &Admin{backend: backend}
+
+	var backup BackupReply
+	if err := admin.Backup(0, &backup); err != errNoStore {
+		t.Fatalf("expected %v backing up a witness, got %v", errNoStore, err)
+	}
+
+	var status StatusReply
+	if err := admin.Status(0, &status); err != nil {
+		t.Fatalf("status on a witness failed: %v", err)
+	}
+	if status.State != witnessState {
+		t.Fatalf("expected a witness, status says %v", status.State)
+	}
+}
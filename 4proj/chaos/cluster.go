@@ -0,0 +1,347 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"../protos"
+)
+
+// client is what the links carrying our own (and a frontend's) calls to the nodes are named after
+const client = "c"
+
+// Cluster runs backends on localhost with every connection between them going through a Link
+type Cluster struct {
+	binary  string
+	dataDir string
+
+	nodes []string // the address each backend really listens on
+	procs []*exec.Cmd
+	links map[string]*Link
+
+	leader int
+
+	acked   []protos.Giraffe // writes the cluster told us succeeded
+	unknown int              // writes that timed out, so may or may not have happened
+}
+
+// CreateCluster lays out n backends listening from port, with their links listening from proxyPort
+func CreateCluster(binary string, dataDir string, n int, port int, proxyPort int) *Cluster {
+	cluster := &Cluster{
+		binary:  binary,
+		dataDir: dataDir,
+		procs:   make([]*exec.Cmd, n),
+		links:   map[string]*Link{},
+	}
+
+	for i := 0; i < n; i++ {
+		cluster.nodes = append(cluster.nodes, fmt.Sprintf("127.0.0.1:%v", port+i))
+	}
+
+	next := proxyPort
+	for from := 0; from < n; from++ {
+		for to := 0; to < n; to++ {
+			if from == to {
+				continue
+			}
+			name := linkName(fmt.Sprint(from), fmt.Sprint(to))
+			cluster.links[name] = CreateLink(name, fmt.Sprintf("127.0.0.1:%v", next), cluster.nodes[to])
+			next++
+		}
+	}
+	for to := 0; to < n; to++ {
+		name := linkName(client, fmt.Sprint(to))
+		cluster.links[name] = CreateLink(name, fmt.Sprintf("127.0.0.1:%v", next), cluster.nodes[to])
+		next++
+	}
+
+	return cluster
+}
+
+func linkName(from string, to string) string {
+	return from + ">" + to
+}
+
+// Start opens every link and starts every backend
+func (cluster *Cluster) Start() error {
+	for _, link := range cluster.links {
+		err := link.Start()
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := range cluster.nodes {
+		err := cluster.StartNode(i)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// StartNode starts backend i, telling it to reach its peers through its own links to them
+func (cluster *Cluster) StartNode(i int) error {
+	if cluster.procs[i] != nil {
+		return fmt.Errorf("node %v is already running", i)
+	}
+
+	peers := []string{}
+	for to := range cluster.nodes {
+		if to != i {
+			peers = append(peers, nodeID(to)+"="+cluster.links[linkName(fmt.Sprint(i), fmt.Sprint(to))].Listen)
+		}
+	}
+
+	output, err := os.OpenFile(filepath.Join(cluster.dataDir, fmt.Sprintf("node%v.log", i)),
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(cluster.binary,
+		"--id", nodeID(i),
+		"--listen", cluster.nodes[i],
+		"--backend", strings.Join(peers, ","),
+		"--data", filepath.Join(cluster.dataDir, fmt.Sprintf("node%v", i)))
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	err = cmd.Start()
+	if err != nil {
+		output.Close()
+		return err
+	}
+
+	cluster.procs[i] = cmd
+	go func() {
+		cmd.Wait()
+		output.Close()
+	}()
+
+	return nil
+}
+
+// KillNode kills backend i without giving it a chance to clean up
+func (cluster *Cluster) KillNode(i int) error {
+	cmd := cluster.procs[i]
+	if cmd == nil {
+		return fmt.Errorf("node %v is not running", i)
+	}
+
+	cluster.procs[i] = nil
+	return cmd.Process.Kill()
+}
+
+// Stop kills every backend and closes every link
+func (cluster *Cluster) Stop() {
+	for i := range cluster.procs {
+		if cluster.procs[i] != nil {
+			cluster.KillNode(i)
+		}
+	}
+
+	for _, link := range cluster.links {
+		link.Close()
+	}
+}
+
+// ClientLinks are the addresses to point a frontend at so its calls go through links too
+func (cluster *Cluster) ClientLinks() []string {
+	addrs := []string{}
+	for i := range cluster.nodes {
+		addrs = append(addrs, cluster.links[linkName(client, fmt.Sprint(i))].Listen)
+	}
+	return addrs
+}
+
+// call makes an RPC to node i through the client link, giving up after timeout. Dialing is covered by the
+// timeout too, since a blackholed link never answers the HTTP handshake
+func (cluster *Cluster) call(i int, method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		rpcClient, err := rpc.DialHTTP("tcp", cluster.links[linkName(client, fmt.Sprint(i))].Listen)
+		if err != nil {
+			done <- err
+			return
+		}
+		defer rpcClient.Close()
+
+		done <- rpcClient.Call(method, args, reply)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return errTimeout
+	}
+}
+
+var errTimeout = errors.New("timed out")
+
+// nodeID is what backend i goes by
+func nodeID(i int) string {
+	return fmt.Sprintf("n%v", i)
+}
+
+// nodeIndex finds which backend an ID belongs to
+func (cluster *Cluster) nodeIndex(id string) int {
+	for i := range cluster.nodes {
+		if nodeID(i) == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// WaitLeader waits until some node says it is the leader
+func (cluster *Cluster) WaitLeader(timeout time.Duration) (int, error) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		for i := range cluster.nodes {
+			if cluster.procs[i] == nil {
+				continue
+			}
+
+			var status struct {
+				State string
+			}
+			err := cluster.call(i, "Admin.Status", 0, &status, RPCTimeout)
+			if err == nil && status.State == "leader" {
+				cluster.leader = i
+				return i, nil
+			}
+		}
+		time.Sleep(RetryInterval)
+	}
+
+	return -1, errors.New("no leader was elected")
+}
+
+// CreateGiraffeArgs mirrors the backend's
+type CreateGiraffeArgs struct {
+	Name      string
+	Client    string
+	RequestID string
+}
+
+// Write creates a giraffe, following not leader hints and trying other nodes until one takes it
+func (cluster *Cluster) Write(name string) error {
+	target := cluster.leader
+
+	var lastErr error
+	for attempt := 0; attempt < WriteAttempts; attempt++ {
+		var giraffe protos.Giraffe
+		err := cluster.call(target, "Backend.CreateGiraffe", &CreateGiraffeArgs{Name: name, Client: "chaos", RequestID: name}, &giraffe, WriteTimeout)
+		if err == nil {
+			cluster.leader = target
+			cluster.acked = append(cluster.acked, giraffe)
+			return nil
+		}
+		if err == errTimeout {
+			cluster.unknown++ // it may still commit, so we can't call it lost either way
+			cluster.leader = (target + 1) % len(cluster.nodes)
+			return err
+		}
+		lastErr = err
+
+		// Follow the leader's ID rather than its address, since the address is whichever link the follower
+		// reaches the leader through
+		hint := -1
+		if notLeader, ok := protos.ParseNotLeader(err); ok {
+			hint = cluster.nodeIndex(notLeader.LeaderID)
+		}
+		if hint >= 0 && hint != target {
+			target = hint
+		} else {
+			target = (target + 1) % len(cluster.nodes)
+			time.Sleep(RetryInterval)
+		}
+	}
+
+	return lastErr
+}
+
+// Check waits for every running node to have every acknowledged write, reporting the ones still missing
+// when timeout runs out
+func (cluster *Cluster) Check(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		missing := map[int]int{}
+		for i := range cluster.nodes {
+			if cluster.procs[i] == nil {
+				continue
+			}
+			missing[i] = cluster.missing(i)
+		}
+
+		ok := true
+		for _, count := range missing {
+			if count != 0 {
+				ok = false
+			}
+		}
+
+		if ok || time.Now().After(deadline) {
+			for i := range cluster.nodes {
+				count, running := missing[i]
+				switch {
+				case !running:
+					log.Printf("node %v: not running\n", i)
+				case count < 0:
+					log.Printf("node %v: unreachable\n", i)
+				default:
+					log.Printf("node %v: %v of %v acknowledged writes present\n", i, len(cluster.acked)-count, len(cluster.acked))
+				}
+			}
+			log.Printf("%v writes acknowledged, %v timed out with unknown outcome\n", len(cluster.acked), cluster.unknown)
+			return ok
+		}
+
+		time.Sleep(RetryInterval)
+	}
+}
+
+// missing counts the acknowledged writes node i doesn't have, or -1 if we can't ask it
+func (cluster *Cluster) missing(i int) int {
+	var snapshot struct {
+		Giraffes []protos.Giraffe
+	}
+	err := cluster.call(i, "Backend.Snapshot", 0, &snapshot, RPCTimeout)
+	if err != nil {
+		return -1
+	}
+
+	have := map[uint64]protos.Giraffe{}
+	for _, giraffe := range snapshot.Giraffes {
+		have[giraffe.Idx] = giraffe
+	}
+
+	count := 0
+	for _, giraffe := range cluster.acked {
+		if have[giraffe.Idx] != giraffe {
+			count++
+		}
+	}
+
+	return count
+}
+
+func sortedLinks(cluster *Cluster) []string {
+	names := []string{}
+	for name := range cluster.links {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,19 @@
+package main
+
+import "time"
+
+const (
+	// RPCTimeout is how long we wait on a backend for anything but a write
+	RPCTimeout = 1 * time.Second
+	// WriteTimeout is how long we wait for a write to be acknowledged before calling its outcome unknown
+	WriteTimeout = 5 * time.Second
+	// WriteAttempts is how many nodes a write is tried on before giving up
+	WriteAttempts = 5
+	// RetryInterval is how long we wait between attempts
+	RetryInterval = 200 * time.Millisecond
+
+	// LeaderTimeout is how long wait-leader waits for an election
+	LeaderTimeout = 10 * time.Second
+	// CheckTimeout is how long check waits for nodes to catch up
+	CheckTimeout = 15 * time.Second
+)
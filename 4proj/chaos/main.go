@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+func main() {
+	nodes := flag.Int("nodes", 3, "How many backends to run")
+
+	port := flag.Int("port", 9000, "The port the first backend listens on, the rest count up from it")
+
+	proxyPort := flag.Int("proxy-port", 9100, "The port the first link listens on, the rest count up from it")
+
+	source := flag.String("source", "../backend", "The backend's source directory, built before the scenario starts")
+
+	binary := flag.String("binary", "", "A prebuilt backend binary to use instead of building one")
+
+	dataDir := flag.String("data", "", "Where to keep the backends' data and logs (defaults to a new temp directory)")
+
+	flag.Parse()
+
+	if *dataDir == "" {
+		dir, err := ioutil.TempDir("", "chaos")
+		if err != nil {
+			log.Fatal(err)
+		}
+		*dataDir = dir
+	}
+	log.Printf("backend data and logs are in %v\n", *dataDir)
+
+	if *binary == "" {
+		*binary = filepath.Join(*dataDir, "backend")
+		build := exec.Command("go", "build", "-o", *binary, ".")
+		build.Dir = *source
+		build.Env = append(os.Environ(), "GO111MODULE=off")
+		build.Stdout = os.Stderr
+		build.Stderr = os.Stderr
+		err := build.Run()
+		if err != nil {
+			log.Fatalf("could not build the backend: %v", err)
+		}
+	}
+
+	cluster := CreateCluster(*binary, *dataDir, *nodes, *port, *proxyPort)
+	scenario := CreateScenario(cluster)
+
+	// Scenarios come from files, or from stdin to drive the cluster by hand
+	inputs := flag.Args()
+	if len(inputs) == 0 {
+		inputs = []string{"-"}
+	}
+
+	var err error
+	for _, path := range inputs {
+		input := os.Stdin
+		if path != "-" {
+			input, err = os.Open(path)
+			if err != nil {
+				break
+			}
+		}
+
+		err = scenario.Run(input)
+		input.Close()
+		if err != nil {
+			break
+		}
+	}
+
+	cluster.Stop()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+	if scenario.Failed() {
+		os.Exit(1)
+	}
+	log.Println("every check passed")
+}
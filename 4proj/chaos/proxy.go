@@ -0,0 +1,174 @@
+package main
+
+import (
+	"math/rand"
+	"net"
+	"time"
+)
+
+// Faults describes what a link is currently doing to the traffic going through it
+type Faults struct {
+	Latency   time.Duration
+	DropRate  float64 // chance each chunk of data kills its connection instead of going through
+	Blackhole bool    // accept and swallow everything, answering nothing
+	Cut       bool    // refuse connections outright, as in a partition
+}
+
+// Link is a TCP proxy standing in for one direction of traffic, like node 0 calling node 1
+type Link struct {
+	Name   string
+	Listen string
+	Target string
+
+	faults   Faults
+	conns    map[net.Conn]bool
+	listener net.Listener
+
+	lock chan bool
+}
+
+// CreateLink is a constructor for link
+func CreateLink(name string, listen string, target string) *Link {
+	return &Link{
+		Name:   name,
+		Listen: listen,
+		Target: target,
+
+		conns: map[net.Conn]bool{},
+		lock:  make(chan bool, 1),
+	}
+}
+
+// Start listens and proxies connections until the link is closed
+func (link *Link) Start() error {
+	listener, err := net.Listen("tcp", link.Listen)
+	if err != nil {
+		return err
+	}
+	link.listener = listener
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go link.serve(conn)
+		}
+	}()
+
+	return nil
+}
+
+// Close stops listening and drops every connection
+func (link *Link) Close() {
+	if link.listener != nil {
+		link.listener.Close()
+	}
+	link.dropAll()
+}
+
+// Faults gives back what the link is currently doing
+func (link *Link) Faults() Faults {
+	link.lock <- true
+	defer func() {
+		<-link.lock
+	}()
+
+	return link.faults
+}
+
+// SetFaults changes what the link does from now on. Cutting a link also drops the connections it already has,
+// since RPC clients hold on to theirs
+func (link *Link) SetFaults(faults Faults) {
+	link.lock <- true
+	link.faults = faults
+	<-link.lock
+
+	if faults.Cut || faults.DropRate >= 1 {
+		link.dropAll()
+	}
+}
+
+func (link *Link) dropAll() {
+	link.lock <- true
+	defer func() {
+		<-link.lock
+	}()
+
+	for conn := range link.conns {
+		conn.Close()
+	}
+	link.conns = map[net.Conn]bool{}
+}
+
+func (link *Link) track(conn net.Conn, open bool) {
+	link.lock <- true
+	defer func() {
+		<-link.lock
+	}()
+
+	if open {
+		link.conns[conn] = true
+	} else {
+		delete(link.conns, conn)
+	}
+}
+
+func (link *Link) serve(client net.Conn) {
+	if link.Faults().Cut {
+		client.Close()
+		return
+	}
+
+	server, err := net.Dial("tcp", link.Target)
+	if err != nil {
+		client.Close()
+		return
+	}
+
+	link.track(client, true)
+	link.track(server, true)
+
+	done := make(chan bool, 2)
+	go link.pipe(server, client, done)
+	go link.pipe(client, server, done)
+	<-done
+
+	client.Close()
+	server.Close()
+	link.track(client, false)
+	link.track(server, false)
+}
+
+// pipe copies src to dst a chunk at a time, applying whatever faults are set when each chunk arrives
+func (link *Link) pipe(dst net.Conn, src net.Conn, done chan bool) {
+	defer func() {
+		done <- true
+	}()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			faults := link.Faults()
+			if faults.Cut || (faults.DropRate > 0 && rand.Float64() < faults.DropRate) {
+				return
+			}
+			if faults.Blackhole {
+				continue
+			}
+			if faults.Latency > 0 {
+				time.Sleep(faults.Latency)
+			}
+
+			_, werr := dst.Write(buf[:n])
+			if werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return // closed on either end, or dropped by us
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scenario runs chaos commands against a cluster, one per line. Lines starting with # are ignored.
+//
+//	start                       start every backend that isn't running
+//	start-node <n>              start a backend that was killed
+//	kill <n>                    kill a backend
+//	wait-leader                 wait for a leader to be elected
+//	write <count>               create giraffes, remembering the ones acknowledged
+//	sleep <duration>            e.g. sleep 2s
+//	partition <members> | ...   cut every link between members of different groups, c is the client.
+//	                            A member named twice stays in the first group it was named in
+//	latency <links> <duration>  delay everything on the links
+//	drop <links> <rate>         kill connections on the links, a rate of 1 drops them all
+//	blackhole <links>           swallow everything on the links without answering
+//	heal [links]                clear every fault, or just the ones on some links
+//	links                       print every link and what it's doing
+//	check                       wait for every running node to have every acknowledged write
+//
+// <links> is all, a-b for both directions between a and b, or a>b for just a calling b. Anywhere a node
+// is named, leader stands for the last node seen leading
+type Scenario struct {
+	cluster *Cluster
+	started bool
+	failed  bool
+	writes  int
+}
+
+// CreateScenario is a constructor for scenario
+func CreateScenario(cluster *Cluster) *Scenario {
+	return &Scenario{cluster: cluster}
+}
+
+// Run reads and runs commands until the end of input, stopping at the first one that can't run
+func (scenario *Scenario) Run(input io.Reader) error {
+	scanner := bufio.NewScanner(input)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		log.Printf("> %v\n", text)
+		err := scenario.exec(strings.Fields(text))
+		if err != nil {
+			return fmt.Errorf("line %v: %v", line, err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Failed says whether any check found acknowledged writes missing
+func (scenario *Scenario) Failed() bool {
+	return scenario.failed
+}
+
+func (scenario *Scenario) exec(args []string) error {
+	cluster := scenario.cluster
+
+	for i := 1; i < len(args); i++ {
+		args[i] = strings.Replace(args[i], "leader", strconv.Itoa(cluster.leader), -1)
+	}
+
+	switch args[0] {
+	case "start":
+		if scenario.started {
+			for i := range cluster.nodes {
+				if cluster.procs[i] == nil {
+					err := cluster.StartNode(i)
+					if err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}
+		scenario.started = true
+		err := cluster.Start()
+		if err == nil {
+			log.Printf("point a frontend at --backend %v\n", strings.Join(cluster.ClientLinks(), ","))
+		}
+		return err
+	case "start-node", "kill":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: %v <node>", args[0])
+		}
+		i, err := scenario.node(args[1])
+		if err != nil {
+			return err
+		}
+		if args[0] == "kill" {
+			return cluster.KillNode(i)
+		}
+		return cluster.StartNode(i)
+	case "wait-leader":
+		leader, err := cluster.WaitLeader(LeaderTimeout)
+		if err == nil {
+			log.Printf("node %v is leading\n", leader)
+		}
+		return err
+	case "write":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: write <count>")
+		}
+		count, err := strconv.Atoi(args[1])
+		if err != nil {
+			return err
+		}
+		failed := 0
+		for i := 0; i < count; i++ {
+			scenario.writes++
+			if cluster.Write(fmt.Sprintf("chaos-%v", scenario.writes)) != nil {
+				failed++
+			}
+		}
+		log.Printf("%v of %v writes acknowledged\n", count-failed, count)
+		return nil
+	case "sleep":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: sleep <duration>")
+		}
+		duration, err := time.ParseDuration(args[1])
+		if err != nil {
+			return err
+		}
+		time.Sleep(duration)
+		return nil
+	case "partition":
+		return scenario.partition(args[1:])
+	case "latency", "drop":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: %v <links> <amount>", args[0])
+		}
+		return scenario.each(args[1], func(link *Link, faults Faults) (Faults, error) {
+			var err error
+			if args[0] == "latency" {
+				faults.Latency, err = time.ParseDuration(args[2])
+			} else {
+				faults.DropRate, err = strconv.ParseFloat(args[2], 64)
+			}
+			return faults, err
+		})
+	case "blackhole":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: blackhole <links>")
+		}
+		return scenario.each(args[1], func(link *Link, faults Faults) (Faults, error) {
+			faults.Blackhole = true
+			return faults, nil
+		})
+	case "heal":
+		selector := "all"
+		if len(args) > 1 {
+			selector = args[1]
+		}
+		return scenario.each(selector, func(link *Link, faults Faults) (Faults, error) {
+			return Faults{}, nil
+		})
+	case "links":
+		for _, name := range sortedLinks(cluster) {
+			link := cluster.links[name]
+			log.Printf("%v %v -> %v %+v\n", name, link.Listen, link.Target, link.Faults())
+		}
+		return nil
+	case "check":
+		if !cluster.Check(CheckTimeout) {
+			log.Println("CHECK FAILED: acknowledged writes are missing")
+			scenario.failed = true
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown command %v", args[0])
+}
+
+// node parses a backend's number
+func (scenario *Scenario) node(arg string) (int, error) {
+	i, err := strconv.Atoi(arg)
+	if err != nil || i < 0 || i >= len(scenario.cluster.nodes) {
+		return 0, fmt.Errorf("no node %v", arg)
+	}
+	return i, nil
+}
+
+// each changes the faults on every link the selector picks
+func (scenario *Scenario) each(selector string, fn func(*Link, Faults) (Faults, error)) error {
+	names := []string{}
+	switch {
+	case selector == "all":
+		names = sortedLinks(scenario.cluster)
+	case strings.Contains(selector, ">"):
+		names = append(names, selector)
+	case strings.Contains(selector, "-"):
+		ends := strings.SplitN(selector, "-", 2)
+		names = append(names, linkName(ends[0], ends[1]), linkName(ends[1], ends[0]))
+	default:
+		return fmt.Errorf("bad links %v, expected all, a-b or a>b", selector)
+	}
+
+	found := false
+	for _, name := range names {
+		link, ok := scenario.cluster.links[name]
+		if !ok {
+			continue // the client only has links one way
+		}
+		found = true
+
+		faults, err := fn(link, link.Faults())
+		if err != nil {
+			return err
+		}
+		link.SetFaults(faults)
+	}
+
+	if !found {
+		return fmt.Errorf("no links match %v", selector)
+	}
+
+	return nil
+}
+
+// partition cuts every link between members of different groups, leaving anyone not named alone
+func (scenario *Scenario) partition(args []string) error {
+	group := map[string]int{}
+	current := 0
+	for _, arg := range args {
+		if arg == "|" {
+			current++
+			continue
+		}
+		if _, named := group[arg]; !named {
+			group[arg] = current
+		}
+	}
+
+	if current == 0 {
+		return fmt.Errorf("usage: partition <members> | <members> ...")
+	}
+
+	for _, link := range scenario.cluster.links {
+		ends := strings.SplitN(link.Name, ">", 2)
+		from, fromNamed := group[ends[0]]
+		to, toNamed := group[ends[1]]
+		if fromNamed && toNamed && from != to {
+			faults := link.Faults()
+			faults.Cut = true
+			link.SetFaults(faults)
+		}
+	}
+
+	return nil
+}
@@ -1,12 +1,26 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"log"
 	"net/rpc"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
-	"4proj/frontend/protos"
+	"4proj/protos"
+	"4proj/tlsconf"
+)
+
+const (
+	// WriteAttempts is how many times a write is tried before giving up
+	WriteAttempts = 5
+	// WriteBackoff is how long to wait before the first retry, doubling each time
+	WriteBackoff = 100 * time.Millisecond
 )
 
 // Node represents a single node and the client we use to communicate with them
@@ -15,6 +29,9 @@ type Node struct {
 	Alive bool
 
 	Client *rpc.Client
+	tls    *tls.Config
+
+	health HealthReply // as of when we connected
 
 	lock chan bool
 }
@@ -24,19 +41,57 @@ type Backend struct {
 	nodes   map[string]*Node
 	primary *Node // We cache the primary point of contact
 
+	leader     *Node // Writes have to go to the leader, which backends tell us about
+	leaderTerm uint64
+
+	staleness Staleness // reads within this bound are spread across every node
+	nextRead  int
+
+	tls *tls.Config
+
 	lock chan bool
 }
 
 // CreateNode is the constructor for node
-func CreateNode(addr string) *Node {
+func CreateNode(addr string, config *tls.Config) *Node {
 	return &Node{
 		Addr:   addr,
 		Client: nil,
+		tls:    config,
 
 		lock: make(chan bool, 1),
 	}
 }
 
+// Pressure is how much of a backend's log is waiting to commit
+type Pressure struct {
+	Uncommitted      int
+	UncommittedBytes int64
+
+	MaxUncommitted      int
+	MaxUncommittedBytes int64
+
+	Overloaded bool
+}
+
+// HealthReply is a backend's view of itself
+type HealthReply struct {
+	Ready bool
+
+	Role       string
+	Term       uint64
+	Leader     string
+	LeaderAddr string
+
+	SinceHeartbeat time.Duration
+	ApplyLag       uint64
+
+	CanWrite          bool
+	CanReadLinearized bool
+
+	Pressure Pressure
+}
+
 func (node *Node) connect() error {
 	node.lock <- true
 	defer func() {
@@ -47,22 +102,50 @@ func (node *Node) connect() error {
 		return nil
 	}
 
-	client, err := rpc.DialHTTP("tcp", node.Addr)
+	client, err := tlsconf.DialRPC(node.Addr, node.Addr, rpc.DefaultRPCPath, node.tls)
 	if err != nil {
 		return err
 	}
 
-	var fit bool
-	err = client.Call("Backend.Healthcheck", 0, &fit)
-	if err != nil || !fit {
+	var health HealthReply
+	err = client.Call("Backend.Healthcheck", 0, &health)
+	if err != nil || !health.Ready {
 		client.Close()
 		return errors.New("Node is not okay")
 	}
+	if health.Role == "witness" {
+		client.Close()
+		return errors.New("Node is a witness, it has no giraffes")
+	}
 
 	node.Client = client
+	node.health = health
 	return nil
 }
 
+// call makes an RPC on this node, dropping the connection if it broke
+func (node *Node) call(method string, args interface{}, reply interface{}) error {
+	err := node.connect()
+	if err != nil {
+		return err
+	}
+
+	node.lock <- true
+	client := node.Client
+	<-node.lock
+
+	if client == nil {
+		return errors.New("Client died mid-connection")
+	}
+
+	err = client.Call(method, args, reply)
+	if _, ok := err.(rpc.ServerError); err != nil && !ok {
+		node.close()
+	}
+
+	return err
+}
+
 func (node *Node) close() {
 	node.lock <- true
 	defer func() {
@@ -77,22 +160,23 @@ func (node *Node) close() {
 	node.Client = nil
 }
 
-func parseBackends(backends string) map[string]*Node {
+func parseBackends(backends string, config *tls.Config) map[string]*Node {
 	nodes := map[string]*Node{}
 
 	for _, addr := range strings.FieldsFunc(backends, func(c rune) bool {
 		return c == ','
 	}) {
-		nodes[addr] = CreateNode(addr)
+		nodes[addr] = CreateNode(addr, config)
 	}
 
 	return nodes
 }
 
-// CreateBackend is a constructor for the backend
-func CreateBackend(backends string) *Backend {
+// CreateBackend is a constructor for the backend, config is nil unless backends want mutual TLS
+func CreateBackend(backends string, config *tls.Config) *Backend {
 	return &Backend{
-		nodes: parseBackends(backends),
+		nodes: parseBackends(backends, config),
+		tls:   config,
 		lock:  make(chan bool, 1),
 	}
 }
@@ -104,6 +188,12 @@ func (backend *Backend) connectNode(node *Node) {
 		return
 	}
 
+	if node.health.CanWrite {
+		backend.followHint(node.Addr, node.health.Term)
+	} else if node.health.LeaderAddr != "" {
+		backend.followHint(node.health.LeaderAddr, node.health.Term)
+	}
+
 	backend.lock <- true
 	defer func() {
 		<-backend.lock
@@ -124,106 +214,319 @@ func (backend *Backend) selectPrimary() error {
 		return nil
 	}
 	for _, node := range backend.nodes {
-		if node.Client != nil { // We just grab the first node we see
+		if node.Client == nil {
+			go backend.connectNode(node)
+			continue
+		}
+
+		// The node furthest along applying what's committed makes the best primary, the leader if it's caught up
+		if backend.primary == nil || node.health.ApplyLag < backend.primary.health.ApplyLag ||
+			(node.health.ApplyLag == backend.primary.health.ApplyLag && node.health.CanReadLinearized) {
 			backend.primary = node
-			return nil
 		}
+	}
 
-		go backend.connectNode(node)
+	if backend.primary == nil {
+		return errors.New("No node is fit to be primary yet")
 	}
 
-	return errors.New("No node is fit to be primary yet")
+	return nil
 }
 
-// CreateGiraffe is an rpc exposed method to create a giraffe
-func (backend *Backend) CreateGiraffe(name string) (*protos.Giraffe, error) {
-	err := backend.selectPrimary() // just to make sure
+// primaryCall sends a read to the primary, dropping it as primary if it can't be reached. Errors the primary
+// answered with leave it in place, it's still the best node to ask
+func (backend *Backend) primaryCall(method string, args interface{}, reply interface{}) error {
+	err := backend.selectPrimary()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	err = backend.primary.connect()
-	if err != nil {
+	backend.lock <- true
+	primary := backend.primary
+	<-backend.lock
+
+	if primary == nil {
+		return errors.New("No node is fit to be primary yet")
+	}
+
+	err = primary.call(method, args, reply)
+	if _, ok := err.(rpc.ServerError); err != nil && !ok {
+		backend.dropPrimary(primary)
+	}
+
+	return err
+}
+
+// dropPrimary stops using node as the primary, unless another one was picked in the meantime
+func (backend *Backend) dropPrimary(node *Node) {
+	backend.lock <- true
+	defer func() {
+		<-backend.lock
+	}()
+
+	if backend.primary == node {
 		backend.primary = nil
-		return nil, err
 	}
+}
+
+func isOverloaded(err error) bool {
+	serverErr, ok := err.(rpc.ServerError)
+	return ok && strings.HasPrefix(string(serverErr), "overloaded: ")
+}
 
-	backend.primary.lock <- true
+// followHint caches the leader a backend told us about, unless we already know of a newer one
+func (backend *Backend) followHint(addr string, term uint64) {
+	backend.lock <- true
 	defer func() {
-		<-backend.primary.lock
+		<-backend.lock
 	}()
 
-	if backend.primary.Client == nil {
-		return nil, errors.New("Client died mid-connection")
+	if addr == "" {
+		backend.leader = nil
+		return
 	}
 
-	log.Printf("Rpc to %v\n", backend.primary.Addr)
+	if backend.leader != nil && term < backend.leaderTerm {
+		return
+	}
 
-	var reply protos.Giraffe
-	err = backend.primary.Client.Call("Backend.CreateGiraffe", &name, &reply)
-	if err != nil {
-		<-backend.primary.lock
-		backend.primary.close()
-		backend.primary.lock <- true
-		backend.primary = nil
-		return nil, err
+	node, found := backend.nodes[addr]
+	if !found {
+		node = CreateNode(addr, backend.tls)
+		backend.nodes[addr] = node
 	}
 
-	return &reply, nil
+	backend.leader = node
+	backend.leaderTerm = term
 }
 
-// ReadGiraffe is an RPC exposed method to read a giraffe
-func (backend *Backend) ReadGiraffe(idx uint64) (*protos.Giraffe, error) {
-	err := backend.selectPrimary() // just to make sure
-	if err != nil {
-		backend.primary = nil
-		return nil, err
+// writeTarget is the cached leader, or any node we can reach to ask who the leader is
+func (backend *Backend) writeTarget() (*Node, error) {
+	backend.lock <- true
+	leader := backend.leader
+	<-backend.lock
+
+	if leader != nil {
+		return leader, nil
 	}
 
-	var giraffe protos.Giraffe
-	err = backend.primary.Client.Call("Backend.ReadGiraffe", &idx, &giraffe)
+	err := backend.selectPrimary()
 	if err != nil {
-		backend.primary = nil
 		return nil, err
 	}
 
-	return &giraffe, nil
+	backend.lock <- true
+	defer func() {
+		<-backend.lock
+	}()
+
+	if backend.primary == nil {
+		return nil, errors.New("No node is fit to be primary yet")
+	}
+
+	return backend.primary, nil
 }
 
-// LogEditGiraffeArgs will keep all information necessary to edit a giraffe later
-type LogEditGiraffeArgs struct {
-	Idx        uint64
+// write sends a write to the leader, following leader hints and backing off between attempts
+func (backend *Backend) write(method string, args interface{}, reply interface{}) error {
+	backoff := WriteBackoff
+	var err error
+
+	for attempt := 0; attempt < WriteAttempts; attempt++ {
+		var node *Node
+		node, err = backend.writeTarget()
+		if err == nil {
+			log.Printf("Rpc to %v\n", node.Addr)
+			err = node.call(method, args, reply)
+			if err == nil {
+				backend.lock <- true
+				term := backend.leaderTerm
+				<-backend.lock
+
+				backend.followHint(node.Addr, term)
+				return nil
+			}
+
+			if notLeader, ok := protos.ParseNotLeader(err); ok {
+				backend.followHint(notLeader.Leader, notLeader.Term)
+				if notLeader.Leader != "" && notLeader.Leader != node.Addr {
+					continue // we were told exactly where to go, no need to wait
+				}
+			} else if isOverloaded(err) {
+				log.Printf("%v is overloaded, backing off\n", node.Addr) // the write wasn't added, so it's safe to retry
+			} else if _, ok := err.(rpc.ServerError); ok {
+				return err // the leader turned the write down, trying again won't help
+			} else {
+				backend.followHint("", 0)
+				backend.dropPrimary(node)
+			}
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	return err
+}
+
+// CreateGiraffeArgs names a new giraffe, and who is creating it: Client is us, OnBehalfOf the web client we're
+// acting for. TTL is milliseconds until it expires, 0 for never. RequestID makes retrying the create safe,
+// backends give back what an earlier try with it made
+type CreateGiraffeArgs struct {
 	Name       string
-	NeckLength uint64
+	Client     string
+	OnBehalfOf string
+
+	TTL       int64
+	RequestID string
 }
 
-// UpdateGiraffe is an RPC exposed method to update an entry
-func (backend *Backend) UpdateGiraffe(args *LogEditGiraffeArgs) error {
-	err := backend.selectPrimary() // just to make sure
+// newRequestID makes an ID for a write that's unique enough to never collide with another client's
+func newRequestID() string {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
 	if err != nil {
-		backend.primary = nil
-		return err
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(id)
+}
+
+// CreateGiraffe is an rpc exposed method to create a giraffe, client is who asked for it
+func (backend *Backend) CreateGiraffe(args *CreateGiraffeArgs) (*protos.Giraffe, error) {
+	if args.RequestID == "" {
+		args.RequestID = newRequestID() // write retries after errors that leave it unclear whether it went through
 	}
 
 	var reply protos.Giraffe
-	err = backend.primary.Client.Call("Backend.EditGiraffe", args, &reply)
+	err := backend.write("Backend.CreateGiraffe", args, &reply)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return &reply, nil
+}
+
+// Staleness bounds how far behind the leader a backend can be and still answer a read, in committed entries
+// it hasn't applied or time since it heard from the leader. Zero fields aren't checked
+type Staleness struct {
+	MaxLag uint64
+	MaxAge time.Duration
+}
+
+// UseStaleReads lets reads go to any backend within bound instead of only the primary
+func (backend *Backend) UseStaleReads(bound Staleness) {
+	backend.staleness = bound
+}
+
+func isStaleRead(err error) bool {
+	serverErr, ok := err.(rpc.ServerError)
+	return ok && strings.HasPrefix(string(serverErr), "stale read: ")
 }
 
-// DeleteGiraffe is an RPC exposed method to delete an entry
-func (backend *Backend) DeleteGiraffe(idx uint64) error {
-	err := backend.selectPrimary() // just to make sure
+// readOrder takes turns on which node a read tries first, then goes around the rest
+func (backend *Backend) readOrder() []*Node {
+	backend.lock <- true
+	defer func() {
+		<-backend.lock
+	}()
+
+	addrs := []string{}
+	for addr := range backend.nodes {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	order := []*Node{}
+	for i := range addrs {
+		order = append(order, backend.nodes[addrs[(backend.nextRead+i)%len(addrs)]])
+	}
+	backend.nextRead++
+
+	return order
+}
+
+// spreadRead sends a read to the next node in turn, moving on when a node is too far behind or can't be reached
+func (backend *Backend) spreadRead(method string, args interface{}, reply interface{}) error {
+	err := errors.New("No nodes to read from")
+	for _, node := range backend.readOrder() {
+		err = node.call(method, args, reply)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(rpc.ServerError); ok && !isStaleRead(err) {
+			return err // the node answered, it just wasn't good news
+		}
+		log.Printf("Reading from %v failed, trying the next node: %v\n", node.Addr, err)
+	}
+
+	return err
+}
+
+// ReadGiraffeArgs picks a giraffe and how stale an answer can be
+type ReadGiraffeArgs struct {
+	Idx       uint64
+	Staleness Staleness
+}
+
+// read sends a read to any node within our staleness bound if we have one, or the primary if not
+func (backend *Backend) read(method string, args interface{}, reply interface{}) error {
+	if backend.staleness != (Staleness{}) {
+		return backend.spreadRead(method, args, reply)
+	}
+	return backend.primaryCall(method, args, reply)
+}
+
+// ReadGiraffe is an RPC exposed method to read a giraffe
+func (backend *Backend) ReadGiraffe(idx uint64) (*protos.Giraffe, error) {
+	args := &ReadGiraffeArgs{Idx: idx, Staleness: backend.staleness}
+	var giraffe protos.Giraffe
+
+	err := backend.read("Backend.ReadGiraffe", args, &giraffe)
 	if err != nil {
-		backend.primary = nil
-		return err
+		return nil, err
 	}
 
+	return &giraffe, nil
+}
+
+// EditGiraffeArgs will keep all information necessary to edit a giraffe later, and who is editing it. TTL is
+// milliseconds from now until it expires, 0 keeps its deadline. An empty Species or BirthDate keeps the old one
+// unless ClearSpecies or ClearBirthDate is set
+type EditGiraffeArgs struct {
+	Idx            uint64
+	Name           string
+	NeckLength     uint64
+	Species        string
+	BirthDate      string
+	ClearSpecies   bool
+	ClearBirthDate bool
+
+	Client     string
+	OnBehalfOf string
+	TTL        int64
+}
+
+// UpdateGiraffe is an RPC exposed method to update an entry
+func (backend *Backend) UpdateGiraffe(args *EditGiraffeArgs) error {
+	var reply protos.Giraffe
+	return backend.write("Backend.EditGiraffe", args, &reply)
+}
+
+// DeleteGiraffeArgs says which giraffe to delete, and who is deleting it. RequestID has a retried delete that
+// already went through succeed instead of finding nothing to delete
+type DeleteGiraffeArgs struct {
+	Idx        uint64
+	Client     string
+	OnBehalfOf string
+
+	RequestID string
+}
+
+// DeleteGiraffe is an RPC exposed method to delete an entry, onBehalfOf is who asked us to
+func (backend *Backend) DeleteGiraffe(idx uint64, onBehalfOf string) error {
 	var success bool
-	err = backend.primary.Client.Call("Backend.DeleteGiraffe", &idx, &success)
+	args := &DeleteGiraffeArgs{Idx: idx, Client: clientName, OnBehalfOf: onBehalfOf, RequestID: newRequestID()}
+	err := backend.write("Backend.DeleteGiraffe", args, &success)
 	if err != nil {
 		return err
 	}
@@ -235,40 +538,95 @@ func (backend *Backend) DeleteGiraffe(idx uint64) error {
 	return nil
 }
 
-// ListEntries will grab all of the entries for a particular store
-func (backend *Backend) ListEntries() ([]protos.Giraffe, error) {
-	err := backend.selectPrimary()
+// ListEntriesArgs asks for a page of giraffes, Token comes from a previous reply's Next or Prev
+type ListEntriesArgs struct {
+	Token    string
+	PageSize int
+
+	Staleness Staleness
+}
+
+// ListEntriesReply holds a page of giraffes ordered by Idx, along with tokens for the pages around it
+type ListEntriesReply struct {
+	Giraffes []protos.Giraffe
+	Next     string
+	Prev     string
+}
+
+// ListEntries will grab a page of the entries for a particular store
+func (backend *Backend) ListEntries(token string, pageSize int) (*ListEntriesReply, error) {
+	args := &ListEntriesArgs{
+		Token:     token,
+		PageSize:  pageSize,
+		Staleness: backend.staleness,
+	}
+
+	var page ListEntriesReply
+	err := backend.read("Backend.ListEntries", args, &page)
 	if err != nil {
-		backend.primary = nil
 		return nil, err
 	}
 
-	err = backend.primary.connect()
+	return &page, nil
+}
+
+// QueryArgs filters, sorts and limits a giraffe query. Filters left empty match everything
+type QueryArgs struct {
+	Name          string
+	NamePrefix    string
+	MinNeckLength *uint64
+	MaxNeckLength *uint64
+
+	SortBy     string
+	Descending bool
+	Limit      int
+
+	Staleness Staleness
+}
+
+// QueryGiraffes searches giraffes using the backend's secondary indexes
+func (backend *Backend) QueryGiraffes(args *QueryArgs) ([]protos.Giraffe, error) {
+	args.Staleness = backend.staleness
+
+	var entries []protos.Giraffe
+	err := backend.read("Backend.QueryGiraffes", args, &entries)
 	if err != nil {
-		backend.primary.close()
-		backend.primary = nil
-		return nil, errors.New("Need to select a new primary")
+		return nil, err
 	}
 
-	backend.primary.lock <- true
-	defer func() {
-		<-backend.primary.lock
-	}()
+	return entries, nil
+}
 
-	if backend.primary.Client == nil {
-		return nil, errors.New("Primary client died mid-connection")
-	}
+// AuditRecord is one change to a giraffe, who asked for it and when. Giraffe is nil if it was deleted
+type AuditRecord struct {
+	Index      uint64
+	Action     string
+	Client     string
+	OnBehalfOf string
+	Time       int64
+	Giraffe    *protos.Giraffe
+}
 
-	var entries []protos.Giraffe
-	err = backend.primary.Client.Call("Backend.ListEntries", 0, &entries)
+// When formats the record's time for people
+func (record AuditRecord) When() string {
+	return time.Unix(0, record.Time*int64(time.Millisecond)).Format("2006-01-02 15:04:05")
+}
 
+// GiraffeHistoryArgs picks a giraffe and how stale an answer can be
+type GiraffeHistoryArgs struct {
+	Idx       uint64
+	Staleness Staleness
+}
+
+// GiraffeHistory grabs every recorded change to a giraffe, oldest first
+func (backend *Backend) GiraffeHistory(idx uint64) ([]AuditRecord, error) {
+	args := &GiraffeHistoryArgs{Idx: idx, Staleness: backend.staleness}
+
+	var records []AuditRecord
+	err := backend.read("Backend.GiraffeHistory", args, &records)
 	if err != nil {
-		<-backend.primary.lock
-		backend.primary.close()
-		backend.primary.lock <- true
-		backend.primary = nil
 		return nil, err
 	}
 
-	return entries, nil
+	return records, nil
 }
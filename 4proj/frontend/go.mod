@@ -16,6 +16,8 @@ require (
 	github.com/iris-contrib/go.uuid v2.0.0+incompatible // indirect
 	github.com/json-iterator/go v1.1.8 // indirect
 	github.com/kataras/golog v0.0.9 // indirect
+	4proj/protos v0.0.0
+	4proj/tlsconf v0.0.0
 	github.com/kataras/iris v11.1.1+incompatible
 	github.com/klauspost/compress v1.9.4 // indirect
 	github.com/microcosm-cc/bluemonday v1.0.2 // indirect
@@ -24,3 +26,7 @@ require (
 	golang.org/x/crypto v0.0.0-20191206172530-e9b2fee46413 // indirect
 	gopkg.in/yaml.v2 v2.2.7 // indirect
 )
+
+replace 4proj/protos => ../protos
+
+replace 4proj/tlsconf => ../tlsconf
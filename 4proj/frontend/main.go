@@ -1,8 +1,12 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"log"
+
+	"4proj/tlsconf"
 )
 
 func main() {
@@ -12,8 +16,28 @@ func main() {
 
 	backends := flag.String("backend", ":8081,:8082", "The other backends available")
 
+	tlsCert := flag.String("tls-cert", "", "PEM client certificate for talking to backends, turns on mutual TLS")
+
+	tlsKey := flag.String("tls-key", "", "PEM key for --tls-cert")
+
+	tlsCA := flag.String("tls-ca", "", "PEM CA that backends' certificates must be signed by")
+
+	maxLag := flag.Uint64("max-lag", 0, "Spread reads across backends, as long as they are at most this many committed entries behind the leader")
+
+	maxStaleness := flag.Duration("max-staleness", 0, "Spread reads across backends, as long as they heard from the leader this recently")
+
 	flag.Parse()
 
-	server := CreateWebserver(*backends)
+	var config *tls.Config
+	if *tlsCert != "" || *tlsKey != "" || *tlsCA != "" {
+		var err error
+		config, err = tlsconf.Load(*tlsCert, *tlsKey, *tlsCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	server := CreateWebserver(*backends, config)
+	server.backend.UseStaleReads(Staleness{MaxLag: *maxLag, MaxAge: *maxStaleness})
 	server.ListenAndServe(*addr)
 }
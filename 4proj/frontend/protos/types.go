@@ -1,8 +0,0 @@
-package protos
-
-// Giraffe s aren't real
-type Giraffe struct {
-	Idx        uint64
-	Name       string
-	NeckLength uint64
-}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"log"
 
 	"github.com/kataras/iris"
@@ -13,12 +14,12 @@ type Webserver struct {
 }
 
 // CreateWebserver serves as a constructor for the webserver
-func CreateWebserver(backends string) *Webserver {
+func CreateWebserver(backends string, config *tls.Config) *Webserver {
 	app := iris.Default()
 
 	server := &Webserver{
 		app:     app,
-		backend: CreateBackend(backends),
+		backend: CreateBackend(backends, config),
 	}
 
 	app.RegisterView(iris.HTML("./views", ".html"))
@@ -39,7 +40,16 @@ func (server *Webserver) ListenAndServe(addr string) error {
 }
 
 func (server *Webserver) index(ctx iris.Context) {
-	entries, err := server.backend.ListEntries()
+	page := &ListEntriesReply{}
+	size := ctx.URLParamIntDefault("size", 0)
+	var err error
+
+	if query := parseQuery(ctx); query != nil {
+		page.Giraffes, err = server.backend.QueryGiraffes(query)
+	} else {
+		page, err = server.backend.ListEntries(ctx.URLParam("page"), size)
+	}
+
 	if err != nil {
 		ctx.StatusCode(500)
 		ctx.ViewData("Error", err)
@@ -47,14 +57,70 @@ func (server *Webserver) index(ctx iris.Context) {
 		return
 	}
 
-	ctx.ViewData("Giraffes", entries)
+	ctx.ViewData("Giraffes", page.Giraffes)
+	ctx.ViewData("Next", page.Next)
+	ctx.ViewData("Prev", page.Prev)
+	ctx.ViewData("Size", size) // so paging keeps the page size asked for
+	ctx.ViewData("Query", ctx.URLParams())
 	ctx.View("index.html")
 }
 
+// parseQuery builds a giraffe query out of the search form, or nil if nothing was searched for
+func parseQuery(ctx iris.Context) *QueryArgs {
+	query := &QueryArgs{
+		Name:       ctx.URLParam("name"),
+		NamePrefix: ctx.URLParam("prefix"),
+		SortBy:     ctx.URLParam("sort"),
+		Descending: ctx.URLParam("order") == "desc",
+		Limit:      ctx.URLParamIntDefault("limit", 0),
+	}
+
+	if min, err := ctx.URLParamInt64("min"); err == nil && min >= 0 {
+		minNeck := uint64(min)
+		query.MinNeckLength = &minNeck
+	}
+
+	if max, err := ctx.URLParamInt64("max"); err == nil && max >= 0 {
+		maxNeck := uint64(max)
+		query.MaxNeckLength = &maxNeck
+	}
+
+	if query.Name == "" && query.NamePrefix == "" && query.SortBy == "" && query.Limit == 0 &&
+		query.MinNeckLength == nil && query.MaxNeckLength == nil {
+		return nil
+	}
+
+	return query
+}
+
+// clientName is what we call ourselves in the audit trail. Backends using TLS go by our certificate instead
+const clientName = "frontend"
+
+// clientID is who a request came from, as far as the audit trail is concerned
+func clientID(ctx iris.Context) string {
+	return ctx.RemoteAddr()
+}
+
+// formTTL reads the form's expiry in seconds as the milliseconds backends want
+func formTTL(ctx iris.Context) int64 {
+	return ctx.PostValueInt64Default("ttl", 0) * 1000
+}
+
+// formCleared says whether a form sent a field and left it empty, as opposed to not having the field at all
+func formCleared(ctx iris.Context, key string) bool {
+	values, found := ctx.FormValues()[key]
+	return found && len(values) > 0 && values[0] == ""
+}
+
 func (server *Webserver) postIndex(ctx iris.Context) {
 	log.Print("Hello from postIndex")
 
-	_, err := server.backend.CreateGiraffe(ctx.FormValue("name"))
+	_, err := server.backend.CreateGiraffe(&CreateGiraffeArgs{
+		Name:       ctx.FormValue("name"),
+		Client:     clientName,
+		OnBehalfOf: clientID(ctx),
+		TTL:        formTTL(ctx),
+	})
 	if err != nil {
 		ctx.StatusCode(500)
 		ctx.ViewData("Error", err)
@@ -80,7 +146,13 @@ func (server *Webserver) getSpecific(ctx iris.Context) {
 		ctx.View("error.html")
 	}
 
+	history, err := server.backend.GiraffeHistory(id)
+	if err != nil {
+		log.Printf("Could not get the history of giraffe %v: %v\n", id, err) // the giraffe is still worth showing
+	}
+
 	ctx.ViewData("Giraffe", giraffe)
+	ctx.ViewData("History", history)
 	ctx.View("specific.html")
 }
 
@@ -92,7 +164,7 @@ func (server *Webserver) postDelete(ctx iris.Context) {
 		ctx.View("error.html")
 	}
 
-	err = server.backend.DeleteGiraffe(id)
+	err = server.backend.DeleteGiraffe(id, clientID(ctx))
 	if err != nil {
 		ctx.StatusCode(500)
 		ctx.ViewData("Error", err)
@@ -110,10 +182,18 @@ func (server *Webserver) postEdit(ctx iris.Context) {
 		ctx.View("error.html")
 	}
 
-	err = server.backend.UpdateGiraffe(&LogEditGiraffeArgs{
+	err = server.backend.UpdateGiraffe(&EditGiraffeArgs{
 		Idx:        id,
 		Name:       ctx.FormValue("name"),
 		NeckLength: uint64(ctx.PostValueInt64Default("necklength", 0)),
+		Species:    ctx.FormValue("species"),
+		BirthDate:  ctx.FormValue("birthdate"),
+		Client:     clientName,
+		OnBehalfOf: clientID(ctx),
+		TTL:        formTTL(ctx),
+
+		ClearSpecies:   formCleared(ctx, "species"),
+		ClearBirthDate: formCleared(ctx, "birthdate"),
 	})
 
 	if err != nil {
@@ -0,0 +1,3 @@
+module 4proj/protos
+
+go 1.13
@@ -0,0 +1,60 @@
+package protos
+
+import (
+	"fmt"
+	"net/rpc"
+	"strconv"
+	"strings"
+)
+
+// notLeaderPrefix starts every not leader error, so clients can tell them from other errors once net/rpc has
+// turned them into plain text
+const notLeaderPrefix = "not leader: "
+
+// NotLeaderError is given back for writes sent to a follower, telling the client who to ask instead.
+// Leader is the leader's address and LeaderID its node ID, both empty if we don't know who the leader is right now
+type NotLeaderError struct {
+	Leader   string
+	Term     uint64
+	LeaderID string
+}
+
+func (err *NotLeaderError) Error() string {
+	return fmt.Sprintf("%vleader=%v term=%v id=%v", notLeaderPrefix, err.Leader, err.Term, err.LeaderID)
+}
+
+// ParseNotLeader gets a NotLeaderError back out of an error from an RPC call. net/rpc only carries the error's
+// text, so this is the one place that reads it
+func ParseNotLeader(err error) (*NotLeaderError, bool) {
+	var text string
+	switch err := err.(type) {
+	case *NotLeaderError:
+		return err, true
+	case rpc.ServerError:
+		text = string(err)
+	default:
+		return nil, false
+	}
+
+	if !strings.HasPrefix(text, notLeaderPrefix) {
+		return nil, false
+	}
+
+	notLeader := &NotLeaderError{}
+	for _, field := range strings.Fields(strings.TrimPrefix(text, notLeaderPrefix)) {
+		switch {
+		case strings.HasPrefix(field, "leader="):
+			notLeader.Leader = strings.TrimPrefix(field, "leader=")
+		case strings.HasPrefix(field, "term="):
+			term, err := strconv.ParseUint(strings.TrimPrefix(field, "term="), 10, 64)
+			if err != nil {
+				return nil, false
+			}
+			notLeader.Term = term
+		case strings.HasPrefix(field, "id="):
+			notLeader.LeaderID = strings.TrimPrefix(field, "id=")
+		}
+	}
+
+	return notLeader, true
+}
@@ -0,0 +1,40 @@
+package protos
+
+import (
+	"errors"
+	"net/rpc"
+	"testing"
+)
+
+func TestNotLeaderRoundTrip(t *testing.T) {
+	for _, sent := range []*NotLeaderError{
+		{Leader: "127.0.0.1:8001", Term: 7, LeaderID: "b"},
+		{Leader: "", Term: 3, LeaderID: ""}, // mid election, nobody to point at
+	} {
+		// net/rpc hands the client only the error's text
+		got, ok := ParseNotLeader(rpc.ServerError(sent.Error()))
+		if !ok {
+			t.Fatalf("%q wasn't recognised as not leader", sent.Error())
+		}
+		if *got != *sent {
+			t.Fatalf("sent %+v, parsed %+v", sent, got)
+		}
+
+		if got, ok := ParseNotLeader(sent); !ok || got != sent {
+			t.Fatalf("the typed error didn't come back as itself")
+		}
+	}
+}
+
+func TestNotLeaderIgnoresOtherErrors(t *testing.T) {
+	for _, err := range []error{
+		nil,
+		rpc.ServerError("overloaded: 100 entries waiting"),
+		errors.New("not leader: leader=a term=1 id=a"), // a local error isn't the backend's answer
+		rpc.ServerError("not leader: leader=a term=x id=a"),
+	} {
+		if _, ok := ParseNotLeader(err); ok {
+			t.Fatalf("%v was taken for not leader", err)
+		}
+	}
+}
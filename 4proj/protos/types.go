@@ -1,8 +1,92 @@
 package protos
 
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// GiraffeVersion is the schema version giraffes are written at. To add a field, add it to Giraffe, bump
+// GiraffeVersion, and add a migration from the old version to fill it in for giraffes written before it existed
+const GiraffeVersion = 2
+
 // Giraffe s aren't real
 type Giraffe struct {
 	Idx        uint64
 	Name       string
 	NeckLength uint64
+
+	// Since version 2
+	Species   string
+	BirthDate string // YYYY-MM-DD, empty if we don't know
+
+	Version uint32 // the schema version this giraffe was written at, 0 for giraffes from before versions
+}
+
+// migrations bring a giraffe's fields from the version it's keyed by up to the next one
+var migrations = map[uint32]func(fields map[string]json.RawMessage) error{
+	// Giraffes from before versions are version 1
+	0: func(fields map[string]json.RawMessage) error {
+		return nil
+	},
+	// Version 2 added species and birth dates, which nobody knew yet
+	1: func(fields map[string]json.RawMessage) error {
+		fields["Species"] = json.RawMessage(`""`)
+		fields["BirthDate"] = json.RawMessage(`""`)
+		return nil
+	},
+}
+
+// giraffeFields has Giraffe's fields without its JSON methods
+type giraffeFields Giraffe
+
+// MarshalJSON writes a giraffe at the current schema version
+func (giraffe Giraffe) MarshalJSON() ([]byte, error) {
+	fields := giraffeFields(giraffe)
+	fields.Version = GiraffeVersion
+	return json.Marshal(fields)
+}
+
+// UnmarshalJSON reads a giraffe written at any version up to ours, migrating it forward. Giraffes from a newer
+// version are refused rather than read, since writing them back would lose the fields we don't know about
+func (giraffe *Giraffe) UnmarshalJSON(raw []byte) error {
+	fields := map[string]json.RawMessage{}
+	err := json.Unmarshal(raw, &fields)
+	if err != nil {
+		return err
+	}
+
+	var version uint32
+	if rawVersion, found := fields["Version"]; found {
+		err = json.Unmarshal(rawVersion, &version)
+		if err != nil {
+			return err
+		}
+	}
+
+	if version > GiraffeVersion {
+		return fmt.Errorf("giraffe was written at schema version %v, we only understand up to %v", version, GiraffeVersion)
+	}
+
+	for ; version < GiraffeVersion; version++ {
+		err = migrations[version](fields)
+		if err != nil {
+			return fmt.Errorf("could not migrate giraffe from schema version %v: %v", version, err)
+		}
+	}
+
+	migrated, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+
+	var decoded giraffeFields
+	err = json.Unmarshal(migrated, &decoded)
+	if err != nil {
+		return err
+	}
+
+	*giraffe = Giraffe(decoded)
+	giraffe.Version = GiraffeVersion
+
+	return nil
 }
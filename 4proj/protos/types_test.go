@@ -0,0 +1,49 @@
+package protos
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestOldGiraffesMigrate(t *testing.T) {
+	for _, raw := range []string{
+		`{"Idx":4,"Name":"leon","NeckLength":15}`,             // from before versions
+		`{"Idx":4,"Name":"leon","NeckLength":15,"Version":1}`, // before species and birth dates
+	} {
+		var giraffe Giraffe
+		err := json.Unmarshal([]byte(raw), &giraffe)
+		if err != nil {
+			t.Fatalf("%v: %v", raw, err)
+		}
+
+		want := Giraffe{Idx: 4, Name: "leon", NeckLength: 15, Version: GiraffeVersion}
+		if giraffe != want {
+			t.Fatalf("%v came out as %+v", raw, giraffe)
+		}
+	}
+}
+
+func TestGiraffesWrittenAtCurrentVersion(t *testing.T) {
+	sent := Giraffe{Idx: 9, Name: "Bob", NeckLength: 12, Species: "reticulated", BirthDate: "2019-04-01"}
+	raw, err := json.Marshal(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got Giraffe
+	err = json.Unmarshal(raw, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent.Version = GiraffeVersion
+	if got != sent {
+		t.Fatalf("sent %+v, got %+v back", sent, got)
+	}
+}
+
+func TestNewerGiraffesRefused(t *testing.T) {
+	var giraffe Giraffe
+	if json.Unmarshal([]byte(`{"Idx":4,"Name":"leon","Version":99}`), &giraffe) == nil {
+		t.Fatal("read a giraffe from a newer schema version")
+	}
+}
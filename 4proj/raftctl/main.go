@@ -0,0 +1,378 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/rpc"
+	"os"
+	"strings"
+	"time"
+
+	"../protos"
+	"../tlsconf"
+)
+
+// These mirror the admin RPC types in the backend
+
+// PeerStatus is how far along the leader thinks a peer is
+type PeerStatus struct {
+	ID         string
+	Addr       string
+	NextIndex  uint64
+	MatchIndex uint64
+	Lag        uint64
+	Connected  bool
+	Priority   int
+	Witness    bool
+}
+
+// StatusReply describes a node's view of raft
+type StatusReply struct {
+	Node   string
+	Addr   string
+	State  string
+	Term   uint64
+	Leader string
+
+	LeaderAddr string
+	Priority   int
+
+	CommitIndex  uint64
+	LastApplied  uint64
+	LastLogIndex uint64
+	LogBase      uint64
+
+	Removed bool
+	Peers   []PeerStatus
+
+	LeaderLag   uint64        // committed entries we have yet to apply, as a follower
+	SinceLeader time.Duration // since we last heard from the leader, or a majority last answered it on the leader
+}
+
+// DumpLogArgs picks which log entries to dump
+type DumpLogArgs struct {
+	From   uint64
+	To     uint64
+	Action string
+}
+
+// LogEntryInfo is a log entry as it's stored
+type LogEntryInfo struct {
+	Index   uint64
+	Term    uint64
+	Action  string
+	Version uint32
+	Data    json.RawMessage
+
+	Client     string `json:",omitempty"`
+	OnBehalfOf string `json:",omitempty"`
+	Time       int64  `json:",omitempty"`
+}
+
+// MembershipArgs names a node joining or leaving the cluster
+type MembershipArgs struct {
+	ID   string
+	Addr string
+}
+
+// TransferLeaderArgs names who should take over leadership by node ID
+type TransferLeaderArgs struct {
+	Target string
+}
+
+// BackupInfo describes a backup file
+type BackupInfo struct {
+	Applied uint64
+	Records uint64
+	Bytes   int64
+}
+
+// BackupReply names a backup the leader spooled, to fetch with BackupChunk
+type BackupReply struct {
+	ID   string
+	Info BackupInfo
+}
+
+// BackupChunkArgs asks for the piece of a backup starting at Offset
+type BackupChunkArgs struct {
+	ID     string
+	Offset int64
+	Size   int
+}
+
+// BackupChunkReply is a piece of a backup, Done is set on the last one
+type BackupChunkReply struct {
+	Data []byte
+	Done bool
+}
+
+const usage = `usage: raftctl [--nodes addr,addr,...] <command> [args]
+
+commands:
+  status                     role, term, indexes and peer lag of every node
+  leader                     print the current leader's ID and address
+  add-node <id>=<addr>       add a node to the cluster, or move a member to a new address
+  remove-node <id>           take a node out of the cluster
+  transfer-leader <id>       hand leadership to another node
+  snapshot <path>            take a backup from the leader and write it to path here
+  dump-log [--node addr] [--from n] [--to n] [--action name]
+                             print log entries as JSON lines
+  merge-traces [--text] <file>...
+                             merge backends' --trace files into one timeline
+`
+
+// tlsConfig is set when backends want mutual TLS
+var tlsConfig *tls.Config
+
+func call(addr string, method string, args interface{}, reply interface{}) error {
+	path := rpc.DefaultRPCPath
+	if tlsConfig != nil {
+		path = tlsconf.AdminPath // only operators' certificates are let through there
+	}
+
+	client, err := tlsconf.DialRPC(addr, addr, path, tlsConfig)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.Call(method, args, reply)
+}
+
+// findLeader asks every node who the leader is and where it is. A leader we reached ourselves beats what
+// followers think, since they may only know an address the leader has moved away from
+func findLeader(nodes []string) (*StatusReply, error) {
+	var hint *StatusReply
+	for _, addr := range nodes {
+		var status StatusReply
+		err := call(addr, "Admin.Status", 0, &status)
+		if err != nil {
+			continue
+		}
+		if status.State == "leader" {
+			status.LeaderAddr = addr
+			return &status, nil
+		}
+		if status.LeaderAddr != "" && hint == nil {
+			hint = &status
+		}
+	}
+
+	if hint == nil {
+		return nil, errors.New("no node knows of a leader")
+	}
+
+	return hint, nil
+}
+
+// callLeader sends a write to the leader, following a not leader answer once if the leader moved
+func callLeader(nodes []string, method string, args interface{}, reply interface{}) error {
+	status, err := findLeader(nodes)
+	if err != nil {
+		return err
+	}
+
+	err = call(status.LeaderAddr, method, args, reply)
+	if err == nil {
+		return nil
+	}
+
+	notLeader, ok := protos.ParseNotLeader(err)
+	if !ok || notLeader.Leader == "" || notLeader.Leader == status.LeaderAddr {
+		return err
+	}
+
+	return call(notLeader.Leader, method, args, reply)
+}
+
+func status(nodes []string) {
+	for _, addr := range nodes {
+		var status StatusReply
+		err := call(addr, "Admin.Status", 0, &status)
+		if err != nil {
+			fmt.Printf("%v: unreachable (%v)\n", addr, err)
+			continue
+		}
+
+		removed := ""
+		if status.Removed {
+			removed = " (removed)"
+		}
+
+		fmt.Printf("%v (%v): %v%v term=%v leader=%v commit=%v applied=%v base=%v last=%v priority=%v\n", status.Node,
+			status.Addr, status.State, removed, status.Term, status.Leader, status.CommitIndex, status.LastApplied,
+			status.LogBase, status.LastLogIndex, status.Priority)
+
+		if status.State != "leader" {
+			if status.State == "follower" && status.Leader != "" {
+				fmt.Printf("  behind the leader by %v entries, heard from it %v ago\n", status.LeaderLag,
+					status.SinceLeader.Round(time.Millisecond))
+			}
+			continue
+		}
+		fmt.Printf("  a majority answered %v ago\n", status.SinceLeader.Round(time.Millisecond))
+		for _, peer := range status.Peers {
+			witness := ""
+			if peer.Witness {
+				witness = " (witness)"
+			}
+			fmt.Printf("  %v (%v)%v: match=%v next=%v lag=%v connected=%v\n", peer.ID, peer.Addr, witness,
+				peer.MatchIndex, peer.NextIndex, peer.Lag, peer.Connected)
+		}
+	}
+}
+
+func dumpLog(nodes []string, argv []string) error {
+	flags := flag.NewFlagSet("dump-log", flag.ExitOnError)
+	node := flags.String("node", nodes[0], "The node whose log to dump")
+	from := flags.Uint64("from", 0, "The first index to dump")
+	to := flags.Uint64("to", 0, "The last index to dump, 0 for the end of the log")
+	action := flags.String("action", "", "Only dump entries with this action")
+	flags.Parse(argv)
+
+	var entries []LogEntryInfo
+	err := call(*node, "Admin.DumpLog", &DumpLogArgs{From: *from, To: *to, Action: *action}, &entries)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	for _, entry := range entries {
+		err = encoder.Encode(entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// snapshot has the leader take a backup and fetches it a chunk at a time into path. It's written next to path
+// and moved there once it's all in, so a backup that failed halfway never looks like a whole one
+func snapshot(nodes []string, path string) (*BackupInfo, error) {
+	status, err := findLeader(nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	var backup BackupReply
+	err = call(status.LeaderAddr, "Admin.Backup", 0, &backup)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+
+	var offset int64
+	for {
+		var chunk BackupChunkReply
+		err = call(status.LeaderAddr, "Admin.BackupChunk", &BackupChunkArgs{ID: backup.ID, Offset: offset}, &chunk)
+		if err == nil {
+			_, err = file.Write(chunk.Data)
+		}
+		if err != nil || chunk.Done {
+			break
+		}
+		offset += int64(len(chunk.Data))
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+
+	return &backup.Info, os.Rename(tmp, path)
+}
+
+// parseMember reads id=addr, a bare address is its own ID like in the backend's --backend
+func parseMember(arg string) *MembershipArgs {
+	parts := strings.SplitN(arg, "=", 2)
+	if len(parts) == 1 {
+		return &MembershipArgs{ID: arg, Addr: arg}
+	}
+	return &MembershipArgs{ID: parts[0], Addr: parts[1]}
+}
+
+func needArg(args []string, what string) string {
+	if len(args) < 1 {
+		log.Fatalf("missing %v\n\n%v", what, usage)
+	}
+	return args[0]
+}
+
+func main() {
+	nodesFlag := flag.String("nodes", ":8080,:8081,:8082", "The backends in the cluster")
+	tlsCert := flag.String("tls-cert", "", "PEM client certificate for talking to backends, turns on mutual TLS")
+	tlsKey := flag.String("tls-key", "", "PEM key for --tls-cert")
+	tlsCA := flag.String("tls-ca", "", "PEM CA that backends' certificates must be signed by")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *tlsCert != "" || *tlsKey != "" || *tlsCA != "" {
+		config, err := tlsconf.Load(*tlsCert, *tlsKey, *tlsCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tlsConfig = config
+	}
+
+	nodes := strings.FieldsFunc(*nodesFlag, func(c rune) bool {
+		return c == ','
+	})
+	if len(nodes) == 0 || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	args := flag.Args()[1:]
+	var ok bool
+	var err error
+
+	switch flag.Arg(0) {
+	case "status":
+		status(nodes)
+	case "leader":
+		var status *StatusReply
+		status, err = findLeader(nodes)
+		if err == nil {
+			fmt.Printf("%v %v\n", status.Leader, status.LeaderAddr)
+		}
+	case "add-node":
+		err = callLeader(nodes, "Admin.AddNode", parseMember(needArg(args, "node id=address")), &ok)
+	case "remove-node":
+		err = callLeader(nodes, "Admin.RemoveNode", &MembershipArgs{ID: needArg(args, "node id")}, &ok)
+	case "transfer-leader":
+		err = callLeader(nodes, "Admin.TransferLeader", &TransferLeaderArgs{Target: needArg(args, "target node id")}, &ok)
+	case "snapshot":
+		var info *BackupInfo
+		info, err = snapshot(nodes, needArg(args, "backup path"))
+		if err == nil {
+			fmt.Printf("wrote %v records at applied index %v, %v bytes\n", info.Records, info.Applied, info.Bytes)
+		}
+	case "dump-log":
+		err = dumpLog(nodes, args)
+	case "merge-traces":
+		err = mergeTraceFiles(args)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
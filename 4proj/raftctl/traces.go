@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// TraceEvent mirrors a line of a backend's --trace file
+type TraceEvent struct {
+	Node  string
+	Term  uint64
+	Time  time.Time
+	Mono  time.Duration
+	Event string
+
+	Role    string `json:",omitempty"`
+	Peer    string `json:",omitempty"`
+	Granted bool   `json:",omitempty"`
+	Reason  string `json:",omitempty"`
+	From    uint64 `json:",omitempty"`
+	Index   uint64 `json:",omitempty"`
+	Action  string `json:",omitempty"`
+}
+
+// readTrace loads one node's trace file, in the order it was written
+func readTrace(path string) ([]TraceEvent, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	events := []TraceEvent{}
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for {
+		var event TraceEvent
+		err = decoder.Decode(&event)
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: event %v: %v", path, len(events), err)
+		}
+		events = append(events, event)
+	}
+}
+
+// byNode regroups the events of every trace into one trace per node, in the order its Mono says they
+// happened. Mono carries on across a node's restarts, so this holds however its runs were split into files
+func byNode(traces [][]TraceEvent) [][]TraceEvent {
+	nodes := map[string]int{}
+	grouped := [][]TraceEvent{}
+	for _, trace := range traces {
+		for _, event := range trace {
+			i, found := nodes[event.Node]
+			if !found {
+				i = len(grouped)
+				nodes[event.Node] = i
+				grouped = append(grouped, []TraceEvent{})
+			}
+			grouped[i] = append(grouped[i], event)
+		}
+	}
+
+	for _, trace := range grouped {
+		sort.SliceStable(trace, func(i, j int) bool {
+			return trace[i].Mono < trace[j].Mono
+		})
+	}
+	return grouped
+}
+
+// mergeTraces interleaves the traces by time. Each node's own order is kept even where its clock went
+// backwards, so a node's events never show up out of the order they happened in
+func mergeTraces(traces [][]TraceEvent) []TraceEvent {
+	traces = byNode(traces)
+	merged := []TraceEvent{}
+	heads := make([]int, len(traces))
+	for {
+		next := -1
+		for i, trace := range traces {
+			if heads[i] == len(trace) {
+				continue
+			}
+			if next == -1 || trace[heads[i]].Time.Before(traces[next][heads[next]].Time) {
+				next = i
+			}
+		}
+		if next == -1 {
+			return merged
+		}
+
+		merged = append(merged, traces[next][heads[next]])
+		heads[next]++
+	}
+}
+
+// describe is an event as a line of text
+func describe(event TraceEvent) string {
+	var what string
+	switch event.Event {
+	case "role":
+		what = fmt.Sprintf("became %v", event.Role)
+	case "term":
+		what = fmt.Sprintf("moved from term %v", event.From)
+	case "vote":
+		what = fmt.Sprintf("refused %v", event.Peer)
+		if event.Granted {
+			what = fmt.Sprintf("voted for %v", event.Peer)
+		}
+	case "append":
+		what = fmt.Sprintf("appended %v to %v", event.From, event.Index)
+		if event.From == event.Index {
+			what = fmt.Sprintf("appended %v", event.Index)
+		}
+	case "truncate":
+		what = fmt.Sprintf("truncated from %v", event.Index)
+	case "commit":
+		what = fmt.Sprintf("committed %v to %v", event.From+1, event.Index)
+		if event.From+1 == event.Index {
+			what = fmt.Sprintf("committed %v", event.Index)
+		}
+	case "apply":
+		what = fmt.Sprintf("applied %v", event.Index)
+	default:
+		what = event.Event
+	}
+
+	if event.Action != "" {
+		what += " " + event.Action
+	}
+	if event.Reason != "" {
+		what += ": " + event.Reason
+	}
+
+	return fmt.Sprintf("%v %v term=%v %v", event.Time.Format("15:04:05.000000"), event.Node, event.Term, what)
+}
+
+func mergeTraceFiles(argv []string) error {
+	flags := flag.NewFlagSet("merge-traces", flag.ExitOnError)
+	text := flags.Bool("text", false, "Print a line of text per event instead of JSON")
+	flags.Parse(argv)
+
+	if flags.NArg() == 0 {
+		return errors.New("missing trace files")
+	}
+
+	traces := [][]TraceEvent{}
+	for _, path := range flags.Args() {
+		trace, err := readTrace(path)
+		if err != nil {
+			return err
+		}
+		traces = append(traces, trace)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	for _, event := range mergeTraces(traces) {
+		if *text {
+			fmt.Println(describe(event))
+			continue
+		}
+
+		err := encoder.Encode(event)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var epoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func event(node string, at, mono int, what string) TraceEvent {
+	return TraceEvent{
+		Node:   node,
+		Time:   epoch.Add(time.Duration(at) * time.Millisecond),
+		Mono:   time.Duration(mono) * time.Millisecond,
+		Event:  "role",
+		Reason: what,
+	}
+}
+
+func reasons(events []TraceEvent) []string {
+	what := []string{}
+	for _, event := range events {
+		what = append(what, event.Reason)
+	}
+	return what
+}
+
+func expectOrder(t *testing.T, merged []TraceEvent, expected ...string) {
+	got := reasons(merged)
+	if len(got) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, got)
+		}
+	}
+}
+
+func TestMergeTracesByTime(t *testing.T) {
+	n1 := []TraceEvent{event("n1", 10, 10, "n1 campaigns"), event("n1", 30, 30, "n1 leads")}
+	n2 := []TraceEvent{event("n2", 20, 5, "n2 votes"), event("n2", 40, 25, "n2 follows")}
+	n3 := []TraceEvent{event("n3", 25, 100, "n3 votes")}
+
+	expectOrder(t, mergeTraces([][]TraceEvent{n1, n2, n3}),
+		"n1 campaigns", "n2 votes", "n3 votes", "n1 leads", "n2 follows")
+}
+
+func TestMergeTracesKeepsANodesOrderWhenItsClockStepsBack(t *testing.T) {
+	n1 := []TraceEvent{event("n1", 10, 10, "n1 first"), event("n1", 50, 20, "n1 second"), event("n1", 5, 30, "n1 third")}
+	n2 := []TraceEvent{event("n2", 20, 20, "n2 first"), event("n2", 60, 60, "n2 second")}
+
+	expectOrder(t, mergeTraces([][]TraceEvent{n1, n2}),
+		"n1 first", "n2 first", "n1 second", "n1 third", "n2 second")
+}
+
+func TestMergeTracesAcrossRestarts(t *testing.T) {
+	// n1 restarted between its runs with its clock set back, and its runs were kept in two files
+	run1 := []TraceEvent{event("n1", 10, 10, "n1 run 1"), event("n1", 40, 40, "n1 run 1 again")}
+	run2 := []TraceEvent{event("n1", 15, 45, "n1 run 2")}
+	n2 := []TraceEvent{event("n2", 20, 20, "n2"), event("n2", 50, 50, "n2 again")}
+
+	expectOrder(t, mergeTraces([][]TraceEvent{run2, n2, run1}),
+		"n1 run 1", "n2", "n1 run 1 again", "n1 run 2", "n2 again")
+}
+
+func TestMergeTraceFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "traces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	traces := map[string][]TraceEvent{
+		"n1.jsonl": {event("n1", 10, 10, "n1 campaigns"), event("n1", 30, 30, "n1 leads")},
+		"n2.jsonl": {event("n2", 20, 20, "n2 votes")},
+	}
+	paths := []string{}
+	for name, events := range traces {
+		path := filepath.Join(dir, name)
+		file, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoder := json.NewEncoder(file)
+		for _, event := range events {
+			if err := encoder.Encode(event); err != nil {
+				t.Fatal(err)
+			}
+		}
+		file.Close()
+		paths = append(paths, path)
+	}
+
+	read := [][]TraceEvent{}
+	for _, path := range paths {
+		trace, err := readTrace(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read = append(read, trace)
+	}
+	expectOrder(t, mergeTraces(read), "n1 campaigns", "n2 votes", "n1 leads")
+}
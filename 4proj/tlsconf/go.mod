@@ -0,0 +1,3 @@
+module 4proj/tlsconf
+
+go 1.13
@@ -0,0 +1,159 @@
+package tlsconf
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/rpc"
+	"time"
+)
+
+// AdminPath is where backends serve admin RPCs when TLS is on, apart from the rest so only operators can reach them
+const AdminPath = "/_adminRPC_"
+
+// Load builds a mutual TLS config from PEM cert, key and CA files. The same config serves and dials
+func Load(certFile string, keyFile string, caFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" || caFile == "" {
+		return nil, errors.New("TLS needs a cert, a key and a CA")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(raw) {
+		return nil, fmt.Errorf("no certificates found in %v", caFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		RootCAs:      pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+// CertNamed checks whether a certificate was issued to name, in its common name or a DNS name. Peers check
+// each other's node IDs, frontends and raftctl check the host:port address they dialed
+func CertNamed(cert *x509.Certificate, name string) bool {
+	if cert.Subject.CommonName == name {
+		return true
+	}
+
+	for _, dns := range cert.DNSNames {
+		if dns == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CertName is who a certificate was issued to, its common name or else its first DNS name
+func CertName(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" || len(cert.DNSNames) == 0 {
+		return cert.Subject.CommonName
+	}
+	return cert.DNSNames[0]
+}
+
+// verifyPeer checks a certificate chain against our CA and that it was issued to name
+func verifyPeer(raw [][]byte, roots *x509.CertPool, name string) error {
+	certs := []*x509.Certificate{}
+	for _, der := range raw {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return errors.New("no certificate presented")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return err
+	}
+
+	if !CertNamed(certs[0], name) {
+		return fmt.Errorf("certificate is not issued to %v", name)
+	}
+
+	return nil
+}
+
+// DialRPC connects to the RPC server at addr and path, over mutual TLS when config is set, checking the
+// certificate is issued to name
+func DialRPC(addr string, name string, path string, config *tls.Config) (*rpc.Client, error) {
+	return DialRPCTimeout(addr, name, path, config, 0)
+}
+
+// DialRPCTimeout is DialRPC giving up once connecting and the handshakes take longer than timeout, 0 waits forever.
+// A peer that accepts connections but never answers would otherwise hang us
+func DialRPCTimeout(addr string, name string, path string, config *tls.Config, timeout time.Duration) (*rpc.Client, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+
+	var conn net.Conn
+	var err error
+	if config == nil {
+		conn, err = dialer.Dial("tcp", addr)
+	} else {
+		dialConfig := config.Clone()
+		dialConfig.InsecureSkipVerify = true // IDs and host:port names don't pass the usual hostname check, verifyPeer does it all
+		dialConfig.VerifyPeerCertificate = func(raw [][]byte, chains [][]*x509.Certificate) error {
+			return verifyPeer(raw, config.RootCAs, name)
+		}
+
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, dialConfig)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	return connectRPC(conn, path)
+}
+
+// connectRPC does the HTTP CONNECT handshake net/rpc expects before it speaks RPC on a connection
+func connectRPC(conn net.Conn, path string) (*rpc.Client, error) {
+	io.WriteString(conn, "CONNECT "+path+" HTTP/1.0\n\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status != "200 Connected to Go RPC" {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{}) // calls set their own timeouts
+	return rpc.NewClient(conn), nil
+}